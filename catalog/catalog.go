@@ -0,0 +1,651 @@
+package catalog
+
+import (
+	"boro-db/filesystem"
+	"boro-db/paging"
+	"boro-db/segment"
+	"boro-db/storage"
+	"boro-db/utils/checksums"
+	"boro-db/wal"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/phuslu/log"
+)
+
+var ErrTableExists = fmt.Errorf("table already exists")
+var ErrTableNotFound = fmt.Errorf("table not found")
+var ErrIndexExists = fmt.Errorf("index already exists")
+var ErrIndexNotFound = fmt.Errorf("index not found")
+var ErrInvalidDefinition = fmt.Errorf("invalid definition")
+var ErrCatalogCorrupted = fmt.Errorf("catalog corrupted")
+
+const MaxNameLength = 255
+
+// segment holding the catalog itself , tables and indexes get one each under "catalog/"
+const catalogSegment = "catalog"
+
+/*
+System catalog
+┌──────────────────────────────────────────────────────────────┐
+| catalog page : next page (8byte) | used bytes (4byte)        |
+| catalog bytes ......                                         |
+└──────────────────────────────────────────────────────────────┘
+catalog bytes
+| crc (4byte) | applied lsn (8byte) | next id (4byte) |
+| table count (4byte) | tables | index count (4byte) | indexes |  (see record.go)
+
+  - the catalog lives in the "catalog" segment , the segment root points at the first page of the chain
+  - every table and index owns a segment ("catalog/table/<id>" , "catalog/index/<id>")
+    its root page is the root of that segment
+  - a ddl is written to the wal first , then applied and the catalog rewritten into fresh pages
+    the segment root flips to the new chain in one step and the old chain is released
+  - the catalog remembers the lsn of the last ddl it reflects , on open the ddl records after it are
+    replayed so a crash between the wal append and the rewrite loses nothing
+    a ddl that fails after it was logged is finished by the next open
+*/
+const chainHeaderSize = 12
+
+type Column struct {
+	Name string
+	Type storage.KeyType
+}
+
+type Table struct {
+	ID      uint32
+	Name    string
+	Columns []Column
+	segment *segment.Segment
+}
+
+type Index struct {
+	ID      uint32
+	Name    string
+	TableID uint32
+	// column names of the table in key order
+	Columns []string
+	Unique  bool
+	segment *segment.Segment
+}
+
+type Catalog struct {
+	logger   log.Logger
+	fs       filesystem.FileSystem
+	segments *segment.Manager
+	wal      *wal.Wal
+	lock     sync.RWMutex
+	segment  *segment.Segment
+	// pages of the persisted catalog , the root of segment first
+	chain      []uint64
+	tables     map[string]*Table
+	indexes    map[string]*Index
+	nextID     uint32
+	appliedLSN uint64
+	// usable bytes of a page , page meta excluded
+	pageSize int
+}
+
+// pages of the table are allocated through its segment
+func (t *Table) Segment() *segment.Segment {
+	return t.segment
+}
+
+func (t *Table) Root() uint64 {
+	return t.segment.Root()
+}
+
+func (t *Table) SetRoot(page uint64) error {
+	return t.segment.SetRoot(page)
+}
+
+// -1 when the table has no such column
+func (t *Table) ColumnIndex(name string) int {
+	return slices.IndexFunc(t.Columns, func(column Column) bool {
+		return column.Name == name
+	})
+}
+
+func (i *Index) Segment() *segment.Segment {
+	return i.segment
+}
+
+func (i *Index) Root() uint64 {
+	return i.segment.Root()
+}
+
+// called by the index whenever its root page moves (B+ tree root split)
+func (i *Index) SetRoot(page uint64) error {
+	return i.segment.SetRoot(page)
+}
+
+func tableSegmentName(id uint32) string {
+	return fmt.Sprintf("%s/table/%d", catalogSegment, id)
+}
+
+func indexSegmentName(id uint32) string {
+	return fmt.Sprintf("%s/index/%d", catalogSegment, id)
+}
+
+func validName(name string) error {
+	if name == "" || len(name) > MaxNameLength {
+		return fmt.Errorf("%w : name %q", ErrInvalidDefinition, name)
+	}
+	return nil
+}
+
+func (c *Catalog) CreateTable(name string, columns []Column) (*Table, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 || len(columns) > 0xFFFF {
+		return nil, fmt.Errorf("%w : table %s has %d columns", ErrInvalidDefinition, name, len(columns))
+	}
+	seen := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		if err := validName(column.Name); err != nil {
+			return nil, err
+		}
+		if seen[column.Name] {
+			return nil, fmt.Errorf("%w : duplicate column %s", ErrInvalidDefinition, column.Name)
+		}
+		if column.Type < storage.Int64 || column.Type > storage.VARCHAR {
+			return nil, fmt.Errorf("%w : column %s has unknown type %d", ErrInvalidDefinition, column.Name, column.Type)
+		}
+		seen[column.Name] = true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.tables[name]; ok {
+		return nil, fmt.Errorf("%w : %s", ErrTableExists, name)
+	}
+	table := &Table{ID: c.nextID, Name: name, Columns: slices.Clone(columns)}
+	if err := c.execute(&ddlRecord{op: opCreateTable, table: table}); err != nil {
+		return nil, err
+	}
+	return c.tables[name], nil
+}
+
+// drops the table and every index on it
+func (c *Catalog) DropTable(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	table, ok := c.tables[name]
+	if !ok {
+		return fmt.Errorf("%w : %s", ErrTableNotFound, name)
+	}
+	return c.execute(&ddlRecord{op: opDropTable, id: table.ID})
+}
+
+func (c *Catalog) CreateIndex(name string, tableName string, columns []string, unique bool) (*Index, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.indexes[name]; ok {
+		return nil, fmt.Errorf("%w : %s", ErrIndexExists, name)
+	}
+	table, ok := c.tables[tableName]
+	if !ok {
+		return nil, fmt.Errorf("%w : %s", ErrTableNotFound, tableName)
+	}
+	if len(columns) == 0 || len(columns) > len(table.Columns) {
+		return nil, fmt.Errorf("%w : index %s has %d columns", ErrInvalidDefinition, name, len(columns))
+	}
+	seen := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		if table.ColumnIndex(column) == -1 {
+			return nil, fmt.Errorf("%w : table %s has no column %s", ErrInvalidDefinition, tableName, column)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("%w : duplicate index column %s", ErrInvalidDefinition, column)
+		}
+		seen[column] = true
+	}
+
+	index := &Index{ID: c.nextID, Name: name, TableID: table.ID, Columns: slices.Clone(columns), Unique: unique}
+	if err := c.execute(&ddlRecord{op: opCreateIndex, index: index}); err != nil {
+		return nil, err
+	}
+	return c.indexes[name], nil
+}
+
+func (c *Catalog) DropIndex(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	index, ok := c.indexes[name]
+	if !ok {
+		return fmt.Errorf("%w : %s", ErrIndexNotFound, name)
+	}
+	return c.execute(&ddlRecord{op: opDropIndex, id: index.ID})
+}
+
+func (c *Catalog) Table(name string) (*Table, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	table, ok := c.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("%w : %s", ErrTableNotFound, name)
+	}
+	return table, nil
+}
+
+func (c *Catalog) Index(name string) (*Index, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	index, ok := c.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w : %s", ErrIndexNotFound, name)
+	}
+	return index, nil
+}
+
+// tables ordered by name
+func (c *Catalog) Tables() []*Table {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	tables := make([]*Table, 0, len(c.tables))
+	for _, table := range c.tables {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables
+}
+
+// indexes of the table ordered by name
+func (c *Catalog) Indexes(tableName string) ([]*Index, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	table, ok := c.tables[tableName]
+	if !ok {
+		return nil, fmt.Errorf("%w : %s", ErrTableNotFound, tableName)
+	}
+	indexes := c.indexesOf(table.ID)
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes, nil
+}
+
+// caller must hold the lock
+func (c *Catalog) indexesOf(tableID uint32) []*Index {
+	indexes := make([]*Index, 0)
+	for _, index := range c.indexes {
+		if index.TableID == tableID {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+/*
+logs , applies and persists a ddl , caller must hold the lock
+the ddl is done once it is logged and applied , persist is only a checkpoint (see persist)
+a logged id is taken even if applying fails , the next open replays the record with it
+*/
+func (c *Catalog) execute(r *ddlRecord) error {
+	lsn, err := c.wal.AppendContext(context.Background(), r.encode())
+	if err != nil {
+		c.logger.Error().Err(err).Msg("error logging ddl")
+		return err
+	}
+	if id, ok := r.createdID(); ok {
+		c.nextID = max(c.nextID, id+1)
+	}
+	if err := c.apply(r); err != nil {
+		c.logger.Error().Err(err).Msg(fmt.Sprintf("error applying ddl logged at lsn %d", lsn))
+		return err
+	}
+	c.appliedLSN = lsn
+	if err := c.persist(); err != nil {
+		c.logger.Warn().Err(err).Msg(fmt.Sprintf("error persisting catalog at lsn %d , the wal still has the ddl", lsn))
+	}
+	return nil
+}
+
+/*
+applies a ddl to the in memory catalog and the segments
+replayed records may find their work partly done , every step tolerates that
+caller must hold the lock
+*/
+func (c *Catalog) apply(r *ddlRecord) error {
+	switch r.op {
+	case opCreateTable:
+		if existing := c.tableByID(r.table.ID); existing != nil {
+			if existing.Name != r.table.Name {
+				return fmt.Errorf("%w : table id %d reused by %s , taken by %s", ErrCatalogCorrupted, r.table.ID, r.table.Name, existing.Name)
+			}
+			return nil
+		}
+		if _, ok := c.tables[r.table.Name]; ok {
+			return fmt.Errorf("%w : table %s created twice", ErrCatalogCorrupted, r.table.Name)
+		}
+		seg, err := c.createSegment(tableSegmentName(r.table.ID))
+		if err != nil {
+			return err
+		}
+		r.table.segment = seg
+		c.tables[r.table.Name] = r.table
+		c.nextID = max(c.nextID, r.table.ID+1)
+
+	case opCreateIndex:
+		if existing := c.indexByID(r.index.ID); existing != nil {
+			if existing.Name != r.index.Name {
+				return fmt.Errorf("%w : index id %d reused by %s , taken by %s", ErrCatalogCorrupted, r.index.ID, r.index.Name, existing.Name)
+			}
+			return nil
+		}
+		if _, ok := c.indexes[r.index.Name]; ok {
+			return fmt.Errorf("%w : index %s created twice", ErrCatalogCorrupted, r.index.Name)
+		}
+		if c.tableByID(r.index.TableID) == nil {
+			return fmt.Errorf("%w : index %s on missing table %d", ErrCatalogCorrupted, r.index.Name, r.index.TableID)
+		}
+		seg, err := c.createSegment(indexSegmentName(r.index.ID))
+		if err != nil {
+			return err
+		}
+		r.index.segment = seg
+		c.indexes[r.index.Name] = r.index
+		c.nextID = max(c.nextID, r.index.ID+1)
+
+	case opDropTable:
+		table := c.tableByID(r.id)
+		if table == nil {
+			return nil
+		}
+		for _, index := range c.indexesOf(table.ID) {
+			if err := c.dropSegment(indexSegmentName(index.ID)); err != nil {
+				return err
+			}
+			delete(c.indexes, index.Name)
+		}
+		if err := c.dropSegment(tableSegmentName(table.ID)); err != nil {
+			return err
+		}
+		delete(c.tables, table.Name)
+
+	case opDropIndex:
+		index := c.indexByID(r.id)
+		if index == nil {
+			return nil
+		}
+		if err := c.dropSegment(indexSegmentName(index.ID)); err != nil {
+			return err
+		}
+		delete(c.indexes, index.Name)
+	}
+	return nil
+}
+
+func (c *Catalog) tableByID(id uint32) *Table {
+	for _, table := range c.tables {
+		if table.ID == id {
+			return table
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) indexByID(id uint32) *Index {
+	for _, index := range c.indexes {
+		if index.ID == id {
+			return index
+		}
+	}
+	return nil
+}
+
+// a replayed create finds the segment already there
+func (c *Catalog) createSegment(name string) (*segment.Segment, error) {
+	seg, err := c.segments.Create(name)
+	if errors.Is(err, segment.ErrSegmentExists) {
+		return c.segments.Get(name)
+	}
+	return seg, err
+}
+
+// a replayed drop finds the segment already gone
+func (c *Catalog) dropSegment(name string) error {
+	if err := c.segments.Drop(name); err != nil && !errors.Is(err, segment.ErrSegmentNotFound) {
+		return err
+	}
+	return nil
+}
+
+// caller must hold the lock
+func (c *Catalog) serialize() []byte {
+	buffer := make([]byte, 4, 64)
+	buffer = binary.BigEndian.AppendUint64(buffer, c.appliedLSN)
+	buffer = binary.BigEndian.AppendUint32(buffer, c.nextID)
+
+	tables := make([]*Table, 0, len(c.tables))
+	for _, table := range c.tables {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].ID < tables[j].ID })
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(tables)))
+	for _, table := range tables {
+		buffer = appendTable(buffer, table)
+	}
+
+	indexes := make([]*Index, 0, len(c.indexes))
+	for _, index := range c.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].ID < indexes[j].ID })
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(indexes)))
+	for _, index := range indexes {
+		buffer = appendIndex(buffer, index)
+	}
+
+	checksums.CalculateCRC(buffer[0:4], buffer[4:])
+	return buffer
+}
+
+// segments are attached after the replay , caller must hold the lock
+func (c *Catalog) deserialize(buffer []byte) error {
+	if len(buffer) < 4 || !checksums.CompareCRC(crcOf(buffer[4:]), buffer[0:4]) {
+		return fmt.Errorf("%w : crc mismatch", ErrCatalogCorrupted)
+	}
+	d := &decoder{buffer: buffer[4:]}
+	c.appliedLSN = d.uint64()
+	c.nextID = d.uint32()
+	for count := d.uint32(); count > 0 && d.err == nil; count-- {
+		table := d.table()
+		c.tables[table.Name] = table
+	}
+	for count := d.uint32(); count > 0 && d.err == nil; count-- {
+		index := d.index()
+		c.indexes[index.Name] = index
+	}
+	return d.err
+}
+
+func crcOf(buffer []byte) []byte {
+	crc := make([]byte, 4)
+	checksums.CalculateCRC(crc, buffer)
+	return crc
+}
+
+/*
+writes the catalog into fresh pages of the catalog segment and points the segment root at them
+the in memory catalog is the truth , a failed persist is retried by the next ddl or the replay on open
+caller must hold the lock
+*/
+func (c *Catalog) persist() error {
+	ctx := context.Background()
+	data := c.serialize()
+	perPage := c.pageSize - chainHeaderSize
+
+	chain, err := c.segment.Allocate(uint64((len(data) + perPage - 1) / perPage))
+	if err != nil {
+		c.logger.Error().Err(err).Msg("error allocating catalog pages")
+		return err
+	}
+	abandon := func(err error) error {
+		return errors.Join(err, c.segment.Release(chain))
+	}
+
+	for i, page := range chain {
+		part := data[i*perPage : min((i+1)*perPage, len(data))]
+		buffer := make([]byte, chainHeaderSize+len(part))
+		if i+1 < len(chain) {
+			binary.BigEndian.PutUint64(buffer[0:8], chain[i+1])
+		}
+		binary.BigEndian.PutUint32(buffer[8:12], uint32(len(part)))
+		copy(buffer[chainHeaderSize:], part)
+		err := c.fs.WriteContext(ctx, page, func(p *paging.Page) error {
+			return p.SetPageBuffer(0, buffer, 0)
+		})
+		if err != nil {
+			return abandon(err)
+		}
+	}
+	// the chain must be durable before the root points at it
+	if err := c.fs.FlushContext(ctx); err != nil {
+		return abandon(err)
+	}
+	if err := c.segment.SetRoot(chain[0]); err != nil {
+		return abandon(err)
+	}
+
+	previous := c.chain
+	c.chain = chain
+	if len(previous) != 0 {
+		if err := c.segment.Release(previous); err != nil {
+			c.logger.Warn().Err(err).Msg("error releasing previous catalog pages")
+		}
+	}
+	return nil
+}
+
+// reads the chain at the segment root , caller must hold the lock
+func (c *Catalog) load(ctx context.Context) error {
+	next := c.segment.Root()
+	data := make([]byte, 0)
+	for next != segment.NoRoot {
+		if !c.segment.Owns(next) || slices.Contains(c.chain, next) {
+			return fmt.Errorf("%w : catalog page %d is not part of the catalog segment", ErrCatalogCorrupted, next)
+		}
+		page, err := c.fs.ReadContext(ctx, next)
+		if err != nil {
+			return err
+		}
+		var buffer []byte
+		page.GetPageBuffer(func(b []byte) {
+			buffer = slices.Clone(b)
+		})
+		used := int(binary.BigEndian.Uint32(buffer[8:12]))
+		if used > len(buffer)-chainHeaderSize {
+			return fmt.Errorf("%w : catalog page %d claims %d bytes", ErrCatalogCorrupted, next, used)
+		}
+		c.chain = append(c.chain, next)
+		data = append(data, buffer[chainHeaderSize:chainHeaderSize+used]...)
+		next = binary.BigEndian.Uint64(buffer[0:8])
+	}
+	if len(c.chain) == 0 {
+		return nil
+	}
+	return c.deserialize(data)
+}
+
+// replays the ddl records the persisted catalog misses , caller must hold the lock
+func (c *Catalog) replay(ctx context.Context) (int, error) {
+	replayed := 0
+	err := c.wal.Replay(ctx, c.appliedLSN, func(lsn uint64, payload []byte) error {
+		r, err := decodeRecord(payload)
+		if err != nil || r == nil {
+			return err
+		}
+		if err := c.apply(r); err != nil {
+			return err
+		}
+		c.appliedLSN = lsn
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// caller must hold the lock
+func (c *Catalog) attachSegments() error {
+	for _, table := range c.tables {
+		seg, err := c.segments.Get(tableSegmentName(table.ID))
+		if err != nil {
+			return fmt.Errorf("%w : table %s : %w", ErrCatalogCorrupted, table.Name, err)
+		}
+		table.segment = seg
+	}
+	for _, index := range c.indexes {
+		seg, err := c.segments.Get(indexSegmentName(index.ID))
+		if err != nil {
+			return fmt.Errorf("%w : index %s : %w", ErrCatalogCorrupted, index.Name, err)
+		}
+		index.segment = seg
+	}
+	return nil
+}
+
+/*
+Opens the catalog kept in the segments , creating an empty one on first use
+the wal must be the one the catalog logged to before , its ddl records past the catalog are replayed
+*/
+func NewCatalog(logger log.Logger, fs filesystem.FileSystem, segments *segment.Manager, w *wal.Wal) (*Catalog, error) {
+	ctx := context.Background()
+	c := &Catalog{
+		logger:   logger,
+		fs:       fs,
+		segments: segments,
+		wal:      w,
+		pageSize: fs.PageSize(),
+		chain:    make([]uint64, 0),
+		tables:   make(map[string]*Table),
+		indexes:  make(map[string]*Index),
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	seg, err := c.createSegment(catalogSegment)
+	if err != nil {
+		logger.Error().Err(err).Msg("error opening catalog segment")
+		return nil, err
+	}
+	c.segment = seg
+
+	if err := c.load(ctx); err != nil {
+		logger.Error().Err(err).Msg("error loading catalog")
+		return nil, err
+	}
+	// pages allocated for a chain that never became the root
+	orphans := slices.DeleteFunc(seg.Pages(), func(page uint64) bool {
+		return slices.Contains(c.chain, page)
+	})
+	if len(orphans) != 0 {
+		if err := seg.Release(orphans); err != nil {
+			logger.Warn().Err(err).Msg("error releasing orphaned catalog pages")
+		}
+	}
+
+	replayed, err := c.replay(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("error replaying ddl records")
+		return nil, err
+	}
+	if err := c.attachSegments(); err != nil {
+		logger.Error().Err(err).Msg("error attaching catalog segments")
+		return nil, err
+	}
+	if replayed != 0 || len(c.chain) == 0 {
+		logger.Info().Msg(fmt.Sprintf("persisting catalog after replaying %d ddl records", replayed))
+		if err := c.persist(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,238 @@
+package catalog
+
+import (
+	"boro-db/filesystem"
+	"boro-db/heap"
+	"boro-db/logging"
+	"boro-db/paging"
+	"boro-db/segment"
+	"boro-db/storage"
+	"boro-db/wal"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDatabase struct {
+	fs       filesystem.FileSystem
+	wal      *wal.Wal
+	segments *segment.Manager
+	catalog  *Catalog
+}
+
+func openTestDatabase(t *testing.T, dir string) *testDatabase {
+	logger := *logging.CreateDebugLogger()
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       filepath.Join(dir, "data"),
+		MaxHeapFileSizeByte: 4096 * 64,
+	}
+	fs, err := filesystem.NewFileSystem(logger, &filesystem.FileSystemOptions{
+		HeapFileOptions: heapOptions,
+		PageSystemOption: paging.PageSystemOption{
+			HeapFileOptions:              heapOptions,
+			PageBufferCacheSize:          256,
+			BufferPoolEvictionIntervalms: 3600 * 1000,
+			BufferPoolFlushIntervalms:    3600 * 1000,
+			EnablePageMeta:               true,
+		},
+		ExtendAddressSpaceByPageCount: 16,
+	})
+	assert.Nil(t, err)
+	w, err := wal.NewWal(logger, &wal.WalOptions{
+		FileDirectory: filepath.Join(dir, "wal"),
+		SegmentSizes:  4096 * 16,
+	})
+	assert.Nil(t, err)
+	segments, err := segment.NewManager(logger, fs)
+	assert.Nil(t, err)
+
+	db := &testDatabase{fs: fs, wal: w, segments: segments}
+	db.catalog, err = NewCatalog(logger, fs, segments, w)
+	assert.Nil(t, err)
+	return db
+}
+
+func (db *testDatabase) close(t *testing.T) {
+	assert.Nil(t, db.wal.Close(context.Background()))
+	assert.Nil(t, db.fs.Close(context.Background()))
+}
+
+var userColumns = []Column{
+	{Name: "id", Type: storage.Int64},
+	{Name: "name", Type: storage.VARCHAR},
+	{Name: "age", Type: storage.Int16},
+}
+
+func TestCatalog(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-catalog")
+	os.MkdirAll(dir, os.ModePerm)
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	db := openTestDatabase(t, dir)
+	catalog := db.catalog
+
+	users, err := catalog.CreateTable("users", userColumns)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, users.ColumnIndex("name"))
+	_, err = catalog.CreateTable("users", userColumns)
+	assert.ErrorIs(t, err, ErrTableExists)
+	_, err = catalog.CreateTable("bad", []Column{{Name: "id", Type: storage.Int64}, {Name: "id", Type: storage.Int8}})
+	assert.ErrorIs(t, err, ErrInvalidDefinition)
+	_, err = catalog.CreateTable("bad", []Column{{Name: "id", Type: storage.KeyType(42)}})
+	assert.ErrorIs(t, err, ErrInvalidDefinition)
+	_, err = catalog.CreateTable("bad", nil)
+	assert.ErrorIs(t, err, ErrInvalidDefinition)
+
+	orders, err := catalog.CreateTable("orders", []Column{{Name: "id", Type: storage.Int64}, {Name: "user", Type: storage.Int64}})
+	assert.Nil(t, err)
+
+	byName, err := catalog.CreateIndex("users_name", "users", []string{"name"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, users.ID, byName.TableID)
+	_, err = catalog.CreateIndex("users_id", "users", []string{"id"}, true)
+	assert.Nil(t, err)
+	_, err = catalog.CreateIndex("users_id", "users", []string{"id"}, true)
+	assert.ErrorIs(t, err, ErrIndexExists)
+	_, err = catalog.CreateIndex("users_email", "users", []string{"email"}, false)
+	assert.ErrorIs(t, err, ErrInvalidDefinition)
+	_, err = catalog.CreateIndex("missing_id", "missing", []string{"id"}, false)
+	assert.ErrorIs(t, err, ErrTableNotFound)
+	_, err = catalog.CreateIndex("orders_user", "orders", []string{"user"}, false)
+	assert.Nil(t, err)
+
+	// the index keeps its root page in its segment
+	pages, err := byName.Segment().Allocate(1)
+	assert.Nil(t, err)
+	assert.Nil(t, byName.SetRoot(pages[0]))
+
+	assert.Nil(t, catalog.DropIndex("orders_user"))
+	assert.ErrorIs(t, catalog.DropIndex("orders_user"), ErrIndexNotFound)
+	assert.Nil(t, catalog.DropTable("orders"))
+	_, err = catalog.Table("orders")
+	assert.ErrorIs(t, err, ErrTableNotFound)
+	assert.Empty(t, db.segments.List(tableSegmentName(orders.ID)))
+	db.close(t)
+
+	db = openTestDatabase(t, dir)
+	catalog = db.catalog
+	tables := catalog.Tables()
+	assert.Equal(t, 1, len(tables))
+	assert.Equal(t, "users", tables[0].Name)
+	assert.Equal(t, userColumns, tables[0].Columns)
+
+	indexes, err := catalog.Indexes("users")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(indexes))
+	assert.Equal(t, "users_id", indexes[0].Name)
+	assert.True(t, indexes[0].Unique)
+	assert.Equal(t, "users_name", indexes[1].Name)
+	assert.Equal(t, []string{"name"}, indexes[1].Columns)
+	assert.Equal(t, pages[0], indexes[1].Root())
+
+	// ids are not reused after a restart
+	accounts, err := catalog.CreateTable("accounts", userColumns)
+	assert.Nil(t, err)
+	assert.Greater(t, accounts.ID, indexes[1].ID)
+
+	// dropping a table takes its indexes and segments along
+	assert.Nil(t, catalog.DropTable("users"))
+	_, err = catalog.Index("users_name")
+	assert.ErrorIs(t, err, ErrIndexNotFound)
+	assert.Equal(t, []string{tableSegmentName(accounts.ID)}, db.segments.List(catalogSegment+"/"))
+	db.close(t)
+}
+
+func TestCatalogReplay(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-catalog-replay")
+	os.MkdirAll(dir, os.ModePerm)
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	ctx := context.Background()
+	db := openTestDatabase(t, dir)
+	users, err := db.catalog.CreateTable("users", userColumns)
+	assert.Nil(t, err)
+	db.catalog.lock.Lock()
+	appliedLSN := db.catalog.appliedLSN
+	db.catalog.lock.Unlock()
+
+	// crash right after the wal append , the catalog pages never saw these
+	orders := &Table{ID: users.ID + 1, Name: "orders", Columns: []Column{{Name: "id", Type: storage.Int64}}}
+	_, err = db.wal.AppendContext(ctx, (&ddlRecord{op: opCreateTable, table: orders}).encode())
+	assert.Nil(t, err)
+	_, err = db.wal.AppendContext(ctx, (&ddlRecord{op: opDropTable, id: users.ID}).encode())
+	assert.Nil(t, err)
+	// records of other wal users are skipped
+	_, err = db.wal.AppendContext(ctx, []byte("not a ddl"))
+	assert.Nil(t, err)
+	db.close(t)
+
+	db = openTestDatabase(t, dir)
+	_, err = db.catalog.Table("users")
+	assert.ErrorIs(t, err, ErrTableNotFound)
+	replayed, err := db.catalog.Table("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, orders.Columns, replayed.Columns)
+	assert.NotNil(t, replayed.Segment())
+	assert.Greater(t, db.catalog.appliedLSN, appliedLSN)
+	assert.Equal(t, []string{tableSegmentName(orders.ID)}, db.segments.List(catalogSegment+"/"))
+	db.close(t)
+
+	// replayed once , persisted with the catalog
+	db = openTestDatabase(t, dir)
+	_, err = db.catalog.Table("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(db.catalog.Tables()))
+	db.close(t)
+}
+
+func TestCatalogIDsAfterFailedApply(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-catalog-ids")
+	os.MkdirAll(dir, os.ModePerm)
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	ctx := context.Background()
+	db := openTestDatabase(t, dir)
+	defer db.close(t)
+	users, err := db.catalog.CreateTable("users", userColumns)
+	assert.Nil(t, err)
+
+	// logged but not applied , the id stays taken
+	db.catalog.lock.Lock()
+	orphan := &Index{ID: db.catalog.nextID, Name: "orphan_idx", TableID: users.ID + 100, Columns: []string{"id"}}
+	assert.ErrorIs(t, db.catalog.execute(&ddlRecord{op: opCreateIndex, index: orphan}), ErrCatalogCorrupted)
+	db.catalog.lock.Unlock()
+	orders, err := db.catalog.CreateTable("orders", userColumns)
+	assert.Nil(t, err)
+	assert.Greater(t, orders.ID, orphan.ID)
+
+	// a replayed id taken under another name is refused
+	reused := &Table{ID: users.ID, Name: "accounts", Columns: userColumns}
+	before := db.wal.LastLSN()
+	_, err = db.wal.AppendContext(ctx, (&ddlRecord{op: opCreateTable, table: reused}).encode())
+	assert.Nil(t, err)
+	db.catalog.lock.Lock()
+	db.catalog.appliedLSN = before
+	_, err = db.catalog.replay(ctx)
+	db.catalog.lock.Unlock()
+	assert.ErrorIs(t, err, ErrCatalogCorrupted)
+	assert.ErrorContains(t, err, "reused")
+}
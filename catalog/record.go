@@ -0,0 +1,189 @@
+package catalog
+
+import (
+	"boro-db/storage"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+DDL record (wal payload)
+┌──────────────────────────────────────────────────────────────┐
+| tag (1byte) | op (1byte) | object ......                      |
+└──────────────────────────────────────────────────────────────┘
+create table : | table |
+create index : | index |
+drop table / drop index : | id (4byte) |
+
+table : | id (4byte) | name | column count (2byte) | columns (name | type (1byte)) |
+index : | id (4byte) | table id (4byte) | unique (1byte) | name | column count (2byte) | column names |
+names : | length (2byte) | bytes |
+
+  - the tag tells catalog records apart from other records sharing the wal
+  - records carry the ids the catalog handed out so replaying them rebuilds the same catalog
+*/
+const recordTag = byte(0xCA)
+
+type ddlOp uint8
+
+const (
+	opCreateTable ddlOp = iota + 1
+	opDropTable
+	opCreateIndex
+	opDropIndex
+)
+
+type ddlRecord struct {
+	op    ddlOp
+	table *Table
+	index *Index
+	id    uint32
+}
+
+// id a create hands out , false for drops
+func (r *ddlRecord) createdID() (uint32, bool) {
+	switch r.op {
+	case opCreateTable:
+		return r.table.ID, true
+	case opCreateIndex:
+		return r.index.ID, true
+	}
+	return 0, false
+}
+
+func (r *ddlRecord) encode() []byte {
+	buffer := []byte{recordTag, byte(r.op)}
+	switch r.op {
+	case opCreateTable:
+		buffer = appendTable(buffer, r.table)
+	case opCreateIndex:
+		buffer = appendIndex(buffer, r.index)
+	default:
+		buffer = binary.BigEndian.AppendUint32(buffer, r.id)
+	}
+	return buffer
+}
+
+// (nil , nil) for records that are not the catalog's
+func decodeRecord(payload []byte) (*ddlRecord, error) {
+	if len(payload) < 2 || payload[0] != recordTag {
+		return nil, nil
+	}
+	r := &ddlRecord{op: ddlOp(payload[1])}
+	d := &decoder{buffer: payload[2:]}
+	switch r.op {
+	case opCreateTable:
+		r.table = d.table()
+	case opCreateIndex:
+		r.index = d.index()
+	case opDropTable, opDropIndex:
+		r.id = d.uint32()
+	default:
+		return nil, fmt.Errorf("%w : unknown ddl op %d", ErrCatalogCorrupted, r.op)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return r, nil
+}
+
+func appendName(buffer []byte, name string) []byte {
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(name)))
+	return append(buffer, name...)
+}
+
+func appendTable(buffer []byte, table *Table) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, table.ID)
+	buffer = appendName(buffer, table.Name)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(table.Columns)))
+	for _, column := range table.Columns {
+		buffer = appendName(buffer, column.Name)
+		buffer = append(buffer, byte(column.Type))
+	}
+	return buffer
+}
+
+func appendIndex(buffer []byte, index *Index) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, index.ID)
+	buffer = binary.BigEndian.AppendUint32(buffer, index.TableID)
+	unique := byte(0)
+	if index.Unique {
+		unique = 1
+	}
+	buffer = append(buffer, unique)
+	buffer = appendName(buffer, index.Name)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(index.Columns)))
+	for _, column := range index.Columns {
+		buffer = appendName(buffer, column)
+	}
+	return buffer
+}
+
+// reads fields in order , the first short read sticks in err and zero values follow
+type decoder struct {
+	buffer []byte
+	err    error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buffer) < n {
+		d.err = fmt.Errorf("%w : %d bytes left , %d needed", ErrCatalogCorrupted, len(d.buffer), n)
+		return nil
+	}
+	bytes := d.buffer[:n]
+	d.buffer = d.buffer[n:]
+	return bytes
+}
+
+func (d *decoder) uint8() uint8 {
+	if bytes := d.take(1); bytes != nil {
+		return bytes[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if bytes := d.take(2); bytes != nil {
+		return binary.BigEndian.Uint16(bytes)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if bytes := d.take(4); bytes != nil {
+		return binary.BigEndian.Uint32(bytes)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if bytes := d.take(8); bytes != nil {
+		return binary.BigEndian.Uint64(bytes)
+	}
+	return 0
+}
+
+func (d *decoder) name() string {
+	return string(d.take(int(d.uint16())))
+}
+
+func (d *decoder) table() *Table {
+	table := &Table{ID: d.uint32(), Name: d.name()}
+	count := int(d.uint16())
+	for i := 0; i < count && d.err == nil; i++ {
+		table.Columns = append(table.Columns, Column{Name: d.name(), Type: storage.KeyType(d.uint8())})
+	}
+	return table
+}
+
+func (d *decoder) index() *Index {
+	index := &Index{ID: d.uint32(), TableID: d.uint32(), Unique: d.uint8() == 1, Name: d.name()}
+	count := int(d.uint16())
+	for i := 0; i < count && d.err == nil; i++ {
+		index.Columns = append(index.Columns, d.name())
+	}
+	return index
+}
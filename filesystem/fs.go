@@ -3,11 +3,19 @@ package filesystem
 import (
 	"boro-db/heap"
 	"boro-db/paging"
+	"boro-db/utils/future"
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 
 	"github.com/phuslu/log"
 )
 
+// shared with heap so callers can check errors.Is(err, ErrClosed) at any layer
+var ErrClosed = heap.ErrClosed
+var ErrPageNotAllocated = errors.New("page is not allocated")
+
 /*
 Filesystem uses the Paging System + Heap to
 provide a usable memory + durable persistent
@@ -26,16 +34,53 @@ type FileSystem interface {
 	// Grab contiguous or non contiguous pages (preferably contiguous)
 	Malloc(count uint64) ([]uint64, error)
 
+	// Grab count pages that are sequential on disk (ascending page numbers)
+	// for LSM runs / B+ tree leaves which are scanned in order
+	MallocContiguous(count uint64) ([]uint64, error)
+
 	// Mark the pages free for future usage
 	Free(pages []uint64) error
 
+	// Moves live pages into free space at the front and gives the free tail back to the OS
+	// relocate is called for every moved page so the owner can repoint its references
+	// pages must not be written while compaction runs
+	Compact(relocate func(from uint64, to uint64) error) (heap.CompactionResult, error)
+
 	Flush() error
+
+	// Capacity of the heap directory , see heap.Stats
+	Stats() (heap.Stats, error)
+
+	// Usable bytes of a page , the page meta is not part of it
+	PageSize() int
+
+	// Blocking variants of Read / Write / Flush returning errors instead of dropping them
+	// a context done before the call starts it returns ctx.Err() , a started call always runs to its result
+	ReadContext(ctx context.Context, pageNumber uint64) (*paging.Page, error)
+	WriteContext(ctx context.Context, pageNumber uint64, doWrite func(*paging.Page) error) error
+	FlushContext(ctx context.Context) error
+	// Flushes only the given pages , for callers ordering their own writes (see segment)
+	FlushPagesContext(ctx context.Context, pageNumbers []uint64) error
+
+	// Async variants , resolve the future with Get(ctx)
+	ReadAsync(pageNumber uint64) *future.Future[*paging.Page]
+	WriteAsync(pageNumber uint64, doWrite func(*paging.Page) error) *future.Future[*paging.Page]
+
+	// Flushes the paging system and closes the heap, further calls return ErrClosed
+	// a Close that runs out of time before the pages are flushed can be called again
+	Close(ctx context.Context) error
 }
 
 type FileSystemOptions struct {
 	heap.HeapFileOptions
 	paging.PageSystemOption
 	ExtendAddressSpaceByPageCount int
+	// how the address space grows , see growth.go
+	GrowthPolicy GrowthPolicy
+	// grow in the background once fewer pages are free , 0 disables it
+	LowFreePagesWatermark uint64
+	// cap on the pages of the address space , 0 means unlimited
+	MaxTotalPages uint64
 }
 
 type localfilesystem struct {
@@ -43,18 +88,72 @@ type localfilesystem struct {
 	heap    heap.HeapFile
 	paging  paging.PageSystem
 	logger  log.Logger
+	closed  atomic.Bool
+
+	growLock     sync.Mutex
+	growSignal   chan struct{}
+	growStop     chan struct{}
+	growStopOnce sync.Once
+	growStopped  chan struct{}
+	// Close can be retried , one attempt at a time
+	closeLock sync.Mutex
 }
 
 func (lfs *localfilesystem) Flush() error {
+	if lfs.closed.Load() {
+		return ErrClosed
+	}
 	return lfs.paging.Flush()
 }
 
+/*
+Close order matters
+- background growth stops first , it extends the heap
+- paging next so the dirty pages make it to the heap files
+- heap last which fsyncs and releases the file descriptors
+- until paging is closed nothing is given up , a Close that timed out can be called again
+*/
+func (lfs *localfilesystem) Close(ctx context.Context) error {
+	lfs.closeLock.Lock()
+	defer lfs.closeLock.Unlock()
+	if lfs.closed.Load() {
+		return ErrClosed
+	}
+
+	lfs.growStopOnce.Do(func() {
+		close(lfs.growStop)
+	})
+	select {
+	case <-lfs.growStopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	pagingErr := lfs.paging.Close(ctx)
+	if pagingErr != nil && !errors.Is(pagingErr, ErrClosed) {
+		lfs.logger.Error().Err(pagingErr).Msg("error closing paging")
+		return pagingErr
+	}
+
+	// the heap releases its files even when it fails , there is no retrying past this point
+	lfs.closed.Store(true)
+	heapErr := lfs.heap.Close(ctx)
+	if heapErr != nil {
+		lfs.logger.Error().Err(heapErr).Msg("error closing heap")
+	}
+	return heapErr
+}
+
 /*
 Check if address is valid allocated region address
 read the page from paging system (this can be recently allocated item as well without ever being writtenor not present in memory)
 call doWrite on that page
 */
 func (lfs *localfilesystem) Write(pageNumber uint64, doWrite func(*paging.Page, error)) {
+	if lfs.closed.Load() {
+		doWrite(nil, ErrClosed)
+		return
+	}
 	if !lfs.heap.IsPageFree(pageNumber) {
 		lfs.paging.ReadPage(pageNumber, func(page *paging.Page, err error) {
 			if err != nil {
@@ -64,7 +163,7 @@ func (lfs *localfilesystem) Write(pageNumber uint64, doWrite func(*paging.Page,
 			}
 		})
 	} else {
-		doWrite(nil, errors.New("page is not allocated"))
+		doWrite(nil, ErrPageNotAllocated)
 	}
 }
 
@@ -73,6 +172,10 @@ Seek and read the given page in page number
 Only use BufferPool for this purpose
 */
 func (lfs *localfilesystem) Read(pageNumber uint64, onRead func(*paging.Page, error)) {
+	if lfs.closed.Load() {
+		onRead(nil, ErrClosed)
+		return
+	}
 	if !lfs.heap.IsPageFree(pageNumber) {
 		lfs.paging.ReadPage(pageNumber, func(page *paging.Page, err error) {
 			if err != nil {
@@ -81,34 +184,143 @@ func (lfs *localfilesystem) Read(pageNumber uint64, onRead func(*paging.Page, er
 				onRead(page, nil)
 			}
 		})
+	} else {
+		onRead(nil, ErrPageNotAllocated)
+	}
+}
+
+func (lfs *localfilesystem) ReadContext(ctx context.Context, pageNumber uint64) (*paging.Page, error) {
+	return future.Await(ctx, func(onRead func(*paging.Page, error)) {
+		lfs.Read(pageNumber, onRead)
+	})
+}
+
+func (lfs *localfilesystem) ReadAsync(pageNumber uint64) *future.Future[*paging.Page] {
+	return future.FromCallback(func(onRead func(*paging.Page, error)) {
+		lfs.Read(pageNumber, onRead)
+	})
+}
+
+// doWrite errors are handed back to the caller as is
+func (lfs *localfilesystem) writeWithResult(pageNumber uint64, doWrite func(*paging.Page) error, onDone func(*paging.Page, error)) {
+	lfs.Write(pageNumber, func(page *paging.Page, err error) {
+		if err != nil {
+			onDone(nil, err)
+			return
+		}
+		if err := doWrite(page); err != nil {
+			onDone(nil, err)
+			return
+		}
+		onDone(page, nil)
+	})
+}
+
+func (lfs *localfilesystem) WriteContext(ctx context.Context, pageNumber uint64, doWrite func(*paging.Page) error) error {
+	_, err := future.Await(ctx, func(onDone func(*paging.Page, error)) {
+		lfs.writeWithResult(pageNumber, doWrite, onDone)
+	})
+	return err
+}
+
+func (lfs *localfilesystem) WriteAsync(pageNumber uint64, doWrite func(*paging.Page) error) *future.Future[*paging.Page] {
+	return future.FromCallback(func(onDone func(*paging.Page, error)) {
+		lfs.writeWithResult(pageNumber, doWrite, onDone)
+	})
+}
+
+func (lfs *localfilesystem) Stats() (heap.Stats, error) {
+	if lfs.closed.Load() {
+		return heap.Stats{}, ErrClosed
+	}
+	return lfs.heap.Stats()
+}
+
+func (lfs *localfilesystem) FlushContext(ctx context.Context) error {
+	if lfs.closed.Load() {
+		return ErrClosed
 	}
+	return lfs.paging.FlushContext(ctx)
+}
+
+func (lfs *localfilesystem) PageSize() int {
+	return lfs.paging.PageSize()
+}
+
+func (lfs *localfilesystem) FlushPagesContext(ctx context.Context, pageNumbers []uint64) error {
+	if lfs.closed.Load() {
+		return ErrClosed
+	}
+	for _, pageNumber := range pageNumbers {
+		page, err := lfs.ReadContext(ctx, pageNumber)
+		if err != nil {
+			return err
+		}
+		if err := lfs.paging.FlushPageBlockContext(ctx, page); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 /*
 Similar to malloc in C or make in go
 Provides memory addresses for Pages to work with
-- If address space has enough free pages then allocate + read + return
-- If address space does not have enough free pages then allocate + extend address space + allocate remaining + read + return
+- If address space has enough free pages then allocate + return
+- If address space does not have enough free pages then extend address space by the growth policy + allocate + return
+- ErrNotEnoughSpace once the address space can not grow past MaxTotalPages
 */
 func (lfs *localfilesystem) Malloc(count uint64) ([]uint64, error) {
+	if lfs.closed.Load() {
+		return nil, ErrClosed
+	}
 
 	pages, err := lfs.heap.Malloc(count)
-	if err != nil {
+	if errors.Is(err, ErrNotEnoughSpace) {
 		lfs.logger.Debug().Msg("error allocating pages , not enough space extending space")
+		free := lfs.heap.FreePagesAvailable()
+		if growErr := lfs.grow(count - min(free, count)); growErr != nil {
+			return nil, growErr
+		}
+		pages, err = lfs.heap.Malloc(count)
 	}
 
-	if len(pages) != int(count) {
-		lfs.heap.ExtendBy(int(lfs.options.ExtendAddressSpaceByPageCount))
-		pg, err := lfs.heap.Malloc(count - uint64(len(pages)))
-		if err != nil {
-			lfs.logger.Error().Err(err).Msg("error allocating pages")
-			err := lfs.heap.Free(pages)
-			lfs.logger.Error().Err(err).Msg("error freeing pages when trying to fix allocation")
-			return nil, err
+	if err != nil {
+		lfs.logger.Error().Err(err).Msg("error allocating pages")
+		return nil, err
+	}
+
+	lfs.checkWatermark()
+	return pages, nil
+}
+
+/*
+Contiguous variant of Malloc
+  - best fit over the free runs of the heap
+  - when no run fits the address space is extended and the allocation retried
+    the first extension may only top up the last heap file , the second one starts a fresh file
+    which is always large enough as long as count fits in a heap file
+*/
+func (lfs *localfilesystem) MallocContiguous(count uint64) ([]uint64, error) {
+	if lfs.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	pages, err := lfs.heap.MallocContiguous(count)
+	for attempt := 0; attempt < 2 && errors.Is(err, ErrNotEnoughSpace); attempt++ {
+		lfs.logger.Debug().Msg("no free run large enough , extending space")
+		if growErr := lfs.grow(count); growErr != nil {
+			return nil, growErr
 		}
-		return append(pages, pg...), nil
+		pages, err = lfs.heap.MallocContiguous(count)
 	}
 
+	if err != nil {
+		lfs.logger.Error().Err(err).Msg("error allocating contiguous pages")
+		return nil, err
+	}
+
+	lfs.checkWatermark()
 	return pages, nil
 }
 
@@ -117,13 +329,42 @@ Similar to free in C
 Frees the page numbers provided. This means these pages can now be used while allocation
 */
 func (lfs *localfilesystem) Free(pages []uint64) error {
+	if lfs.closed.Load() {
+		return ErrClosed
+	}
 
-	// TODO : remove these pages from cache as well in case they are still present
-	lfs.heap.Free(pages)
-
+	if err := lfs.heap.Free(pages); err != nil {
+		return err
+	}
+	// a cached copy would outlive the allocation and be flushed over the next owner's data
+	lfs.paging.Invalidate(pages)
 	return nil
 }
 
+/*
+Compaction on top of the heap
+- dirty pages are flushed first , the heap copies pages on disk
+- both ends of a move are dropped from the cache before the owner repoints to the new page
+*/
+func (lfs *localfilesystem) Compact(relocate func(from uint64, to uint64) error) (heap.CompactionResult, error) {
+	if lfs.closed.Load() {
+		return heap.CompactionResult{}, ErrClosed
+	}
+
+	if err := lfs.paging.Flush(); err != nil {
+		lfs.logger.Error().Err(err).Msg("error flushing before compaction")
+		return heap.CompactionResult{}, err
+	}
+
+	return lfs.heap.Compact(func(from uint64, to uint64) error {
+		lfs.paging.Invalidate([]uint64{from, to})
+		if relocate == nil {
+			return nil
+		}
+		return relocate(from, to)
+	})
+}
+
 func NewFileSystem(logger log.Logger, options *FileSystemOptions) (FileSystem, error) {
 
 	heap, err := heap.NewHeap(logger, &options.HeapFileOptions)
@@ -137,13 +378,22 @@ func NewFileSystem(logger log.Logger, options *FileSystemOptions) (FileSystem, e
 
 	if err != nil {
 		logger.Error().Err(err).Msg("error creating paging")
+		heap.Close(context.Background())
 		return nil, err
 	}
 
-	return &localfilesystem{
-		heap:    heap,
-		paging:  paging,
-		options: options,
-		logger:  logger,
-	}, nil
+	lfs := &localfilesystem{
+		heap:        heap,
+		paging:      paging,
+		options:     options,
+		logger:      logger,
+		growSignal:  make(chan struct{}, 1),
+		growStop:    make(chan struct{}),
+		growStopped: make(chan struct{}),
+	}
+	go lfs.runBackgroundGrowth()
+	// a heap reopened below the watermark is topped up right away
+	lfs.checkWatermark()
+
+	return lfs, nil
 }
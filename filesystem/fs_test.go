@@ -0,0 +1,49 @@
+package filesystem
+
+import (
+	"boro-db/logging"
+	"boro-db/paging"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseRetry(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-close-retry")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := growthTestOptions(dir)
+	options.ExtendAddressSpaceByPageCount = 4
+	fs, err := NewFileSystem(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+
+	pages, err := fs.Malloc(1)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.WriteContext(context.Background(), pages[0], func(page *paging.Page) error {
+		return page.SetPageBuffer(0, []byte("survives a timed out close"), 0)
+	}))
+
+	// out of time before the dirty page is flushed , nothing is given up
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, fs.Close(cancelled), context.Canceled)
+	assert.Nil(t, fs.Close(context.Background()))
+	assert.ErrorIs(t, fs.Close(context.Background()), ErrClosed)
+
+	fs, err = NewFileSystem(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	page, err := fs.ReadContext(context.Background(), pages[0])
+	assert.Nil(t, err)
+	page.GetPageBuffer(func(b []byte) {
+		assert.Equal(t, []byte("survives a timed out close"), b[:26])
+	})
+	assert.Nil(t, fs.Close(context.Background()))
+}
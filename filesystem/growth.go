@@ -0,0 +1,125 @@
+package filesystem
+
+import (
+	"boro-db/heap"
+	"errors"
+	"fmt"
+)
+
+// shared with heap so callers can check errors.Is(err, ErrNotEnoughSpace) at any layer
+var ErrNotEnoughSpace = heap.ErrNotEnoughSpace
+var ErrQuotaExceeded = heap.ErrQuotaExceeded
+
+type GrowthPolicyKind uint8
+
+const (
+	// grows by Pages every time
+	GrowthFixed GrowthPolicyKind = iota
+	// grows by Percent of the current size , at least Pages
+	GrowthPercentage
+	// doubles the current size , at least Pages and at most MaxStepPages
+	GrowthGeometric
+)
+
+/*
+How the address space grows when Malloc runs out of free pages
+  - an extension is never smaller than what the failed allocation needs
+  - the zero value is GrowthFixed by ExtendAddressSpaceByPageCount
+*/
+type GrowthPolicy struct {
+	Kind         GrowthPolicyKind
+	Pages        uint64
+	Percent      uint64
+	MaxStepPages uint64 // 0 means no cap
+}
+
+// pages to add to a heap of currentPages that is short of needed pages
+func (gp GrowthPolicy) extension(currentPages uint64, needed uint64) uint64 {
+	step := gp.Pages
+	switch gp.Kind {
+	case GrowthPercentage:
+		step = max(step, currentPages*gp.Percent/100)
+	case GrowthGeometric:
+		step = max(step, currentPages)
+		if gp.MaxStepPages != 0 {
+			step = min(step, gp.MaxStepPages)
+		}
+	}
+	return max(step, needed, 1)
+}
+
+/*
+Growth of the address space
+  - allocations that find too few free pages grow the heap by the growth policy and retry
+  - with LowFreePagesWatermark the heap is grown in the background once an allocation leaves
+    fewer free pages than the watermark , so foreground allocations rarely wait on fallocate
+  - MaxTotalPages caps the heap , an extension is clamped to it and allocations past it fail with ErrNotEnoughSpace
+  - a policy step over the heap quota (QuotaBytes) is retried with only the pages needed
+  - growLock serializes foreground and background growth
+*/
+func (lfs *localfilesystem) grow(needed uint64) error {
+	lfs.growLock.Lock()
+	defer lfs.growLock.Unlock()
+
+	addressRange := lfs.heap.ValidAddressRange()
+	// wraps to 0 for an empty address space
+	currentPages := addressRange[1] + 1 - addressRange[0]
+
+	step := lfs.options.growthPolicy().extension(currentPages, needed)
+	if maxPages := lfs.options.MaxTotalPages; maxPages != 0 {
+		if currentPages+needed > maxPages {
+			return fmt.Errorf("%w : heap is capped at %d pages , %d in use , %d more needed", ErrNotEnoughSpace, maxPages, currentPages, needed)
+		}
+		step = min(step, maxPages-currentPages)
+	}
+
+	lfs.logger.Debug().Msgf("extending address space by %d pages", step)
+	err := lfs.heap.ExtendBy(int(step))
+	if errors.Is(err, ErrQuotaExceeded) && step > needed {
+		// the policy step does not fit the quota , the bare need might
+		err = lfs.heap.ExtendBy(int(needed))
+	}
+	if err != nil {
+		lfs.logger.Error().Err(err).Msg(fmt.Sprintf("error extending address space by %d pages", step))
+		return err
+	}
+	return nil
+}
+
+// wakes the background grower when free pages drop below the watermark
+func (lfs *localfilesystem) checkWatermark() {
+	if lfs.options.LowFreePagesWatermark == 0 || lfs.heap.FreePagesAvailable() >= lfs.options.LowFreePagesWatermark {
+		return
+	}
+	select {
+	case lfs.growSignal <- struct{}{}:
+	default:
+		// already signalled
+	}
+}
+
+func (lfs *localfilesystem) runBackgroundGrowth() {
+	defer close(lfs.growStopped)
+	for {
+		select {
+		case <-lfs.growStop:
+			return
+		case <-lfs.growSignal:
+			free := lfs.heap.FreePagesAvailable()
+			if free >= lfs.options.LowFreePagesWatermark {
+				continue
+			}
+			if err := lfs.grow(lfs.options.LowFreePagesWatermark - free); err != nil {
+				lfs.logger.Warn().Err(err).Msg("background extension failed")
+			}
+		}
+	}
+}
+
+func (options *FileSystemOptions) growthPolicy() GrowthPolicy {
+	policy := options.GrowthPolicy
+	if policy.Kind == GrowthFixed && policy.Pages == 0 {
+		policy.Pages = uint64(max(options.ExtendAddressSpaceByPageCount, 0))
+	}
+	return policy
+}
@@ -0,0 +1,154 @@
+package filesystem
+
+import (
+	"boro-db/heap"
+	"boro-db/logging"
+	"boro-db/paging"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrowthPolicy(t *testing.T) {
+	fixed := GrowthPolicy{Kind: GrowthFixed, Pages: 8}
+	assert.Equal(t, uint64(8), fixed.extension(100, 1))
+	assert.Equal(t, uint64(20), fixed.extension(100, 20))
+
+	percentage := GrowthPolicy{Kind: GrowthPercentage, Pages: 4, Percent: 50}
+	assert.Equal(t, uint64(50), percentage.extension(100, 1))
+	assert.Equal(t, uint64(4), percentage.extension(2, 1))
+
+	geometric := GrowthPolicy{Kind: GrowthGeometric, Pages: 4, MaxStepPages: 64}
+	assert.Equal(t, uint64(4), geometric.extension(0, 1))
+	assert.Equal(t, uint64(16), geometric.extension(16, 1))
+	assert.Equal(t, uint64(64), geometric.extension(1000, 1))
+	assert.Equal(t, uint64(100), geometric.extension(1000, 100))
+
+	// the legacy option backs the zero value
+	options := &FileSystemOptions{ExtendAddressSpaceByPageCount: 10}
+	assert.Equal(t, uint64(10), options.growthPolicy().extension(0, 1))
+}
+
+func growthTestOptions(dir string) *FileSystemOptions {
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+	}
+	return &FileSystemOptions{
+		HeapFileOptions: heapOptions,
+		PageSystemOption: paging.PageSystemOption{
+			HeapFileOptions:              heapOptions,
+			PageBufferCacheSize:          64,
+			BufferPoolEvictionIntervalms: 3600 * 1000,
+			BufferPoolFlushIntervalms:    3600 * 1000,
+		},
+	}
+}
+
+func TestMallocMaxTotalPages(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-max-pages")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := growthTestOptions(dir)
+	options.GrowthPolicy = GrowthPolicy{Kind: GrowthGeometric, Pages: 4, MaxStepPages: 16}
+	options.MaxTotalPages = 20
+
+	fs, err := NewFileSystem(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer fs.Close(context.Background())
+	lfs := fs.(*localfilesystem)
+
+	// 0 -> 4 -> 8 -> 16 pages
+	for i := 0; i < 16; i++ {
+		_, err := fs.Malloc(1)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, [2]uint64{0, 15}, lfs.heap.ValidAddressRange())
+
+	// clamped to the cap
+	pages, err := fs.Malloc(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{16, 17, 18, 19}, pages)
+	assert.Equal(t, [2]uint64{0, 19}, lfs.heap.ValidAddressRange())
+
+	_, err = fs.Malloc(1)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+	_, err = fs.MallocContiguous(2)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+
+	// freed pages are still handed out at the cap
+	assert.Nil(t, fs.Free([]uint64{5}))
+	pages, err = fs.Malloc(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{5}, pages)
+}
+
+func TestBackgroundGrowth(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-background-growth")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := growthTestOptions(dir)
+	options.GrowthPolicy = GrowthPolicy{Kind: GrowthFixed, Pages: 8}
+	options.LowFreePagesWatermark = 4
+
+	fs, err := NewFileSystem(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer fs.Close(context.Background())
+	lfs := fs.(*localfilesystem)
+
+	// the empty heap is below the watermark from the start
+	assert.Eventually(t, func() bool {
+		return lfs.heap.FreePagesAvailable() >= 4
+	}, time.Second, time.Millisecond*5)
+
+	_, err = fs.Malloc(lfs.heap.FreePagesAvailable() - 1)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return lfs.heap.FreePagesAvailable() >= 4
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestMallocWithinQuota(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-quota")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := growthTestOptions(dir)
+	options.GrowthPolicy = GrowthPolicy{Kind: GrowthFixed, Pages: 8}
+	// meta (header + one free list page) and 4 pages of the first heap file
+	options.QuotaBytes = 2*4096 + 4*4096
+
+	fs, err := NewFileSystem(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer fs.Close(context.Background())
+
+	// the 8 page step does not fit , the 3 pages needed do
+	_, err = fs.Malloc(3)
+	assert.Nil(t, err)
+	stats, err := fs.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), stats.TotalPages)
+	assert.Equal(t, options.QuotaBytes, stats.QuotaBytes)
+
+	_, err = fs.Malloc(2)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
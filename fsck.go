@@ -0,0 +1,100 @@
+package main
+
+import (
+	"boro-db/heap"
+	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/log"
+)
+
+// -key id=hexkey , repeated for every key the heap files were encrypted with
+type keyFlags map[uint32][]byte
+
+func (k keyFlags) String() string {
+	return fmt.Sprintf("%d keys", len(k))
+}
+
+func (k keyFlags) Set(value string) error {
+	id, key, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected id=hexkey , got %s", value)
+	}
+	keyID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return fmt.Errorf("key id %s : %w", id, err)
+	}
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("key %s : %w", id, err)
+	}
+	k[uint32(keyID)] = decoded
+	return nil
+}
+
+// boro-db fsck [-repair] [-page-checksums] [-dirs dir,dir] [-key id=hexkey] [-page-size n -heap-file-size n [-checksum name]] <dir>
+func fsck(logger *log.Logger, args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix header page counts, trailing bytes and stale free list bits")
+	pageChecksums := flags.Bool("page-checksums", false, "verify per page checksums (heap written with EnablePageMeta)")
+	directories := flags.String("dirs", "", "comma separated other directories of a heap spread over several volumes")
+	keys := keyFlags{}
+	flags.Var(keys, "key", "id=hexkey of a key the heap files are encrypted with , repeat for every key")
+	pageSize := flags.Uint("page-size", 0, "page size in bytes , for heaps without a MANIFEST")
+	heapFileSize := flags.Uint("heap-file-size", 0, "max heap file size in bytes , for heaps without a MANIFEST")
+	checksum := flags.String("checksum", checksums.CRC32IEEE.String(), "checksum algorithm , for heaps without a MANIFEST")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: boro-db fsck [-repair] [-page-checksums] [-dirs dir,dir] [-key id=hexkey] [-page-size n -heap-file-size n [-checksum name]] <dir>")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	algorithm, err := checksums.ParseAlgorithm(*checksum)
+	if err != nil {
+		logger.Error().Err(err).Msg("fsck failed")
+		return 2
+	}
+
+	checkOptions := heap.CheckOptions{
+		Repair:              *repair,
+		VerifyPageChecksums: *pageChecksums,
+		PageSizeByte:        uint32(*pageSize),
+		MaxHeapFileSizeByte: uint32(*heapFileSize),
+		ChecksumAlgorithm:   algorithm,
+	}
+	if *directories != "" {
+		checkOptions.Directories = strings.Split(*directories, ",")
+	}
+	if len(keys) != 0 {
+		// only reads are done , the current key is never used
+		var current uint32
+		for id := range keys {
+			current = id
+		}
+		checkOptions.KeyProvider = encryption.NewStaticKeyProvider(current, keys)
+	}
+
+	report, err := heap.Check(*logger, flags.Arg(0), checkOptions)
+	if err != nil {
+		logger.Error().Err(err).Msg("fsck failed")
+		return 2
+	}
+
+	fmt.Fprint(os.Stdout, report.String())
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
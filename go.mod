@@ -3,8 +3,10 @@ module boro-db
 go 1.23.1
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/phuslu/log v1.0.113
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.31.0
 	golang.org/x/sys v0.28.0
 )
 
@@ -0,0 +1,139 @@
+package heap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/*
+Compaction
+┌───────────────────────────────────────┐
+| A | _ | B | _ | _ | C | D | _ |  before
+| A | D | B | C | _ | _ | _ | _ |  moved
+| A | D | B | C |                  trimmed
+└───────────────────────────────────────┘
+  - Free only flips bits , heap files keep their size however little is allocated
+  - live pages are moved from the tail into the lowest free pages one at a time
+    allocate target , copy page , relocate(from , to) , free source
+  - relocate lets the owner (B+ tree , segment map ...) repoint its references before the source is freed
+    it runs without the heap lock so it can use the heap , an error stops compaction with the source intact
+  - pages being compacted must not be written meanwhile , the filesystem layer flushes and invalidates its cache
+  - the free tail is trimmed at the end , deleted / truncated heap files give the space back to the OS
+*/
+type CompactionResult struct {
+	PagesMoved   uint64
+	PagesTrimmed uint64
+}
+
+func (fsh *fileSystemHeap) Compact(relocate func(from uint64, to uint64) error) (CompactionResult, error) {
+	var result CompactionResult
+	buffer := make([]byte, fsh.option.PageSizeByte)
+
+	// pages above the cursor are settled , every page below it is a candidate source
+	fsh.heapFileLock.RLock()
+	cursor := fsh.lastAddressInAddressSpace + 1
+	fsh.heapFileLock.RUnlock()
+
+	for {
+		from, to, ok, err := fsh.nextRelocation(cursor)
+		if err != nil {
+			return result, err
+		}
+		if !ok {
+			break
+		}
+		if err := fsh.relocatePage(from, to, buffer, relocate); err != nil {
+			return result, err
+		}
+		result.PagesMoved++
+		cursor = from
+	}
+
+	trimmed, err := fsh.trimFreeTail()
+	result.PagesTrimmed = trimmed
+	fsh.logger.Info().Msg(fmt.Sprintf("Compacted heap %s moved %d pages trimmed %d pages", fsh.option.FileDirectory, result.PagesMoved, result.PagesTrimmed))
+	return result, err
+}
+
+/*
+picks the highest allocated page below the cursor and allocates the lowest free page for it
+ok is false once no free page is left below the source
+*/
+func (fsh *fileSystemHeap) nextRelocation(cursor uint64) (uint64, uint64, bool, error) {
+	fsh.heapFileLock.Lock()
+	defer fsh.heapFileLock.Unlock()
+	if fsh.closed {
+		return 0, 0, false, ErrClosed
+	}
+	if fsh.freePages == 0 {
+		return 0, 0, false, nil
+	}
+
+	from := min(cursor, fsh.lastAddressInAddressSpace+1)
+	for from > fsh.firstAddressInAddressSpace {
+		from--
+		if fsh.isPageFree(from) {
+			continue
+		}
+		pages, err := fsh.malloc(1)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if pages[0] < from {
+			return from, pages[0], true, nil
+		}
+		// the lowest free page is past the source , the heap is compact
+		return 0, 0, false, fsh.free(pages)
+	}
+	return 0, 0, false, nil
+}
+
+// copies from into the allocated to , the source is only freed once the owner has repointed it
+func (fsh *fileSystemHeap) relocatePage(from uint64, to uint64, buffer []byte, relocate func(from uint64, to uint64) error) error {
+	err := fsh.ReadContext(context.Background(), from, buffer)
+	if err == nil {
+		err = fsh.WriteContext(context.Background(), to, buffer)
+	}
+	if err == nil && relocate != nil {
+		err = relocate(from, to)
+	}
+	if err != nil {
+		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to relocate page %d to %d", from, to))
+		if freeErr := fsh.Free([]uint64{to}); freeErr != nil {
+			return errors.Join(err, freeErr)
+		}
+		return err
+	}
+	return fsh.Free([]uint64{from})
+}
+
+// trims the free pages at the end of the address space , the first page is always kept
+func (fsh *fileSystemHeap) trimFreeTail() (uint64, error) {
+	fsh.heapFileLock.Lock()
+	defer fsh.heapFileLock.Unlock()
+	if fsh.closed {
+		return 0, ErrClosed
+	}
+	// files come and go , the summary is rebuilt before the lock is released
+	defer fsh.recountFreePages()
+	// journal images must not outlive the layout they were taken from
+	defer fsh.resetJournal()
+
+	if fsh.lastAddressInAddressSpace+1 <= fsh.firstAddressInAddressSpace {
+		// empty address space
+		return 0, nil
+	}
+	count := uint64(0)
+	for page := fsh.lastAddressInAddressSpace; page > fsh.firstAddressInAddressSpace && fsh.isPageFree(page); page-- {
+		count++
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	if err := fsh.trimHead(count); err != nil {
+		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to trim %d free tail pages", count))
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,179 @@
+package heap
+
+import (
+	"boro-db/utils/checksums"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrCompressedPageCorrupted = fmt.Errorf("compressed page corrupted")
+
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+/*
+Compressed page slot
+┌──────────────────────────────────────────────────────────────┐
+| magic (4byte) | codec (1byte) | padding (3byte)              |
+| compressed length (4byte) | crc32c of compressed data (4byte)|
+| compressed data ......                                       |
+|-------------------- hole punched till PageSize --------------|
+└──────────────────────────────────────────────────────────────┘
+  - every page keeps its full PageSize slot , addressing does not change
+  - a page is only stored compressed when it frees at least one filesystem block
+    otherwise it is written as is , reads tell the two apart by the header
+  - the rest of the slot is punched (fallocate PUNCH_HOLE) so the saved blocks go back to the filesystem
+  - reads always check for the header , turning compression off keeps old pages readable
+*/
+const compressedPageMagic = uint32(0xB0C0DE21)
+const compressedPageHeaderSize = 16
+
+// linux fallocate flags , not exported by syscall
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// built on first use and shared by every heap , a failure is returned by every page write / read needing them
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+})
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+})
+
+func isValidCompression(c Compression) bool {
+	return c <= CompressionZstd
+}
+
+func compress(c Compression, page []byte) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		return s2.EncodeSnappy(nil, page), nil
+	case CompressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(page, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
+
+func decompress(c Compression, compressed []byte, page []byte) error {
+	var decoded []byte
+	var err error
+	switch c {
+	case CompressionSnappy:
+		decoded, err = s2.Decode(nil, compressed)
+	case CompressionZstd:
+		decoder, decoderErr := zstdDecoder()
+		if decoderErr != nil {
+			return decoderErr
+		}
+		decoded, err = decoder.DecodeAll(compressed, nil)
+	default:
+		return fmt.Errorf("%w : unknown compression %s", ErrCompressedPageCorrupted, c)
+	}
+	if err != nil {
+		return fmt.Errorf("%w : %w", ErrCompressedPageCorrupted, err)
+	}
+	if len(decoded) != len(page) {
+		return fmt.Errorf("%w : decompressed to %d bytes , page is %d bytes", ErrCompressedPageCorrupted, len(decoded), len(page))
+	}
+	copy(page, decoded)
+	return nil
+}
+
+/*
+encodes the page for its slot , returns the bytes to write.
+nil when the page should be stored as is.
+*/
+func encodePage(option *HeapFileOptions, page []byte, blockSize int) ([]byte, error) {
+	if option.Compression == CompressionNone {
+		return nil, nil
+	}
+	compressed, err := compress(option.Compression, page)
+	if err != nil {
+		return nil, err
+	}
+	size := compressedPageHeaderSize + len(compressed)
+	if roundUp(size, blockSize) > len(page)-blockSize {
+		return nil, nil
+	}
+
+	slot := make([]byte, size)
+	binary.BigEndian.PutUint32(slot[0:4], compressedPageMagic)
+	slot[4] = byte(option.Compression)
+	binary.BigEndian.PutUint32(slot[8:12], uint32(len(compressed)))
+	copy(slot[compressedPageHeaderSize:], compressed)
+	checksums.Calculate(checksums.CRC32C, slot[12:16], compressed)
+	return slot, nil
+}
+
+// decodes a slot read from disk in place , slots without the header are left untouched
+func decodePage(slot []byte) error {
+	if len(slot) < compressedPageHeaderSize || binary.BigEndian.Uint32(slot[0:4]) != compressedPageMagic {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint32(slot[8:12]))
+	if length > len(slot)-compressedPageHeaderSize {
+		return nil
+	}
+	compressed := slot[compressedPageHeaderSize : compressedPageHeaderSize+length]
+	if !checksums.Verify(checksums.CRC32C, slot[12:16], compressed) {
+		// a raw page that happens to start with the magic
+		return nil
+	}
+	return decompress(Compression(slot[4]), bytes.Clone(compressed), slot)
+}
+
+func roundUp(size int, blockSize int) int {
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// gives the blocks past used bytes of the slot back to the filesystem
+func punchHole(fd int, slotOffset int64, used int, slotSize int, blockSize int) error {
+	start := roundUp(used, blockSize)
+	if start >= slotSize {
+		return nil
+	}
+	return syscall.Fallocate(fd, fallocPunchHole|fallocKeepSize, slotOffset+int64(start), int64(slotSize-start))
+}
+
+// largest filesystem block size of the heap directories , punch hole works in these units
+func filesystemBlockSize(directories []string) int {
+	blockSize := 0
+	for _, directory := range directories {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(directory, &stat); err != nil || stat.Bsize <= 0 {
+			blockSize = max(blockSize, 4096)
+			continue
+		}
+		blockSize = max(blockSize, int(stat.Bsize))
+	}
+	return blockSize
+}
@@ -0,0 +1,116 @@
+package heap
+
+import (
+	"boro-db/logging"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const crashStageEnv = "BORO_HEAP_CRASH_STAGE"
+const crashDirEnv = "BORO_HEAP_CRASH_DIR"
+
+func crashTestOptions(dir string) *HeapFileOptions {
+	return &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 6,
+	}
+}
+
+// runs in the re-executed test binary , dies at the failpoint of the stage
+func crashingAllocation(stage string, dir string) {
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), crashTestOptions(dir))
+	if err != nil {
+		os.Exit(2)
+	}
+	if err := heapFile.ExtendBy(8); err != nil {
+		os.Exit(2)
+	}
+	if _, err := heapFile.Malloc(1); err != nil {
+		os.Exit(2)
+	}
+
+	failpoint = func(name string) {
+		switch {
+		case stage == "torn" && name == "allocation-journal-write":
+			// half written journal
+			os.WriteFile(filepath.Join(dir, allocationJournalFileName), []byte{0xDE, 0xAD, 0xBE, 0xEF, 0, 0, 0, 2, 1, 2, 3}, 0644)
+		case stage != name:
+			return
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+	}
+	// spans both heap files
+	heapFile.Malloc(6)
+	os.Exit(3)
+}
+
+func TestAllocationCrash(t *testing.T) {
+	if stage := os.Getenv(crashStageEnv); stage != "" {
+		crashingAllocation(stage, os.Getenv(crashDirEnv))
+		return
+	}
+
+	stages := map[string]uint64{
+		// free pages expected after reopening , 8 - 1 when the allocation is lost , 8 - 7 when it is kept
+		"allocation-journal-write":     7,
+		"torn":                         7,
+		"allocation-journaled":         1,
+		"allocation-partially-applied": 1,
+	}
+
+	pt, _ := os.Getwd()
+	for stage, freePages := range stages {
+		t.Run(stage, func(t *testing.T) {
+			dir := filepath.Join(pt, "test-crash")
+			os.RemoveAll(dir)
+			defer func() {
+				os.RemoveAll(dir)
+			}()
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestAllocationCrash$")
+			cmd.Env = append(os.Environ(), crashStageEnv+"="+stage, crashDirEnv+"="+dir)
+			err := cmd.Run()
+			exitErr, ok := err.(*exec.ExitError)
+			if !assert.True(t, ok, "child should be killed , got %v", err) {
+				return
+			}
+			status := exitErr.Sys().(syscall.WaitStatus)
+			if !assert.True(t, status.Signaled(), "child exited with %d", exitErr.ExitCode()) {
+				return
+			}
+
+			heapFile, err := NewHeap(*logging.CreateDebugLogger(), crashTestOptions(dir))
+			assert.Nil(t, err)
+
+			assert.Equal(t, freePages, heapFile.FreePagesAvailable())
+			allocated := uint64(0)
+			addressRange := heapFile.ValidAddressRange()
+			for page := addressRange[0]; page <= addressRange[1]; page++ {
+				if !heapFile.IsPageFree(page) {
+					allocated++
+				}
+			}
+			assert.Equal(t, 8-freePages, allocated)
+
+			pages, err := heapFile.Malloc(freePages)
+			assert.Nil(t, err)
+			seen := map[uint64]bool{}
+			for _, page := range pages {
+				assert.True(t, !seen[page], "page %d handed out twice", page)
+				seen[page] = true
+			}
+			assert.Nil(t, heapFile.Close(context.Background()))
+
+			report, err := Check(*logging.CreateDebugLogger(), dir, CheckOptions{})
+			assert.Nil(t, err)
+			assert.True(t, report.OK())
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package heap
+
+import (
+	"boro-db/utils/encryption"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/phuslu/log"
+)
+
+/*
+Encryption at rest
+- pages are encrypted on their way between the page system and the disk (Read / Write)
+- compression runs first , only the used part of a compressed slot is encrypted so punched holes stay holes
+- heap file meta (header + free list) is not encrypted , it holds no user data
+- every heap file records in its header (format v3) whether it is encrypted and the id of its key
+- new heap files use the provider's current key , existing files keep theirs (key rotation)
+- heap files created before a key provider was configured stay plain text
+*/
+const headerEncryptedOffset = 25
+const headerKeyIDOffset = 28
+
+// serialized by SerializeMetaData for v3 headers
+func serializeEncryptionFields(hpm *heapfilemeta) {
+	hpm.buffer[headerEncryptedOffset] = 0
+	if hpm.encrypted {
+		hpm.buffer[headerEncryptedOffset] = 1
+	}
+	binary.BigEndian.PutUint32(hpm.buffer[headerKeyIDOffset:headerKeyIDOffset+4], hpm.keyID)
+}
+
+func deserializeEncryptionFields(hpm *heapfilemeta) {
+	hpm.encrypted = hpm.buffer[headerEncryptedOffset] == 1
+	hpm.keyID = binary.BigEndian.Uint32(hpm.buffer[headerKeyIDOffset : headerKeyIDOffset+4])
+}
+
+// new heap files are encrypted with the current key when a provider is configured
+func initFileEncryption(hpm *heapfilemeta) error {
+	if hpm.options.KeyProvider == nil {
+		return nil
+	}
+	hpm.encrypted = true
+	hpm.keyID = hpm.options.KeyProvider.CurrentKeyID()
+	return loadFileCipher(hpm)
+}
+
+// builds the cipher of an existing heap file from its key id
+func loadFileCipher(hpm *heapfilemeta) error {
+	if !hpm.encrypted {
+		return nil
+	}
+	if hpm.options.KeyProvider == nil {
+		return fmt.Errorf("%w : heap file %d is encrypted with key %d but no key provider is configured", encryption.ErrKeyNotFound, hpm.addressSpaceStart, hpm.keyID)
+	}
+	key, err := hpm.options.KeyProvider.Key(hpm.keyID)
+	if err != nil {
+		return fmt.Errorf("heap file %d : %w", hpm.addressSpaceStart, err)
+	}
+	hpm.cipher, err = encryption.NewPageCipher(key, int(hpm.options.PageSizeByte))
+	return err
+}
+
+func warnPlainTextFile(logger log.Logger, hpm *heapfilemeta) {
+	if hpm.options.KeyProvider != nil && !hpm.encrypted {
+		logger.Warn().Msg(fmt.Sprintf("Heap file %d predates encryption and is stored as plain text", hpm.addressSpaceStart))
+	}
+}
+
+// encrypts the bytes headed for the page slot , the caller's buffer is left untouched
+func encryptSlot(hpm *heapfilemeta, pageNumber uint64, slot []byte) ([]byte, error) {
+	if hpm.cipher == nil {
+		return slot, nil
+	}
+	encrypted := make([]byte, roundUp(len(slot), encryption.UnitSize))
+	copy(encrypted, slot)
+	if err := hpm.cipher.Encrypt(encrypted, pageNumber); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+func decryptSlot(hpm *heapfilemeta, pageNumber uint64, slot []byte) error {
+	if hpm.cipher == nil {
+		return nil
+	}
+	return hpm.cipher.Decrypt(slot, pageNumber)
+}
@@ -1,5 +1,11 @@
 package heap
 
+import (
+	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
+	"context"
+)
+
 const MIN_PAGE_SIZE = uint32(4096)                        // 4kb
 const MAX_HEAP_FILE_SIZE = uint32(2 * 1024 * 1024 * 1024) // 1GB
 
@@ -7,6 +13,21 @@ type HeapFileOptions struct {
 	PageSizeByte        uint32 // size of one page block in bytes
 	FileDirectory       string // file directory where the heap files are located
 	MaxHeapFileSizeByte uint32 // size of heap file inclusive of the metadata. count of page = heapfileSizeByte / pageSizeByte - 1
+	UpgradeFormatOnOpen bool   // rewrite heap files in older formats to CurrentHeapFileFormat while opening
+	// more volumes heap files are spread over , FileDirectory keeps the manifest / journals , see placement.go
+	Directories []string
+	// where new heap files go when there are several directories
+	Placement Placement
+	// checksum used by heap file headers and page meta , pinned by the manifest
+	ChecksumAlgorithm checksums.Algorithm
+	// compress pages on write , reads handle compressed and plain pages either way
+	Compression Compression
+	// encrypts pages of new heap files when set , required to open encrypted ones
+	KeyProvider encryption.KeyProvider
+	// punch the blocks of freed pages out of the heap file , they are fallocated again on reuse
+	PunchHolesOnFree bool
+	// hard cap on the apparent bytes of the heap files , ExtendBy fails with ErrQuotaExceeded past it. 0 means none
+	QuotaBytes uint64
 }
 
 type HeapFile interface {
@@ -22,15 +43,29 @@ type HeapFile interface {
 	ExtendBy(pageCount int) error
 	Read(pageNumber uint64, buffer []byte, onRead func(error))
 	Write(pageNumber uint64, buffer []byte, onWrite func(error))
+	// blocking variants of Read / Write
+	// pread / pwrite can not be interrupted so the context is only checked before the I/O starts
+	ReadContext(ctx context.Context, pageNumber uint64, buffer []byte) error
+	WriteContext(ctx context.Context, pageNumber uint64, buffer []byte) error
 	ValidAddressRange() [2]uint64
 
 	// Part of free space management system
 	// if heap files are used as immutable log file ignore this
 	// if heap files are used as mutable address space use this
 	Malloc(count uint64) ([]uint64, error)
+	// Allocates count pages laid out sequentially on disk , best fit over the free runs
+	MallocContiguous(count uint64) ([]uint64, error)
 	Free(pageNumbers []uint64) error
 	FreePagesAvailable() uint64
+	// capacity report for monitoring , see stats.go
+	Stats() (Stats, error)
 	// Checks if given page is free or not. if it out of range return false
 	// use it always before Read / Write if you care about allocation
 	IsPageFree(pageNumber uint64) bool
+	// Moves live pages from the tail into free pages and trims the freed tail , see compaction.go
+	// relocate is called for every moved page before its old copy is freed
+	Compact(relocate func(from uint64, to uint64) error) (CompactionResult, error)
+
+	// fsyncs and closes every heap file , any call after Close returns ErrClosed
+	Close(ctx context.Context) error
 }
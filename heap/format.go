@@ -0,0 +1,170 @@
+package heap
+
+import (
+	"boro-db/utils/checksums"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"github.com/phuslu/log"
+)
+
+var ErrUnsupportedFormat = fmt.Errorf("unsupported heap file format")
+var ErrHeaderCorrupted = fmt.Errorf("heap file header corrupted")
+
+/*
+Heap file format versions
+  - v0 : crc | pageCount | start-address , no version field (bytes 16-20 are zero)
+  - v1 : v0 + version (4byte) + free list page count (4byte)
+    free list bits past pageCount are always zero
+  - v2 : v1 + checksum algorithm (1byte) , the checksum moves to an 8 byte slot
+    so 64 bit algorithms fit. the crc slot of v0 / v1 stays zero
+  - v3 : v2 + encrypted flag (1byte) + encryption key id (4byte) , see encryption.go
+
+Readers support the last supportedFormatVersions versions. Older files can be
+upgraded online (HeapFileOptions.UpgradeFormatOnOpen) or offline (UpgradeHeap).
+Every version bump adds an entry to formatUpgrades which rewrites a file
+from version n to n+1 in memory , the caller persists the meta buffer.
+*/
+const (
+	heapFileFormatV0 = uint32(0)
+	heapFileFormatV1 = uint32(1)
+	heapFileFormatV2 = uint32(2)
+	heapFileFormatV3 = uint32(3)
+)
+
+const CurrentHeapFileFormat = heapFileFormatV3
+const supportedFormatVersions = 4
+
+const headerVersionOffset = 16
+const headerFreeListPagesOffset = 20
+const headerChecksumAlgorithmOffset = 24
+const headerChecksumOffset = 32
+const headerChecksumSize = 8
+
+var formatUpgrades = map[uint32]func(hpm *heapfilemeta){
+	heapFileFormatV0: upgradeV0ToV1,
+	heapFileFormatV1: upgradeV1ToV2,
+	heapFileFormatV2: upgradeV2ToV3,
+}
+
+func isSupportedFormat(version uint32) bool {
+	return version <= CurrentHeapFileFormat && CurrentHeapFileFormat-version < supportedFormatVersions
+}
+
+func freeListPageCount(option *HeapFileOptions) uint32 {
+	return getFreeListSizeBytes(option) / option.PageSizeByte
+}
+
+// v0 left stale allocation bits past pageCount after truncation , v1 guarantees they are clear
+func upgradeV0ToV1(hpm *heapfilemeta) {
+	pageSize := hpm.options.PageSizeByte
+	freeListSpace := hpm.buffer[pageSize:]
+	for page := uint64(hpm.pageCount); page < uint64(len(freeListSpace))*8; page++ {
+		freeListSpace[page/8] &^= 1 << (page % 8)
+	}
+	hpm.version = heapFileFormatV1
+}
+
+// the algorithm byte is written by SerializeMetaData from the options
+func upgradeV1ToV2(hpm *heapfilemeta) {
+	hpm.version = heapFileFormatV2
+}
+
+// files written before v3 are plain text
+func upgradeV2ToV3(hpm *heapfilemeta) {
+	hpm.encrypted = false
+	hpm.keyID = 0
+	hpm.version = heapFileFormatV3
+}
+
+// checksum algorithm of the header , files before v2 always used crc32 (IEEE)
+func headerChecksumAlgorithm(hpm *heapfilemeta) checksums.Algorithm {
+	if hpm.version < heapFileFormatV2 {
+		return checksums.CRC32IEEE
+	}
+	return checksums.Algorithm(hpm.buffer[headerChecksumAlgorithmOffset])
+}
+
+/*
+v0 / v1 : crc32 (IEEE) of buffer[4:PageSize] stored in buffer[0:4]
+v2 : checksum of buffer[0:PageSize] with the checksum slot zeroed , stored in the slot
+*/
+func calculateHeaderChecksum(hpm *heapfilemeta) {
+	header := hpm.buffer[:hpm.options.PageSizeByte]
+	if hpm.version < heapFileFormatV2 {
+		checksums.CalculateCRC(header[0:4], header[4:])
+		return
+	}
+	clear(header[0:4])
+	header[headerChecksumAlgorithmOffset] = byte(hpm.options.ChecksumAlgorithm)
+	slot := header[headerChecksumOffset : headerChecksumOffset+headerChecksumSize]
+	clear(slot)
+	sum := make([]byte, headerChecksumSize)
+	// the algorithm is validated against the registry when the manifest is loaded (or by Check)
+	checksums.Calculate(hpm.options.ChecksumAlgorithm, sum, header)
+	copy(slot, sum)
+}
+
+func verifyHeaderChecksum(hpm *heapfilemeta) bool {
+	header := hpm.buffer[:hpm.options.PageSizeByte]
+	if hpm.version < heapFileFormatV2 {
+		crcBuffer := make([]byte, 4)
+		checksums.CalculateCRC(crcBuffer, header[4:])
+		return checksums.CompareCRC(crcBuffer, header[0:4])
+	}
+	slot := header[headerChecksumOffset : headerChecksumOffset+headerChecksumSize]
+	stored := make([]byte, headerChecksumSize)
+	copy(stored, slot)
+	clear(slot)
+	match := checksums.Verify(headerChecksumAlgorithm(hpm), stored, header)
+	copy(slot, stored)
+	return match
+}
+
+// upgrades the in memory meta of a heap file to CurrentHeapFileFormat and persists it
+func upgradeHeapFile(hpm *heapfilemeta, logger log.Logger) error {
+	if hpm.version == CurrentHeapFileFormat {
+		return nil
+	}
+	from := hpm.version
+	for hpm.version < CurrentHeapFileFormat {
+		upgrade, ok := formatUpgrades[hpm.version]
+		if !ok {
+			return fmt.Errorf("%w : no upgrade path from version %d", ErrUnsupportedFormat, hpm.version)
+		}
+		upgrade(hpm)
+	}
+	hpm.SerializeMetaData()
+
+	if _, err := syscall.Pwrite(hpm.fd, hpm.buffer, 0); err != nil {
+		logger.Error().Err(err).Msg(fmt.Sprintf("Failed to write upgraded heap file %d", hpm.addressSpaceStart))
+		return err
+	}
+	if err := syscall.Fsync(hpm.fd); err != nil {
+		logger.Error().Err(err).Msg(fmt.Sprintf("Failed to fsync upgraded heap file %d", hpm.addressSpaceStart))
+		return err
+	}
+	logger.Info().Msg(fmt.Sprintf("Upgraded heap file %d from format %d to %d", hpm.addressSpaceStart, from, hpm.version))
+	return nil
+}
+
+/*
+Offline upgrade of every heap file in the directory to CurrentHeapFileFormat.
+The heap must not be open anywhere else , the directory lock enforces that.
+*/
+func UpgradeHeap(logger log.Logger, option *HeapFileOptions) error {
+	upgradeOption := *option
+	upgradeOption.UpgradeFormatOnOpen = true
+
+	heap, err := NewHeap(logger, &upgradeOption)
+	if err != nil {
+		return err
+	}
+	return heap.Close(context.Background())
+}
+
+func readHeaderVersion(buffer []byte) uint32 {
+	return binary.BigEndian.Uint32(buffer[headerVersionOffset : headerVersionOffset+4])
+}
@@ -0,0 +1,34 @@
+package heap
+
+/*
+Free space summary
+- page level : bitmap per free list page (persisted) with per chunk free counts (utils/freelist)
+- file level : heapfilemeta.freePages , lets Malloc skip full heap files without touching their free lists
+- heap level : fileSystemHeap.freePages , FreePagesAvailable and the not enough space check are O(1)
+Counters are adjusted on every allocation / release and recounted from the
+free lists whenever heap files are created , extended or trimmed.
+*/
+
+// caller must hold the heapFileLock
+func (hpm *heapfilemeta) recountFreePages() {
+	hpm.freePages = 0
+	for _, fl := range hpm.freelist {
+		hpm.freePages += fl.TotalFreeLocs()
+	}
+}
+
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) recountFreePages() {
+	fsh.freePages = 0
+	for _, hpf := range fsh.fileIdentifiers {
+		hpf.recountFreePages()
+		fsh.freePages += hpf.freePages
+	}
+}
+
+// records pages taken (negative) or given back (positive) in a heap file
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) adjustFreePages(hpf *heapfilemeta, delta int64) {
+	hpf.freePages = uint64(int64(hpf.freePages) + delta)
+	fsh.freePages = uint64(int64(fsh.freePages) + delta)
+}
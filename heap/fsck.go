@@ -0,0 +1,381 @@
+package heap
+
+import (
+	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/phuslu/log"
+)
+
+/*
+Offline integrity checker for a heap directory
+- header CRC and format version
+- pageCount vs actual file size
+- free list bits past pageCount
+- heap files covering a contiguous address space (every file but the last is full)
+- per page checksums when the pages were written with paging EnablePageMeta
+With Repair set it fixes what NewHeap would otherwise fix silently on open
+(header page count , trailing bytes , stale free list bits). Anything else is only reported.
+*/
+type CheckOptions struct {
+	Repair              bool
+	VerifyPageChecksums bool
+	// needed to verify page checksums of encrypted heap files
+	KeyProvider encryption.KeyProvider
+	// the other heap directories of a heap spread over several volumes , see placement.go
+	Directories []string
+	// sizes of heaps created before manifests (no MANIFEST in the directory)
+	// the missing manifest is reported and the check runs with these , Repair writes it
+	PageSizeByte        uint32
+	MaxHeapFileSizeByte uint32
+	ChecksumAlgorithm   checksums.Algorithm
+}
+
+type CheckIssue struct {
+	File        string
+	Description string
+	Repairable  bool
+	Repaired    bool
+}
+
+type CheckReport struct {
+	Directory    string
+	Manifest     *Manifest
+	FilesChecked int
+	PagesChecked uint64
+	Issues       []CheckIssue
+}
+
+// OK is true when nothing is left to fix
+func (r *CheckReport) OK() bool {
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CheckReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "heap directory : %s\n", r.Directory)
+	if r.Manifest != nil {
+		fmt.Fprintf(&sb, "manifest : %s page size %d max heap file size %d checksum %s\n", r.Manifest.UUID(), r.Manifest.PageSizeByte, r.Manifest.MaxHeapFileSizeByte, r.Manifest.ChecksumAlgorithm)
+	}
+	fmt.Fprintf(&sb, "files checked : %d pages checked : %d issues : %d\n", r.FilesChecked, r.PagesChecked, len(r.Issues))
+	for _, issue := range r.Issues {
+		status := "not repairable"
+		if issue.Repaired {
+			status = "repaired"
+		} else if issue.Repairable {
+			status = "repairable"
+		}
+		fmt.Fprintf(&sb, "%s : %s (%s)\n", issue.File, issue.Description, status)
+	}
+	return sb.String()
+}
+
+func (r *CheckReport) add(file string, repairable bool, repaired bool, format string, args ...any) {
+	r.Issues = append(r.Issues, CheckIssue{
+		File:        file,
+		Description: fmt.Sprintf(format, args...),
+		Repairable:  repairable,
+		Repaired:    repaired,
+	})
+}
+
+func parseHeapFileName(name string) (uint64, bool) {
+	parts := strings.Split(name, heapfileNameSepparate)
+	if len(parts) != 2 || parts[0] != heapFileNamePrefix {
+		return 0, false
+	}
+	start, err := strconv.ParseUint(parts[1], 10, 64)
+	return start, err == nil
+}
+
+/*
+Check validates every heap file in the directory and CheckOptions.Directories.
+Page and heap file sizes come from the manifest , or from CheckOptions for heaps
+created before manifests. The directory locks are held for the duration of the
+check so the heap can not be opened underneath it.
+*/
+func Check(logger log.Logger, directory string, checkOptions CheckOptions) (*CheckReport, error) {
+
+	manifest, err := ReadManifest(directory)
+	missingManifest := errors.Is(err, os.ErrNotExist)
+	if err != nil && !missingManifest {
+		return nil, fmt.Errorf("reading manifest of %s : %w", directory, err)
+	}
+	if missingManifest && (checkOptions.PageSizeByte == 0 || checkOptions.MaxHeapFileSizeByte == 0) {
+		return nil, fmt.Errorf("%s has no manifest , page size and max heap file size have to be given", directory)
+	}
+
+	option := &HeapFileOptions{
+		PageSizeByte:        checkOptions.PageSizeByte,
+		MaxHeapFileSizeByte: checkOptions.MaxHeapFileSizeByte,
+		FileDirectory:       directory,
+		Directories:         checkOptions.Directories,
+		ChecksumAlgorithm:   checkOptions.ChecksumAlgorithm,
+		KeyProvider:         checkOptions.KeyProvider,
+	}
+	if manifest != nil {
+		option.PageSizeByte = manifest.PageSizeByte
+		option.MaxHeapFileSizeByte = manifest.MaxHeapFileSizeByte
+		option.ChecksumAlgorithm = manifest.ChecksumAlgorithm
+	}
+	if _, err := checksums.Get(option.ChecksumAlgorithm); err != nil {
+		return nil, err
+	}
+
+	locks, err := acquireDirectoryLocks(heapDirectories(option))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseDirectoryLocks(locks)
+
+	report := &CheckReport{
+		Directory: directory,
+		Manifest:  manifest,
+	}
+
+	if missingManifest {
+		repaired := false
+		if checkOptions.Repair {
+			if manifest, err = newManifest(option); err != nil {
+				return nil, err
+			}
+			if err := writeManifest(directory, manifest); err != nil {
+				return nil, err
+			}
+			report.Manifest = manifest
+			repaired = true
+		}
+		report.add(manifestFileName, true, repaired, "missing , checked with page size %d and max heap file size %d", option.PageSizeByte, option.MaxHeapFileSizeByte)
+	}
+
+	starts := make([]uint64, 0)
+	directoryOf := make(map[uint64]string)
+	for _, heapDirectory := range heapDirectories(option) {
+		fileEntries, err := os.ReadDir(heapDirectory)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileEntry := range fileEntries {
+			start, ok := parseHeapFileName(fileEntry.Name())
+			if !ok || fileEntry.IsDir() {
+				continue
+			}
+			if existing, found := directoryOf[start]; found {
+				report.add(fileEntry.Name(), false, false, "is in both %s and %s", existing, heapDirectory)
+				continue
+			}
+			directoryOf[start] = heapDirectory
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var previous *heapfilemeta
+	for _, start := range starts {
+		hpf, err := checkHeapFile(logger, option, directoryOf[start], start, checkOptions, report)
+		if err != nil {
+			return nil, err
+		}
+		report.FilesChecked++
+		if hpf == nil {
+			continue
+		}
+		checkContiguity(option, previous, hpf, report)
+		previous = hpf
+	}
+
+	return report, nil
+}
+
+func checkContiguity(option *HeapFileOptions, previous *heapfilemeta, current *heapfilemeta, report *CheckReport) {
+	name := heapFileName(current.addressSpaceStart)
+	maxPages := uint64(totalPagesInHeapFile(option))
+
+	if current.addressSpaceStart%maxPages != 0 {
+		report.add(name, false, false, "start address %d is not aligned to %d pages", current.addressSpaceStart, maxPages)
+	}
+	if previous == nil {
+		return
+	}
+	if uint64(previous.pageCount) != maxPages {
+		report.add(heapFileName(previous.addressSpaceStart), false, false, "has %d of %d pages but is followed by %s", previous.pageCount, maxPages, name)
+	}
+	if previous.addressSpaceStart+uint64(previous.pageCount) != current.addressSpaceStart {
+		report.add(name, false, false, "address space gap , previous file ends at %d but this one starts at %d", previous.addressSpaceStart+uint64(previous.pageCount), current.addressSpaceStart)
+	}
+}
+
+func checkHeapFile(logger log.Logger, option *HeapFileOptions, directory string, start uint64, checkOptions CheckOptions, report *CheckReport) (*heapfilemeta, error) {
+	name := heapFileName(start)
+	path := filepath.Join(directory, name)
+	heapFileMetaSize := getHeapFileMetaSize(option)
+
+	mode := syscall.O_RDONLY
+	if checkOptions.Repair {
+		mode = syscall.O_RDWR
+	}
+	fd, err := syscall.Open(path, mode, permissionBits)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return nil, err
+	}
+
+	if stat.Size < int64(heapFileMetaSize) {
+		report.add(name, false, false, "file is %d bytes , smaller than the %d bytes of metadata", stat.Size, heapFileMetaSize)
+		return nil, nil
+	}
+
+	hpf := &heapfilemeta{
+		fd:                fd,
+		addressSpaceStart: start,
+		directory:         directory,
+		options:           option,
+		buffer:            make([]byte, heapFileMetaSize),
+	}
+	if _, err := syscall.Pread(fd, hpf.buffer, 0); err != nil {
+		return nil, err
+	}
+
+	dirty := false
+	pagesOnDisk := totalPagesInHeapFileForGivenHeapFileSize(uint32(stat.Size)-heapFileMetaSize, option)
+
+	if err := hpf.DeserializeMetadat(); err != nil {
+		if !errors.Is(err, ErrHeaderCorrupted) {
+			report.add(name, false, false, "%s", err.Error())
+			return nil, nil
+		}
+		if !isSupportedFormat(hpf.version) {
+			hpf.version = CurrentHeapFileFormat
+		}
+		report.add(name, true, checkOptions.Repair, "header CRC mismatch , page count rebuilt from file size as %d", pagesOnDisk)
+		hpf.pageCount = pagesOnDisk
+		hpf.addressSpaceStart = start
+		dirty = true
+	}
+
+	if hpf.addressSpaceStart != start {
+		report.add(name, false, false, "header start address %d does not match file name", hpf.addressSpaceStart)
+	}
+
+	if hpf.pageCount > totalPagesInHeapFile(option) {
+		report.add(name, false, false, "page count %d is larger than the %d pages a heap file can hold", hpf.pageCount, totalPagesInHeapFile(option))
+		return nil, nil
+	}
+
+	expectedSize := int64(heapFileMetaSize) + int64(hpf.pageCount)*int64(option.PageSizeByte)
+	truncate := false
+	if stat.Size > expectedSize {
+		report.add(name, true, checkOptions.Repair, "%d trailing bytes past page count %d", stat.Size-expectedSize, hpf.pageCount)
+		truncate = true
+	} else if stat.Size < expectedSize {
+		report.add(name, true, checkOptions.Repair, "page count %d but only %d pages on disk", hpf.pageCount, pagesOnDisk)
+		hpf.pageCount = pagesOnDisk
+		dirty = true
+		truncate = true
+	}
+
+	freeListSpace := hpf.buffer[option.PageSizeByte:]
+	staleBits := 0
+	for page := uint64(hpf.pageCount); page < uint64(len(freeListSpace))*8; page++ {
+		if freeListSpace[page/8]&(1<<(page%8)) != 0 {
+			freeListSpace[page/8] &^= 1 << (page % 8)
+			staleBits++
+		}
+	}
+	if staleBits != 0 {
+		report.add(name, true, checkOptions.Repair, "%d free list bits set past page count %d", staleBits, hpf.pageCount)
+		dirty = true
+	}
+
+	if checkOptions.VerifyPageChecksums {
+		if err := loadFileCipher(hpf); err != nil {
+			report.add(name, false, false, "page checksums not verified : %s", err.Error())
+		} else if err := checkPageChecksums(hpf, report); err != nil {
+			return nil, err
+		}
+	}
+	report.PagesChecked += uint64(hpf.pageCount)
+
+	if !checkOptions.Repair {
+		return hpf, nil
+	}
+
+	if dirty {
+		hpf.SerializeMetaData()
+		if _, err := syscall.Pwrite(fd, hpf.buffer, 0); err != nil {
+			return nil, err
+		}
+	}
+	if truncate {
+		if err := syscall.Ftruncate(fd, int64(heapFileMetaSize)+int64(hpf.pageCount)*int64(option.PageSizeByte)); err != nil {
+			return nil, err
+		}
+	}
+	if dirty || truncate {
+		if err := syscall.Fsync(fd); err != nil {
+			return nil, err
+		}
+		logger.Info().Msg(fmt.Sprintf("Repaired heap file %s", name))
+	}
+
+	return hpf, nil
+}
+
+// allocated pages only , pages never written are all zeros and carry no checksum
+func checkPageChecksums(hpf *heapfilemeta, report *CheckReport) error {
+	option := hpf.options
+	heapFileMetaSize := getHeapFileMetaSize(option)
+	freeListSpace := hpf.buffer[option.PageSizeByte:]
+	page := make([]byte, option.PageSizeByte)
+	checksumSize := option.ChecksumAlgorithm.Size()
+
+	for offset := uint64(0); offset < uint64(hpf.pageCount); offset++ {
+		if freeListSpace[offset/8]&(1<<(offset%8)) == 0 {
+			continue
+		}
+		if _, err := syscall.Pread(hpf.fd, page, int64(heapFileMetaSize)+int64(offset)*int64(option.PageSizeByte)); err != nil {
+			return err
+		}
+		if err := decryptSlot(hpf, hpf.addressSpaceStart+offset, page); err != nil {
+			return err
+		}
+		if err := decodePage(page); err != nil {
+			report.add(heapFileName(hpf.addressSpaceStart), false, false, "page %d : %s", hpf.addressSpaceStart+offset, err.Error())
+			continue
+		}
+		if isZeroPage(page) {
+			continue
+		}
+		if !checksums.Verify(option.ChecksumAlgorithm, page[0:checksumSize], page[checksumSize:]) {
+			report.add(heapFileName(hpf.addressSpaceStart), false, false, "page %d checksum mismatch", hpf.addressSpaceStart+offset)
+		}
+	}
+	return nil
+}
+
+func isZeroPage(buffer []byte) bool {
+	for _, b := range buffer {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
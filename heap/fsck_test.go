@@ -0,0 +1,113 @@
+package heap
+
+import (
+	"boro-db/logging"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-fsck")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(6))
+	_, err = heapFile.Malloc(2)
+	assert.Nil(t, err)
+
+	// check refuses to run while the heap is open
+	_, err = Check(*logging.CreateDebugLogger(), dir, CheckOptions{})
+	assert.ErrorIs(t, err, ErrDirectoryLocked)
+
+	// break the header CRC of the second file and leave trailing bytes behind
+	hpf := heapFile.(*fileSystemHeap).fileIdentifiers[1]
+	_, err = syscall.Pwrite(hpf.fd, []byte{0xFF, 0xFF, 0xFF, 0xFF}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.Close(context.Background()))
+	file, err := os.OpenFile(filepath.Join(dir, heapFileName(4)), os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("garbage"))
+	assert.Nil(t, err)
+	file.Close()
+
+	report, err := Check(*logging.CreateDebugLogger(), dir, CheckOptions{VerifyPageChecksums: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.FilesChecked)
+	assert.False(t, report.OK())
+	assert.Len(t, report.Issues, 2)
+	for _, issue := range report.Issues {
+		assert.Equal(t, heapFileName(4), issue.File)
+		assert.True(t, issue.Repairable)
+	}
+
+	report, err = Check(*logging.CreateDebugLogger(), dir, CheckOptions{Repair: true})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	report, err = Check(*logging.CreateDebugLogger(), dir, CheckOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Equal(t, uint64(6), report.PagesChecked)
+}
+
+func TestCheckWithoutManifest(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-fsck-no-manifest")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+	}
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(6))
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	// a heap from before manifests
+	assert.Nil(t, os.Remove(filepath.Join(dir, manifestFileName)))
+
+	_, err = Check(*logging.CreateDebugLogger(), dir, CheckOptions{})
+	assert.NotNil(t, err)
+
+	sizes := CheckOptions{PageSizeByte: 4096, MaxHeapFileSizeByte: 4096 * 4}
+	report, err := Check(*logging.CreateDebugLogger(), dir, sizes)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.FilesChecked)
+	assert.Len(t, report.Issues, 1)
+	assert.Equal(t, manifestFileName, report.Issues[0].File)
+	assert.True(t, report.Issues[0].Repairable)
+	assert.False(t, report.OK())
+
+	sizes.Repair = true
+	report, err = Check(*logging.CreateDebugLogger(), dir, sizes)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	report, err = Check(*logging.CreateDebugLogger(), dir, CheckOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Equal(t, uint32(4096), report.Manifest.PageSizeByte)
+}
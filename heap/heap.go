@@ -1,14 +1,16 @@
 package heap
 
 import (
-	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
 	"boro-db/utils/freelist"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,12 +21,17 @@ import (
 )
 
 var ErrNotEnoughSpace = fmt.Errorf("not enough space")
+var ErrClosed = fmt.Errorf("closed")
+var ErrPageNotFound = fmt.Errorf("page not found")
 
 /*
 Heap file
 ┌──────────────────────────────────────────────────────────────┐
-| crc (4byte) | pageCount (4byte) |                            |
+| crc (4byte , v0 v1) | pageCount (4byte) |                    |
 | start-address (8byte)                                        |
+| version (4byte) | free list page count (4byte)               |
+| checksum algorithm (1byte) | padding (7byte)                 |
+| checksum (8byte , v2)                                        |
 |──────────────────────4kb metadata────────────────────────────|
 | (((HeapSize) / PagSize) / 8) / PageSize = freePage           |
 | used for tracking free pages                                 |
@@ -40,27 +47,58 @@ const heapfileNameSepparate = "-"
 type heapfilemeta struct {
 	addressSpaceStart uint64
 	fd                int
+	directory         string // one of the heap directories , see placement.go
 	// serializable fields
 	pageCount uint32
+	version   uint32
 	buffer    []byte
 	freelist  []freelist.FreeList
+	freePages uint64 // sum over the free lists , see freespace.go
 	options   *HeapFileOptions
+	encrypted bool
+	keyID     uint32
+	cipher    *encryption.PageCipher
 }
 
+// serializes in the layout of hpm.version , see format.go
 func (hpm *heapfilemeta) SerializeMetaData() {
 	binary.BigEndian.PutUint32(hpm.buffer[4:8], hpm.pageCount)
 	binary.BigEndian.PutUint64(hpm.buffer[8:16], hpm.addressSpaceStart)
-	checksums.CalculateCRC(hpm.buffer[0:4], hpm.buffer[4:hpm.options.PageSizeByte])
+	if hpm.version >= heapFileFormatV1 {
+		binary.BigEndian.PutUint32(hpm.buffer[headerVersionOffset:headerVersionOffset+4], hpm.version)
+		binary.BigEndian.PutUint32(hpm.buffer[headerFreeListPagesOffset:headerFreeListPagesOffset+4], freeListPageCount(hpm.options))
+	}
+	if hpm.version >= heapFileFormatV3 {
+		serializeEncryptionFields(hpm)
+	}
+	calculateHeaderChecksum(hpm)
 }
 
 func (hpm *heapfilemeta) DeserializeMetadat() error {
 	hpm.pageCount = binary.BigEndian.Uint32(hpm.buffer[4:8])
 	hpm.addressSpaceStart = binary.BigEndian.Uint64(hpm.buffer[8:16])
-	crcBuffer := make([]byte, 4)
-	checksums.CalculateCRC(crcBuffer, hpm.buffer[4:hpm.options.PageSizeByte])
+	hpm.version = readHeaderVersion(hpm.buffer)
+	if hpm.version >= heapFileFormatV3 {
+		deserializeEncryptionFields(hpm)
+	}
+
+	if !verifyHeaderChecksum(hpm) {
+		return fmt.Errorf("%w : CRC mismatch", ErrHeaderCorrupted)
+	}
+
+	if !isSupportedFormat(hpm.version) {
+		return fmt.Errorf("%w : heap file %d has version %d , supported versions are %d to %d", ErrUnsupportedFormat, hpm.addressSpaceStart, hpm.version, CurrentHeapFileFormat+1-supportedFormatVersions, CurrentHeapFileFormat)
+	}
+
+	if hpm.version >= heapFileFormatV1 {
+		freeListPages := binary.BigEndian.Uint32(hpm.buffer[headerFreeListPagesOffset : headerFreeListPagesOffset+4])
+		if freeListPages != freeListPageCount(hpm.options) {
+			return fmt.Errorf("%w : heap file %d has %d free list pages , options expect %d", ErrUnsupportedFormat, hpm.addressSpaceStart, freeListPages, freeListPageCount(hpm.options))
+		}
+	}
 
-	if !checksums.CompareCRC(crcBuffer, hpm.buffer[0:4]) {
-		return fmt.Errorf("CRC mismatch")
+	if algorithm := headerChecksumAlgorithm(hpm); algorithm != hpm.options.ChecksumAlgorithm {
+		return fmt.Errorf("%w : heap file %d uses checksum %s , options expect %s", ErrUnsupportedFormat, hpm.addressSpaceStart, algorithm, hpm.options.ChecksumAlgorithm)
 	}
 	return nil
 }
@@ -102,12 +140,25 @@ type fileSystemHeap struct {
 	maxTotalPagesInHeapFile    uint32
 	heapMetaSize               uint32
 	heapFileLock               *sync.RWMutex
+	closed                     bool
+	locks                      []*directoryLock
+	manifest                   *Manifest
+	// filesystem block size , compressed pages punch holes in these units
+	blockSize int
+	// free pages across every heap file , see freespace.go
+	freePages uint64
+	// makes free list changes crash consistent , see journal.go
+	journal *allocationJournal
 }
 
 func (fsh *fileSystemHeap) IsPageFree(pageNumber uint64) bool {
 	fsh.heapFileLock.RLock()
 	defer fsh.heapFileLock.RUnlock()
+	return !fsh.closed && fsh.isPageFree(pageNumber)
+}
 
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) isPageFree(pageNumber uint64) bool {
 	if pageNumber < fsh.firstAddressInAddressSpace || pageNumber > fsh.lastAddressInAddressSpace {
 		return false
 	}
@@ -125,18 +176,22 @@ func (fsh *fileSystemHeap) IsPageFree(pageNumber uint64) bool {
 }
 
 func (fsh *fileSystemHeap) FreePagesAvailable() uint64 {
-	size := 0
-	for _, hpf := range fsh.fileIdentifiers {
-		for _, fl := range hpf.freelist {
-			size += int(fl.TotalFreeLocs())
-		}
-	}
-	return uint64(size)
+	fsh.heapFileLock.RLock()
+	defer fsh.heapFileLock.RUnlock()
+	return fsh.freePages
 }
 
 func (fsh *fileSystemHeap) Free(pageNumbers []uint64) error {
 	fsh.heapFileLock.Lock()
 	defer fsh.heapFileLock.Unlock()
+	if fsh.closed {
+		return ErrClosed
+	}
+	return fsh.free(pageNumbers)
+}
+
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) free(pageNumbers []uint64) error {
 	fsh.logger.Debug().Msgf("Free %d pages heap : %s", len(pageNumbers), fsh.option.FileDirectory)
 	freeListSizeBytes := getFreeListSizeBytes(fsh.option)
 	freeListToSync := make(map[*heapfilemeta][][]uint64)
@@ -164,66 +219,110 @@ func (fsh *fileSystemHeap) Free(pageNumbers []uint64) error {
 		freeListToSync[heapFileMeta][freeListIdx] = append(freeListToSync[heapFileMeta][freeListIdx], freeListSlot)
 	}
 
+	refs := make([]freeListRef, 0)
+	releasedPerRef := make([][]uint64, 0)
+	// takes back exactly the pages released below , a free list that failed half way only had some of them freed
+	reallocate := func() error {
+		var err error
+		for i, ref := range refs {
+			freeList := ref.hpf.freelist[ref.idx]
+			for _, page := range releasedPerRef[i] {
+				if !freeList.IsLocFree(page) {
+					continue
+				}
+				if _, allocErr := freeList.AllocateRun(page, 1); allocErr != nil {
+					err = errors.Join(err, allocErr)
+				}
+			}
+		}
+		return err
+	}
+
 	for heapFileMeta, freeListIdxs := range freeListToSync {
 		for idx, pages := range freeListIdxs {
 			if len(pages) != 0 {
 
-				heapFileMeta.freelist[idx].ReleaseLoc(pages)
-
-				freePageDataSpace := heapFileMeta.buffer[fsh.option.PageSizeByte:freeListSizeBytes]
-
-				currentFreePageBuffer := freePageDataSpace[idx*int(fsh.option.PageSizeByte) : (idx+1)*int(fsh.option.PageSizeByte)]
-
-				_, err := syscall.Pwrite(heapFileMeta.fd, currentFreePageBuffer, int64((idx+1)*int(fsh.option.PageSizeByte)))
-
-				if err != nil {
-					heapFileMeta.freelist[idx].GetLocs(uint64(len(pages))) // grab the same pages in exact same order
-					fsh.logger.Error().Msgf("Error writing to heap file : %s", err.Error())
-					return err
+				freeList := heapFileMeta.freelist[idx]
+				released := make([]uint64, 0, len(pages))
+				seen := make(map[uint64]bool, len(pages))
+				for _, page := range pages {
+					if !seen[page] && !freeList.IsLocFree(page) {
+						released = append(released, page)
+					}
+					seen[page] = true
+				}
+				if len(released) == 0 {
+					continue
+				}
+				refs = append(refs, freeListRef{hpf: heapFileMeta, idx: idx})
+				releasedPerRef = append(releasedPerRef, released)
+				if err := freeList.ReleaseLoc(released); err != nil {
+					// nothing reached the disk yet
+					fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to release pages of heap file %d", heapFileMeta.addressSpaceStart))
+					return errors.Join(err, reallocate())
 				}
 			}
 		}
 	}
 
+	if err := fsh.persistFreeLists(refs); err != nil {
+		return fsh.rollbackFreeLists(refs, reallocate, err)
+	}
+
+	for i, ref := range refs {
+		fsh.adjustFreePages(ref.hpf, int64(len(releasedPerRef[i])))
+	}
+	fsh.punchFreedPages(refs, releasedPerRef)
+
 	return nil
 }
 
 func (fsh *fileSystemHeap) Malloc(pageCount uint64) ([]uint64, error) {
 	fsh.heapFileLock.Lock()
 	defer fsh.heapFileLock.Unlock()
-
-	availablePages := uint64(0)
-
-	for _, hpf := range fsh.fileIdentifiers {
-		for _, freeList := range hpf.freelist {
-			availablePages += freeList.TotalFreeLocs()
-			if availablePages >= pageCount {
-				break
-			}
-		}
+	if fsh.closed {
+		return nil, ErrClosed
 	}
+	return fsh.malloc(pageCount)
+}
 
-	if availablePages < pageCount {
+// lowest free pages first , caller must hold the heapFileLock
+func (fsh *fileSystemHeap) malloc(pageCount uint64) ([]uint64, error) {
+	if fsh.freePages < pageCount {
 		return nil, ErrNotEnoughSpace
 	}
 
 	pagesCollected := uint64(0)
 	finalPages := make([]uint64, pageCount)
+	refs := make([]freeListRef, 0)
+	locs := make([][]uint64, 0)
 
 	j := 0
 
+	rollback := func() error {
+		var err error
+		for i, ref := range refs {
+			err = errors.Join(err, ref.hpf.freelist[ref.idx].ReleaseLoc(locs[i]))
+		}
+		return err
+	}
+
 	for _, hpf := range fsh.fileIdentifiers {
+		if hpf.freePages == 0 {
+			continue
+		}
 		for idx, freeList := range hpf.freelist {
+			if freeList.TotalFreeLocs() == 0 {
+				continue
+			}
 			pagesToGet := pageCount - pagesCollected
-			pages, _ := freeList.GetLocs(pagesToGet)
-
-			_, err := syscall.Pwrite(hpf.fd, freeList.CurrentBuffer(), int64((idx+1)*int(fsh.option.PageSizeByte)))
-
+			pages, err := freeList.GetLocs(pagesToGet)
 			if err != nil {
-				fsh.logger.Error().Err(err).Msg("Error while writing FreeSpaceInfo to heap file")
-				freeList.ReleaseLoc(pages)
-				return nil, err
+				// nothing reached the disk yet
+				return nil, errors.Join(err, rollback())
 			}
+			refs = append(refs, freeListRef{hpf: hpf, idx: idx})
+			locs = append(locs, slices.Clone(pages))
 
 			for i := 0; i < len(pages); i++ {
 				pages[i] = hpf.addressSpaceStart + uint64(idx)*uint64(fsh.option.PageSizeByte*8) + pages[i]
@@ -235,12 +334,92 @@ func (fsh *fileSystemHeap) Malloc(pageCount uint64) ([]uint64, error) {
 				break
 			}
 		}
+		if pagesCollected >= pageCount {
+			break
+		}
+	}
+
+	if err := fsh.reserveAllocatedPages(refs, locs); err != nil {
+		// nothing reached the disk yet
+		return nil, errors.Join(err, rollback())
+	}
+	// every touched free list page becomes durable together
+	if err := fsh.persistFreeLists(refs); err != nil {
+		return nil, fsh.rollbackFreeLists(refs, rollback, err)
+	}
+	for i, ref := range refs {
+		fsh.adjustFreePages(ref.hpf, -int64(len(locs[i])))
 	}
 	fsh.logger.Debug().Msgf("Malloc %d pages heap : %s", pageCount, fsh.option.FileDirectory)
 
 	return finalPages, nil
 }
 
+/*
+Allocates count pages that are contiguous on disk (best fit)
+- runs never cross a heap file or a free list page (PageSize * 8 pages)
+- the smallest free run that fits wins , ties go to the lowest address
+- ErrNotEnoughSpace when no run is large enough , the caller can ExtendBy and retry
+*/
+func (fsh *fileSystemHeap) MallocContiguous(pageCount uint64) ([]uint64, error) {
+	fsh.heapFileLock.Lock()
+	defer fsh.heapFileLock.Unlock()
+	if fsh.closed {
+		return nil, ErrClosed
+	}
+	if pageCount == 0 {
+		return nil, fmt.Errorf("can not allocate an empty run")
+	}
+
+	var bestFile *heapfilemeta
+	bestIdx := 0
+	bestStart, bestLength := uint64(0), uint64(0)
+
+	for _, hpf := range fsh.fileIdentifiers {
+		if hpf.freePages < pageCount {
+			continue
+		}
+		for idx, freeList := range hpf.freelist {
+			if freeList.TotalFreeLocs() < pageCount {
+				continue
+			}
+			start, length, ok := freeList.FindRun(pageCount)
+			if ok && (bestFile == nil || length < bestLength) {
+				bestFile, bestIdx, bestStart, bestLength = hpf, idx, start, length
+			}
+		}
+	}
+
+	if bestFile == nil {
+		return nil, ErrNotEnoughSpace
+	}
+
+	freeList := bestFile.freelist[bestIdx]
+	pages, err := freeList.AllocateRun(bestStart, pageCount)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []freeListRef{{hpf: bestFile, idx: bestIdx}}
+	if err := fsh.reserveAllocatedPages(refs, [][]uint64{pages}); err != nil {
+		// nothing reached the disk yet
+		return nil, errors.Join(err, freeList.ReleaseLoc(pages))
+	}
+	if err := fsh.persistFreeLists(refs); err != nil {
+		return nil, fsh.rollbackFreeLists(refs, func() error {
+			return freeList.ReleaseLoc(pages)
+		}, err)
+	}
+	fsh.adjustFreePages(bestFile, -int64(len(pages)))
+
+	for i := range pages {
+		pages[i] = bestFile.addressSpaceStart + uint64(bestIdx)*uint64(fsh.option.PageSizeByte*8) + pages[i]
+	}
+	fsh.logger.Debug().Msgf("MallocContiguous %d pages at %d heap : %s", pageCount, pages[0], fsh.option.FileDirectory)
+
+	return pages, nil
+}
+
 func (fsh *fileSystemHeap) TrimHead(count uint64) error {
 
 	// no better way for this yet
@@ -248,7 +427,18 @@ func (fsh *fileSystemHeap) TrimHead(count uint64) error {
 	// ensure lock at heap file level not at a global level maybe
 	fsh.heapFileLock.Lock()
 	defer fsh.heapFileLock.Unlock()
+	// files come and go , the summary is rebuilt before the lock is released
+	defer fsh.recountFreePages()
+	// journal images must not outlive the layout they were taken from
+	defer fsh.resetJournal()
+	if fsh.closed {
+		return ErrClosed
+	}
+	return fsh.trimHead(count)
+}
 
+// caller must hold the heapFileLock , recount the free pages and reset the journal
+func (fsh *fileSystemHeap) trimHead(count uint64) error {
 	if fsh.lastAddressInAddressSpace-fsh.firstAddressInAddressSpace+1 < count {
 		return fmt.Errorf("cannot trim heap file to less than %d pages", count)
 	}
@@ -273,7 +463,12 @@ func (fsh *fileSystemHeap) TrimHead(count uint64) error {
 
 		if newLastPageNumber < currentHeapFileStartPageNumber {
 			// Delete everything in current file
-			err := syscall.Unlink(filepath.Join(fsh.option.FileDirectory, heapFileName(currentHeapFileStartPageNumber)))
+			// the fd pins the blocks , close it first so the space goes back to the OS
+			if err := syscall.Close(fsh.fileIdentifiers[i].fd); err != nil {
+				fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to close heap file %d", i))
+				return err
+			}
+			err := syscall.Unlink(fsh.fileIdentifiers[i].path())
 			if err != nil {
 				fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to delete heap file %d", i))
 				return err
@@ -326,6 +521,13 @@ func (fsh *fileSystemHeap) TrimTailHeapFiles(count uint64) error {
 	// ensure lock at heap file level not at a global level maybe
 	fsh.heapFileLock.Lock()
 	defer fsh.heapFileLock.Unlock()
+	// files come and go , the summary is rebuilt before the lock is released
+	defer fsh.recountFreePages()
+	// journal images must not outlive the layout they were taken from
+	defer fsh.resetJournal()
+	if fsh.closed {
+		return ErrClosed
+	}
 
 	if fsh.lastAddressInAddressSpace-fsh.firstAddressInAddressSpace+1 < count {
 		return fmt.Errorf("cannot trim heap file to less than %d pages", count)
@@ -349,7 +551,7 @@ func (fsh *fileSystemHeap) TrimTailHeapFiles(count uint64) error {
 
 		if newFirstPageNumber > currentHeapFileLastPageNumber {
 			// Delete everything in current file
-			err := syscall.Unlink(filepath.Join(fsh.option.FileDirectory, heapFileName(currentHeapFileLastPageNumber)))
+			err := syscall.Unlink(fsh.fileIdentifiers[i].path())
 			if err != nil {
 				fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to delete heap file %d", i))
 				return err
@@ -370,6 +572,19 @@ func (fsh *fileSystemHeap) ExtendBy(pageCount int) error {
 
 	fsh.heapFileLock.Lock()
 	defer fsh.heapFileLock.Unlock()
+	// files come and go , the summary is rebuilt before the lock is released
+	defer fsh.recountFreePages()
+	// journal images must not outlive the layout they were taken from
+	defer fsh.resetJournal()
+	if fsh.closed {
+		return ErrClosed
+	}
+
+	if quota := fsh.option.QuotaBytes; quota != 0 {
+		if projected := fsh.fileBytesAfterExtend(uint64(pageCount)); projected > quota {
+			return fmt.Errorf("%w : extending by %d pages needs %d bytes , quota is %d bytes", ErrQuotaExceeded, pageCount, projected, quota)
+		}
+	}
 
 	pagesRemainingToAllocate := uint64(pageCount)
 
@@ -388,7 +603,8 @@ func (fsh *fileSystemHeap) ExtendBy(pageCount int) error {
 
 			extraPages = uint32(math.Min(float64(extraPages), float64(pagesRemainingToAllocate)))
 
-			hpf, err := createNewEmptyHeapFile(lastHeapFile.addressSpaceStart+uint64(lastHeapFile.pageCount), fsh.option, fsh.logger)
+			start := lastHeapFile.addressSpaceStart + uint64(lastHeapFile.pageCount)
+			hpf, err := createNewEmptyHeapFile(start, fsh.placeHeapFile(start), fsh.option, fsh.logger)
 
 			if err != nil {
 				fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to create new heap file %d", len(fsh.fileIdentifiers)))
@@ -402,6 +618,9 @@ func (fsh *fileSystemHeap) ExtendBy(pageCount int) error {
 				return err
 			}
 
+			// the free list was built for an empty file
+			createFreeSizePages(hpf, fsh.heapMetaSize, fsh.option)
+
 			fsh.fileIdentifiers = append(fsh.fileIdentifiers, hpf)
 
 			lastHeapFile = hpf
@@ -466,42 +685,130 @@ func (fsh *fileSystemHeap) allocatePagesInHeapFile(hpf *heapfilemeta, heapFileSi
 	return nil
 }
 
+// resolves the heap file holding the page and the page offset with in that file
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) locatePage(pageNumber uint64) (*heapfilemeta, uint64, error) {
+	heapFileOffset := pageNumber % uint64(fsh.maxTotalPagesInHeapFile)
+
+	hpf, ok := fsh.startAddressMap[pageNumber-heapFileOffset]
+
+	if !ok || heapFileOffset >= uint64(hpf.pageCount) {
+		return nil, 0, ErrPageNotFound
+	}
+	return hpf, heapFileOffset, nil
+}
+
+// onRead runs once the heapFileLock is released , it may take locks of its own
 func (fsh *fileSystemHeap) Read(pageNumber uint64, buffer []byte, onRead func(error)) {
+	onRead(fsh.read(pageNumber, buffer))
+}
 
-	heapFile := pageNumber / uint64(fsh.maxTotalPagesInHeapFile)
-	heapFileOffset := pageNumber % uint64(fsh.maxTotalPagesInHeapFile)
+func (fsh *fileSystemHeap) read(pageNumber uint64, buffer []byte) error {
+	fsh.heapFileLock.RLock()
+	defer fsh.heapFileLock.RUnlock()
+	if fsh.closed {
+		return ErrClosed
+	}
 
-	hpf, ok := fsh.startAddressMap[fsh.fileIdentifiers[heapFile].addressSpaceStart]
+	hpf, heapFileOffset, err := fsh.locatePage(pageNumber)
 
-	if !ok {
-		onRead(errors.New("page not found"))
+	if err != nil {
+		return err
 	}
 
-	_, err := syscall.Pread(hpf.fd, buffer, int64(fsh.heapMetaSize)+int64(heapFileOffset*uint64(fsh.option.PageSizeByte)))
+	_, err = syscall.Pread(hpf.fd, buffer, int64(fsh.heapMetaSize)+int64(heapFileOffset*uint64(fsh.option.PageSizeByte)))
+
+	if err == nil {
+		err = decryptSlot(hpf, pageNumber, buffer)
+	}
+	if err == nil {
+		err = decodePage(buffer)
+	}
 
-	onRead(err)
+	return err
 }
 
+// onWrite runs once the heapFileLock is released , it may take locks of its own
 func (fsh *fileSystemHeap) Write(pageNumber uint64, buffer []byte, onWrite func(error)) {
+	onWrite(fsh.write(pageNumber, buffer))
+}
 
-	heapFile := pageNumber / uint64(fsh.maxTotalPagesInHeapFile)
-	heapFileOffset := pageNumber % uint64(fsh.maxTotalPagesInHeapFile)
+func (fsh *fileSystemHeap) write(pageNumber uint64, buffer []byte) error {
+	fsh.heapFileLock.RLock()
+	defer fsh.heapFileLock.RUnlock()
+	if fsh.closed {
+		return ErrClosed
+	}
 
-	hpf, ok := fsh.startAddressMap[fsh.fileIdentifiers[heapFile].addressSpaceStart]
+	hpf, heapFileOffset, err := fsh.locatePage(pageNumber)
 
-	if !ok {
-		onWrite(errors.New("page not found"))
+	if err != nil {
+		return err
 	}
 
-	_, err := syscall.Pwrite(hpf.fd, buffer, int64(fsh.heapMetaSize)+int64(heapFileOffset*uint64(fsh.option.PageSizeByte)))
+	encoded, err := encodePage(fsh.option, buffer, fsh.blockSize)
+
+	if err != nil {
+		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to compress page %d", pageNumber))
+		return err
+	}
+
+	slot := buffer
+	if encoded != nil {
+		slot = encoded
+	}
+	slot, err = encryptSlot(hpf, pageNumber, slot)
+
+	if err != nil {
+		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to encrypt page %d", pageNumber))
+		return err
+	}
+
+	slotOffset := int64(fsh.heapMetaSize) + int64(heapFileOffset*uint64(fsh.option.PageSizeByte))
+	_, err = syscall.Pwrite(hpf.fd, slot, slotOffset)
+
+	if err != nil {
+		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to write page %d", pageNumber))
+		return err
+	}
+
+	if encoded != nil {
+		// best effort , the header bounds the compressed data so stale bytes past it are harmless
+		if err := punchHole(hpf.fd, slotOffset, len(slot), int(fsh.option.PageSizeByte), fsh.blockSize); err != nil {
+			fsh.logger.Warn().Err(err).Msg(fmt.Sprintf("Failed to punch hole for page %d", pageNumber))
+		}
+	}
 
 	if err := syscall.Fsync(hpf.fd); err != nil {
-		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to fsync heap file %d", heapFile))
-		onWrite(err)
-		return
+		fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to fsync heap file %d", hpf.addressSpaceStart))
+		return err
 	}
 
-	onWrite(err)
+	return nil
+}
+
+// blocking variant of Read , returns early if the context is done before the read starts
+func (fsh *fileSystemHeap) ReadContext(ctx context.Context, pageNumber uint64, buffer []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var readErr error
+	fsh.Read(pageNumber, buffer, func(err error) {
+		readErr = err
+	})
+	return readErr
+}
+
+// blocking variant of Write , returns early if the context is done before the write starts
+func (fsh *fileSystemHeap) WriteContext(ctx context.Context, pageNumber uint64, buffer []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var writeErr error
+	fsh.Write(pageNumber, buffer, func(err error) {
+		writeErr = err
+	})
+	return writeErr
 }
 
 func (fsh *fileSystemHeap) ValidAddressRange() [2]uint64 {
@@ -510,6 +817,49 @@ func (fsh *fileSystemHeap) ValidAddressRange() [2]uint64 {
 	return [2]uint64{fsh.firstAddressInAddressSpace, fsh.lastAddressInAddressSpace}
 }
 
+/*
+Close fsyncs and closes all the heap file descriptors.
+The heap is unusable afterwards, every call returns ErrClosed
+*/
+func (fsh *fileSystemHeap) Close(ctx context.Context) error {
+	fsh.heapFileLock.Lock()
+	defer fsh.heapFileLock.Unlock()
+
+	if fsh.closed {
+		return ErrClosed
+	}
+	fsh.closed = true
+
+	var closeErr error
+	for _, hpf := range fsh.fileIdentifiers {
+		if err := ctx.Err(); err != nil && closeErr == nil {
+			// still close the remaining fds, we are not coming back for them
+			closeErr = err
+		}
+		if err := syscall.Fsync(hpf.fd); err != nil {
+			fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to fsync heap file %d", hpf.addressSpaceStart))
+			closeErr = errors.Join(closeErr, err)
+		}
+		if err := syscall.Close(hpf.fd); err != nil {
+			fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to close heap file %d", hpf.addressSpaceStart))
+			closeErr = errors.Join(closeErr, err)
+		}
+	}
+
+	if err := fsh.journal.close(); err != nil {
+		fsh.logger.Error().Err(err).Msg("Failed to close the allocation journal")
+		closeErr = errors.Join(closeErr, err)
+	}
+
+	if err := releaseDirectoryLocks(fsh.locks); err != nil {
+		fsh.logger.Error().Err(err).Msg("Failed to release heap directory locks")
+		closeErr = errors.Join(closeErr, err)
+	}
+	fsh.logger.Debug().Msgf("Closed heap : %s", fsh.option.FileDirectory)
+
+	return closeErr
+}
+
 /*
 Creates heapfile in sequence , starts with a heap file of size page size
 if list of heap file is empty. If not loads the heapfile file pointer
@@ -517,67 +867,113 @@ and stores them.
 */
 func NewHeap(logger log.Logger, option *HeapFileOptions) (HeapFile, error) {
 
-	// create heap meta file to lock the heap file status like
-	// pageFileSize
-	// heapFileMaxSize
-	// - these values can never change
-	// - any artifact trying to read this in any other manner will tamper the heap file
+	if err := createHeapDirectories(logger, option); err != nil {
+		return nil, err
+	}
 
-	heapFileMetaSize := getHeapFileMetaSize(option)
+	if !isValidCompression(option.Compression) {
+		return nil, fmt.Errorf("unknown compression %s", option.Compression)
+	}
 
-	_, err := os.Stat(option.FileDirectory)
+	// nothing in the directories is touched before we own them
+	locks, err := acquireDirectoryLocks(heapDirectories(option))
 
 	if err != nil {
-		logger.Error().Err(err).Msg("Creating heap file directory")
-		err = os.Mkdir(option.FileDirectory, os.ModePerm)
-		if err != nil {
-			logger.Error().Err(err).Msg("Failed to create heap file directory")
-			return nil, err
-		}
+		logger.Error().Err(err).Msg("Failed to lock heap file directory")
+		return nil, err
 	}
 
-	fileEntries, err := os.ReadDir(option.FileDirectory)
+	heap, err := openHeap(logger, option, locks)
 
 	if err != nil {
-		logger.Error().Err(err).Msg("Failed to read heap file list")
+		releaseDirectoryLocks(locks)
 		return nil, err
 	}
 
-	fileIdentifiers := make([]*heapfilemeta, 0, len(fileEntries))
+	return heap, nil
+}
+
+func openHeap(logger log.Logger, option *HeapFileOptions, locks []*directoryLock) (*fileSystemHeap, error) {
+
+	// the manifest pins pageFileSize / heapFileMaxSize
+	// - these values can never change
+	// - any artifact trying to read this in any other manner will tamper the heap file
+	manifest, err := loadOrCreateManifest(logger, option)
+
+	if err != nil {
+		logger.Error().Err(err).Msg("Heap manifest check failed")
+		return nil, err
+	}
+
+	// free list pages of an allocation interrupted by a crash are completed first
+	if err := replayAllocationJournal(logger, option); err != nil {
+		logger.Error().Err(err).Msg("Failed to replay the allocation journal")
+		return nil, err
+	}
+
+	heapFileMetaSize := getHeapFileMetaSize(option)
+
+	fileIdentifiers := make([]*heapfilemeta, 0)
 	fileIdentifiersMap := make(map[string]*heapfilemeta)
 
-	for _, fileEntry := range fileEntries {
-		if fileEntry.IsDir() {
-			continue
+	// every heap file opened so far is closed again unless the heap opens
+	fds := make([]int, 0)
+	opened := false
+	defer func() {
+		if opened {
+			return
 		}
-		if strings.Contains(fileEntry.Name(), "heap") {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}()
 
-			// get all of the heap files
-			fileLocation := filepath.Join(option.FileDirectory, fileEntry.Name())
-			logger.Info().Str("file", fileLocation).Msg(fmt.Sprintf("Found heap file %s", fileEntry.Name()))
+	for _, directory := range heapDirectories(option) {
+		fileEntries, err := os.ReadDir(directory)
 
-			fd, err := syscall.Open(fileLocation, syscall.O_RDWR|syscall.O_DSYNC, permissionBits)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to read heap file list")
+			return nil, err
+		}
 
-			if err != nil {
-				logger.Error().Err(err).Msg(fmt.Sprintf("Failed to open heap file %s", fileEntry.Name()))
-				return nil, err
+		for _, fileEntry := range fileEntries {
+			if fileEntry.IsDir() {
+				continue
 			}
+			if strings.Contains(fileEntry.Name(), "heap") {
 
-			addressSpaceStart, err := strconv.ParseInt(strings.Split(fileEntry.Name(), heapfileNameSepparate)[1], 10, 64)
+				// get all of the heap files
+				fileLocation := filepath.Join(directory, fileEntry.Name())
+				if existing, ok := fileIdentifiersMap[fileEntry.Name()]; ok {
+					return nil, fmt.Errorf("heap file %s is in both %s and %s", fileEntry.Name(), existing.directory, directory)
+				}
+				logger.Info().Str("file", fileLocation).Msg(fmt.Sprintf("Found heap file %s", fileEntry.Name()))
 
-			if err != nil {
-				logger.Error().Err(err).Msg(fmt.Sprintf("Failed to parse heap file number %s", fileEntry.Name()))
-				return nil, err
-			}
+				fd, err := syscall.Open(fileLocation, syscall.O_RDWR|syscall.O_DSYNC, permissionBits)
 
-			// stash the fd and heap file number
-			hpf := &heapfilemeta{
-				fd:                fd,
-				addressSpaceStart: uint64(addressSpaceStart),
-				options:           option,
-			}
+				if err != nil {
+					logger.Error().Err(err).Msg(fmt.Sprintf("Failed to open heap file %s", fileEntry.Name()))
+					return nil, err
+				}
+				fds = append(fds, fd)
+
+				addressSpaceStart, err := strconv.ParseInt(strings.Split(fileEntry.Name(), heapfileNameSepparate)[1], 10, 64)
+
+				if err != nil {
+					logger.Error().Err(err).Msg(fmt.Sprintf("Failed to parse heap file number %s", fileEntry.Name()))
+					return nil, err
+				}
 
-			fileIdentifiersMap[fileEntry.Name()] = hpf
+				// stash the fd and heap file number
+				hpf := &heapfilemeta{
+					fd:                fd,
+					addressSpaceStart: uint64(addressSpaceStart),
+					directory:         directory,
+					options:           option,
+				}
+
+				fileIdentifiersMap[fileEntry.Name()] = hpf
+			}
 		}
 	}
 
@@ -590,20 +986,29 @@ func NewHeap(logger log.Logger, option *HeapFileOptions) (HeapFile, error) {
 			return nil, err
 		}
 		hpf.buffer = buffer
-		stat, err := os.Stat(filepath.Join(option.FileDirectory, heapFileName(hpf.addressSpaceStart)))
+		stat, statErr := os.Stat(hpf.path())
 		// corrects the file meta based on the file size
 		// further correction logic can involve reading all the pages and checking how many of them are legit
 		// pages and then truncating them off
-		// TODO:
-		// potential issue of partial page writes is not handled. So if the heap has bunch of corrupted pages
-		// its upto page manager to handle it. or the system can be set in RAID 1
-		if hpf.DeserializeMetadat() != nil {
+		// partial page writes are not handled here. torn pages are the page manager's problem
+		// (paging EnableDoubleWrite restores them) or the system can be set in RAID 1
+		if err := hpf.DeserializeMetadat(); err != nil {
 
-			if err != nil {
-				logger.Error().Err(err).Msg("Failed to get stat of heap file")
+			if !errors.Is(err, ErrHeaderCorrupted) {
+				logger.Error().Err(err).Msg(fmt.Sprintf("Can not read heap file %d", hpf.addressSpaceStart))
 				return nil, err
 			}
 
+			if statErr != nil {
+				logger.Error().Err(statErr).Msg("Failed to get stat of heap file")
+				return nil, statErr
+			}
+
+			if !isSupportedFormat(hpf.version) {
+				// version field itself may be garbage , v1 layout is compatible with v0 bytes
+				hpf.version = CurrentHeapFileFormat
+			}
+
 			// correction phase
 			// confirm if size is a multiple of page size + heapMetaSize
 
@@ -634,6 +1039,18 @@ func NewHeap(logger log.Logger, option *HeapFileOptions) (HeapFile, error) {
 			return nil, err
 		}
 
+		if option.UpgradeFormatOnOpen {
+			if err := upgradeHeapFile(hpf, logger); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := loadFileCipher(hpf); err != nil {
+			logger.Error().Err(err).Msg(fmt.Sprintf("Can not decrypt heap file %d", hpf.addressSpaceStart))
+			return nil, err
+		}
+		warnPlainTextFile(logger, hpf)
+
 		// meta space ignoring
 		createFreeSizePages(hpf, heapFileMetaSize, option)
 		fileIdentifiers = append(fileIdentifiers, hpf)
@@ -643,11 +1060,17 @@ func NewHeap(logger log.Logger, option *HeapFileOptions) (HeapFile, error) {
 		return fileIdentifiers[i].addressSpaceStart < fileIdentifiers[j].addressSpaceStart
 	})
 
+	if err := checkHeapFilesContiguous(fileIdentifiers, totalPagesInHeapFile(option)); err != nil {
+		logger.Error().Err(err).Msg("Heap address space has a hole")
+		return nil, err
+	}
+
 	if len(fileIdentifiers) == 0 {
-		hpm, err := createNewEmptyHeapFile(0, option, logger)
+		hpm, err := createNewEmptyHeapFile(0, option.FileDirectory, option, logger)
 		if err != nil {
 			return nil, err
 		}
+		fds = append(fds, hpm.fd)
 
 		// TODO : correct file size based on meta
 		fileIdentifiers = append(fileIdentifiers, hpm)
@@ -659,7 +1082,15 @@ func NewHeap(logger log.Logger, option *HeapFileOptions) (HeapFile, error) {
 		startAddressMap[hpf.addressSpaceStart] = hpf
 	}
 
-	return &fileSystemHeap{
+	journal, err := openAllocationJournal(option.FileDirectory, option.PageSizeByte)
+
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open the allocation journal")
+		return nil, err
+	}
+
+	fsh := &fileSystemHeap{
+		journal:                    journal,
 		logger:                     logger,
 		fileIdentifiers:            fileIdentifiers,
 		firstAddressInAddressSpace: fileIdentifiers[0].addressSpaceStart,
@@ -669,27 +1100,48 @@ func NewHeap(logger log.Logger, option *HeapFileOptions) (HeapFile, error) {
 		heapFileLock:               &sync.RWMutex{},
 		startAddressMap:            startAddressMap,
 		option:                     option,
-	}, nil
+		locks:                      locks,
+		manifest:                   manifest,
+		blockSize:                  filesystemBlockSize(heapDirectories(option)),
+	}
+	fsh.recountFreePages()
+
+	opened = true
+	return fsh, nil
 }
 
 func createFreeSizePages(hpf *heapfilemeta, heapFileMetaSize uint32, option *HeapFileOptions) {
 	hpf.freelist = make([]freelist.FreeList, 0, heapFileMetaSize/option.PageSizeByte)
 	numFreeListPages := int((heapFileMetaSize - option.PageSizeByte) / option.PageSizeByte)
+	locsPerFreeListPage := uint64(option.PageSizeByte) * 8
 	for i := 0; i < numFreeListPages; i++ {
 		buffer := hpf.buffer[option.PageSizeByte:]
-		hpf.freelist = append(hpf.freelist, freelist.NewBitmapFreeList(buffer[i*int(option.PageSizeByte):(i+1)*int(option.PageSizeByte)], 0, uint64(hpf.pageCount)))
+		// each free list page covers the next PageSize * 8 pages of the file
+		first := uint64(i) * locsPerFreeListPage
+		end := uint64(0)
+		if uint64(hpf.pageCount) > first {
+			end = min(uint64(hpf.pageCount)-first, locsPerFreeListPage)
+		}
+		hpf.freelist = append(hpf.freelist, freelist.NewBitmapFreeList(buffer[i*int(option.PageSizeByte):(i+1)*int(option.PageSizeByte)], 0, end))
 	}
+	hpf.recountFreePages()
 }
 
-func createNewEmptyHeapFile(addressSpaceStart uint64, option *HeapFileOptions, logger log.Logger) (*heapfilemeta, error) {
+func createNewEmptyHeapFile(addressSpaceStart uint64, directory string, option *HeapFileOptions, logger log.Logger) (*heapfilemeta, error) {
 
 	heapFileMetaSize := getHeapFileMetaSize(option)
 
-	fd, err := syscall.Open(filepath.Join(option.FileDirectory, heapFileName(addressSpaceStart)), syscall.O_RDWR|syscall.O_DSYNC|syscall.O_CREAT, permissionBits)
+	fd, err := syscall.Open(filepath.Join(directory, heapFileName(addressSpaceStart)), syscall.O_RDWR|syscall.O_DSYNC|syscall.O_CREAT, permissionBits)
 	if err != nil {
 		logger.Error().Err(err).Msg(fmt.Sprintf("Failed to open heap file %d", addressSpaceStart))
 		return nil, err
 	}
+	created := false
+	defer func() {
+		if !created {
+			syscall.Close(fd)
+		}
+	}()
 
 	err = syscall.Fallocate(fd, 0, 0, int64(heapFileMetaSize))
 	if err != nil {
@@ -699,11 +1151,18 @@ func createNewEmptyHeapFile(addressSpaceStart uint64, option *HeapFileOptions, l
 
 	hpm := &heapfilemeta{
 		pageCount:         0,
+		version:           CurrentHeapFileFormat,
 		fd:                fd,
 		addressSpaceStart: addressSpaceStart,
+		directory:         directory,
 		options:           option,
 	}
 
+	if err := initFileEncryption(hpm); err != nil {
+		logger.Error().Err(err).Msg(fmt.Sprintf("Failed to set up encryption of heap file %d", addressSpaceStart))
+		return nil, err
+	}
+
 	hpm.buffer = make([]byte, heapFileMetaSize)
 	hpm.SerializeMetaData()
 
@@ -720,6 +1179,7 @@ func createNewEmptyHeapFile(addressSpaceStart uint64, option *HeapFileOptions, l
 
 	createFreeSizePages(hpm, heapFileMetaSize, option)
 
+	created = true
 	return hpm, nil
 }
 
@@ -2,9 +2,16 @@ package heap
 
 import (
 	"boro-db/logging"
+	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,6 +43,16 @@ func TestHeapFileOperations(t *testing.T) {
 		assert.Equal(t, uint32(4), hpf.fileIdentifiers[0].pageCount)
 		assert.Equal(t, uint64(4), hpf.FreePagesAvailable())
 
+		// directory is locked for as long as the heap is open
+		_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+			PageSizeByte:        4096,
+			FileDirectory:       dir,
+			MaxHeapFileSizeByte: 4096 * 4,
+		})
+		assert.ErrorIs(t, err, ErrDirectoryLocked)
+		assert.ErrorContains(t, err, fmt.Sprintf("pid %d", os.Getpid()))
+		assert.Nil(t, heapFile.Close(context.Background()))
+
 		t.Run("Test by reloading the file system", func(t *testing.T) {
 			// reload the same file system
 			heapFile, err := NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
@@ -45,6 +62,7 @@ func TestHeapFileOperations(t *testing.T) {
 			})
 
 			assert.Nil(t, err)
+			defer heapFile.Close(context.Background())
 			hpf := heapFile.(*fileSystemHeap)
 			assert.Len(t, hpf.fileIdentifiers, 1)
 			assert.Equal(t, uint64(3), hpf.lastAddressInAddressSpace)
@@ -62,6 +80,7 @@ func TestHeapFileOperations(t *testing.T) {
 			})
 
 			assert.Nil(t, err)
+			defer heapFile.Close(context.Background())
 			hpf := heapFile.(*fileSystemHeap)
 			heapFile.ExtendBy(4)
 			assert.Len(t, hpf.fileIdentifiers, 2)
@@ -97,6 +116,7 @@ func TestHeapFileOperations(t *testing.T) {
 			})
 
 			assert.Nil(t, err)
+			defer heapFile.Close(context.Background())
 			hpf := heapFile.(*fileSystemHeap)
 
 			assert.Len(t, hpf.fileIdentifiers, 5)
@@ -125,6 +145,7 @@ func TestHeapFileOperations(t *testing.T) {
 			})
 
 			assert.Nil(t, err)
+			defer heapFile.Close(context.Background())
 
 			pages, err := heapFile.Malloc(9)
 			assert.Nil(t, err)
@@ -155,6 +176,741 @@ func TestHeapFileOperations(t *testing.T) {
 			wg.Wait()
 
 		})
+
+		t.Run("Test manifest mismatch", func(t *testing.T) {
+			manifest, err := ReadManifest(dir)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(4096), manifest.PageSizeByte)
+			assert.Equal(t, uint32(4096*4), manifest.MaxHeapFileSizeByte)
+
+			_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+				PageSizeByte:        8192,
+				FileDirectory:       dir,
+				MaxHeapFileSizeByte: 4096 * 4,
+			})
+			assert.ErrorIs(t, err, ErrManifestMismatch)
+
+			_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+				PageSizeByte:        4096,
+				FileDirectory:       dir,
+				MaxHeapFileSizeByte: 4096 * 8,
+			})
+			assert.ErrorIs(t, err, ErrManifestMismatch)
+		})
+
+		t.Run("Test close", func(t *testing.T) {
+			heapFile, err := NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+				PageSizeByte:        4096,
+				FileDirectory:       dir,
+				MaxHeapFileSizeByte: 4096 * 4,
+			})
+			assert.Nil(t, err)
+			assert.Nil(t, heapFile.Close(context.Background()))
+
+			_, err = heapFile.Malloc(1)
+			assert.ErrorIs(t, err, ErrClosed)
+			assert.ErrorIs(t, heapFile.ExtendBy(1), ErrClosed)
+			heapFile.Read(0, make([]byte, 4096), func(err error) {
+				assert.ErrorIs(t, err, ErrClosed)
+			})
+			assert.ErrorIs(t, heapFile.Close(context.Background()), ErrClosed)
+		})
 	})
 
 }
+
+func TestHeapFormatUpgrade(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-format")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(4))
+
+	// rewrite the header as a v0 file with a stale allocation bit past pageCount
+	hpf := heapFile.(*fileSystemHeap).fileIdentifiers[0]
+	assert.Equal(t, CurrentHeapFileFormat, hpf.version)
+	hpf.version = heapFileFormatV0
+	for i := 16; i < 24; i++ {
+		hpf.buffer[i] = 0
+	}
+	hpf.buffer[options.PageSizeByte] |= 1 << 6
+	hpf.SerializeMetaData()
+	_, err = syscall.Pwrite(hpf.fd, hpf.buffer, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	// older supported versions are readable as is
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Equal(t, heapFileFormatV0, heapFile.(*fileSystemHeap).fileIdentifiers[0].version)
+	assert.Equal(t, uint64(4), heapFile.FreePagesAvailable())
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	assert.Nil(t, UpgradeHeap(*logging.CreateDebugLogger(), options))
+
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	hpf = heapFile.(*fileSystemHeap).fileIdentifiers[0]
+	assert.Equal(t, CurrentHeapFileFormat, hpf.version)
+	assert.Equal(t, byte(0), hpf.buffer[options.PageSizeByte]&(1<<6))
+	assert.Equal(t, uint64(4), heapFile.FreePagesAvailable())
+
+	// files from the future are refused
+	hpf.version = CurrentHeapFileFormat + 1
+	hpf.SerializeMetaData()
+	_, err = syscall.Pwrite(hpf.fd, hpf.buffer, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	_, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestHeapChecksumAlgorithm(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-checksum-algorithm")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+		ChecksumAlgorithm:   checksums.XXHash64,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(6))
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), heapFile.FreePagesAvailable())
+	assert.Equal(t, byte(checksums.XXHash64), heapFile.(*fileSystemHeap).fileIdentifiers[0].buffer[headerChecksumAlgorithmOffset])
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	manifest, err := ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, checksums.XXHash64, manifest.ChecksumAlgorithm)
+
+	// the algorithm is pinned by the manifest
+	crcOptions := *options
+	crcOptions.ChecksumAlgorithm = checksums.CRC32C
+	_, err = NewHeap(*logging.CreateDebugLogger(), &crcOptions)
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+
+	report, err := Check(*logging.CreateDebugLogger(), dir, CheckOptions{VerifyPageChecksums: true})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+}
+
+func TestHeapManifestForExistingFiles(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-legacy-manifest")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4096 * 16,
+	}
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(6))
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	// a heap from before manifests
+	assert.Nil(t, os.Remove(filepath.Join(dir, manifestFileName)))
+
+	// the free list of a smaller heap file fits one page , the files have two
+	_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 8,
+	})
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	_, err = ReadManifest(dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// six pages do not fit a heap file of four
+	_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+	})
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	_, err = ReadManifest(dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), heapFile.FreePagesAvailable())
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	manifest, err := ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, options.MaxHeapFileSizeByte, manifest.MaxHeapFileSizeByte)
+}
+
+func TestHeapPageCompression(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-compression")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096 * 4,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4 * 4,
+		Compression:         CompressionZstd,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(2))
+	pageNumbers, err := heapFile.Malloc(2)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	hpf := heapFile.(*fileSystemHeap).fileIdentifiers[0]
+	var before syscall.Stat_t
+	assert.Nil(t, syscall.Fstat(hpf.fd, &before))
+
+	compressible := bytes.Repeat([]byte("boro-db "), int(options.PageSizeByte)/8)
+	assert.Nil(t, heapFile.WriteContext(ctx, pageNumbers[0], compressible))
+
+	incompressible := make([]byte, options.PageSizeByte)
+	rand.Read(incompressible)
+	assert.Nil(t, heapFile.WriteContext(ctx, pageNumbers[1], incompressible))
+
+	// the compressed page gives its unused blocks back
+	var after syscall.Stat_t
+	assert.Nil(t, syscall.Fstat(hpf.fd, &after))
+	assert.Less(t, after.Blocks, before.Blocks)
+	assert.Equal(t, before.Size, after.Size)
+
+	buffer := make([]byte, options.PageSizeByte)
+	assert.Nil(t, heapFile.ReadContext(ctx, pageNumbers[0], buffer))
+	assert.Equal(t, compressible, buffer)
+	assert.Nil(t, heapFile.ReadContext(ctx, pageNumbers[1], buffer))
+	assert.Equal(t, incompressible, buffer)
+	assert.Nil(t, heapFile.Close(ctx))
+
+	// compressed pages stay readable with compression turned off
+	plainOptions := *options
+	plainOptions.Compression = CompressionNone
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), &plainOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ReadContext(ctx, pageNumbers[0], buffer))
+	assert.Equal(t, compressible, buffer)
+	assert.Nil(t, heapFile.Close(ctx))
+}
+
+func TestHeapEncryption(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-encryption")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	provider := encryption.NewStaticKeyProvider(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 64)})
+	options := &HeapFileOptions{
+		PageSizeByte:        4096 * 2,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 2 * 2,
+		Compression:         CompressionSnappy,
+		KeyProvider:         provider,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(2))
+
+	// the second file is created after the key is rotated
+	provider.Rotate(2, bytes.Repeat([]byte{2}, 64))
+	assert.Nil(t, heapFile.ExtendBy(2))
+	pageNumbers := make([]uint64, 0, 4)
+	for i := 0; i < 2; i++ {
+		allocated, err := heapFile.Malloc(2)
+		assert.Nil(t, err)
+		pageNumbers = append(pageNumbers, allocated...)
+	}
+
+	fsh := heapFile.(*fileSystemHeap)
+	assert.Equal(t, uint32(1), fsh.fileIdentifiers[0].keyID)
+	assert.Equal(t, uint32(2), fsh.fileIdentifiers[1].keyID)
+
+	ctx := context.Background()
+	compressible := bytes.Repeat([]byte("customer data "), int(options.PageSizeByte)/14+1)[:options.PageSizeByte]
+	incompressible := make([]byte, options.PageSizeByte)
+	rand.Read(incompressible)
+	copy(incompressible[4:], "customer data ")
+	// laid out like paging pages with page meta so fsck can verify them
+	checksums.Calculate(checksums.CRC32IEEE, compressible[0:4], compressible[4:])
+	checksums.Calculate(checksums.CRC32IEEE, incompressible[0:4], incompressible[4:])
+	for i, pageNumber := range pageNumbers {
+		page := compressible
+		if i%2 == 1 {
+			page = incompressible
+		}
+		assert.Nil(t, heapFile.WriteContext(ctx, pageNumber, page))
+	}
+	assert.Nil(t, heapFile.Close(ctx))
+
+	// nothing readable on disk
+	for _, start := range []uint64{0, 2} {
+		content, err := os.ReadFile(filepath.Join(dir, heapFileName(start)))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(content, []byte("customer data")))
+	}
+
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	buffer := make([]byte, options.PageSizeByte)
+	for i, pageNumber := range pageNumbers {
+		assert.Nil(t, heapFile.ReadContext(ctx, pageNumber, buffer))
+		if i%2 == 1 {
+			assert.Equal(t, incompressible, buffer)
+		} else {
+			assert.Equal(t, compressible, buffer)
+		}
+	}
+	assert.Nil(t, heapFile.Close(ctx))
+
+	report, err := Check(*logging.CreateDebugLogger(), dir, CheckOptions{VerifyPageChecksums: true, KeyProvider: provider})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	// encrypted heap files can not be opened without their keys
+	plainOptions := *options
+	plainOptions.KeyProvider = nil
+	_, err = NewHeap(*logging.CreateDebugLogger(), &plainOptions)
+	assert.ErrorIs(t, err, encryption.ErrKeyNotFound)
+}
+
+func TestHeapMallocContiguous(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-contiguous")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(20))
+
+	pages, err := heapFile.Malloc(16)
+	assert.Nil(t, err)
+	// leaves runs of 3 (pages 2-4) and 2 (pages 8-9) in the first file , 4 pages in the second
+	assert.Nil(t, heapFile.Free([]uint64{2, 3, 4, 8, 9}))
+
+	run, err := heapFile.MallocContiguous(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{8, 9}, run)
+
+	run, err = heapFile.MallocContiguous(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{16, 17, 18, 19}, run)
+
+	_, err = heapFile.MallocContiguous(4)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+
+	run, err = heapFile.MallocContiguous(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{2, 3, 4}, run)
+
+	for _, page := range append(pages, run...) {
+		assert.False(t, heapFile.IsPageFree(page))
+	}
+	assert.Equal(t, uint64(0), heapFile.FreePagesAvailable())
+}
+
+func TestHeapFreeSpaceSummary(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-free-space")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(10))
+	assert.Equal(t, uint64(10), heapFile.FreePagesAvailable())
+
+	pages, err := heapFile.Malloc(9)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8}, pages)
+	assert.Equal(t, uint64(1), heapFile.FreePagesAvailable())
+
+	// double frees and unknown pages are not counted
+	assert.Nil(t, heapFile.Free([]uint64{6, 1, 6, 100}))
+	assert.Equal(t, uint64(3), heapFile.FreePagesAvailable())
+
+	// freed pages are reused lowest first
+	pages, err = heapFile.Malloc(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{1, 6}, pages)
+
+	_, err = heapFile.Malloc(2)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+
+	assert.Nil(t, heapFile.TrimHead(2))
+	assert.Equal(t, uint64(0), heapFile.FreePagesAvailable())
+	assert.Nil(t, heapFile.ExtendBy(3))
+	assert.Equal(t, uint64(3), heapFile.FreePagesAvailable())
+	assert.Nil(t, heapFile.Close(context.Background()))
+
+	// the summary is rebuilt from the persisted bitmaps
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), heapFile.FreePagesAvailable())
+	assert.Nil(t, heapFile.Close(context.Background()))
+}
+
+func TestHeapCompaction(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-compaction")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(40))
+
+	pages, err := heapFile.Malloc(40)
+	assert.Nil(t, err)
+	buffer := make([]byte, 4096)
+	for _, page := range pages {
+		buffer[0] = byte(page)
+		assert.Nil(t, heapFile.WriteContext(context.Background(), page, buffer))
+	}
+
+	live := map[uint64]bool{3: true, 20: true, 33: true, 39: true}
+	freed := make([]uint64, 0)
+	for _, page := range pages {
+		if !live[page] {
+			freed = append(freed, page)
+		}
+	}
+	assert.Nil(t, heapFile.Free(freed))
+
+	// a failing owner leaves the page where it was
+	_, err = heapFile.Compact(func(from uint64, to uint64) error {
+		return fmt.Errorf("owner busy")
+	})
+	assert.NotNil(t, err)
+	assert.False(t, heapFile.IsPageFree(39))
+	assert.True(t, heapFile.IsPageFree(0))
+
+	moves := map[uint64]uint64{}
+	result, err := heapFile.Compact(func(from uint64, to uint64) error {
+		moves[from] = to
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint64]uint64{39: 0, 33: 1, 20: 2}, moves)
+	assert.Equal(t, uint64(3), result.PagesMoved)
+	assert.Equal(t, uint64(36), result.PagesTrimmed)
+	assert.Equal(t, [2]uint64{0, 3}, heapFile.ValidAddressRange())
+	assert.Equal(t, uint64(0), heapFile.FreePagesAvailable())
+
+	for from, to := range moves {
+		assert.Nil(t, heapFile.ReadContext(context.Background(), to, buffer))
+		assert.Equal(t, byte(from), buffer[0])
+	}
+
+	// the emptied heap files are gone , the first one shrank
+	_, err = os.Stat(filepath.Join(dir, heapFileName(16)))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, heapFileName(32)))
+	assert.True(t, os.IsNotExist(err))
+	stat, err := os.Stat(filepath.Join(dir, heapFileName(0)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(getHeapFileMetaSize(options)+4*4096), stat.Size())
+
+	// compacting a compact heap is a no-op
+	result, err = heapFile.Compact(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactionResult{}, result)
+
+	assert.Nil(t, heapFile.ExtendBy(4))
+	pages, err = heapFile.Malloc(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{4, 5, 6, 7}, pages)
+}
+
+func TestHeapPunchHolesOnFree(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-punch-free")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 32,
+		PunchHolesOnFree:    true,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(16))
+	pageNumbers, err := heapFile.Malloc(16)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	page := bytes.Repeat([]byte{0xAB}, int(options.PageSizeByte))
+	for _, pageNumber := range pageNumbers {
+		assert.Nil(t, heapFile.WriteContext(ctx, pageNumber, page))
+	}
+
+	hpf := heapFile.(*fileSystemHeap).fileIdentifiers[0]
+	var before syscall.Stat_t
+	assert.Nil(t, syscall.Fstat(hpf.fd, &before))
+
+	// two runs , batched into two punches
+	assert.Nil(t, heapFile.Free([]uint64{4, 5, 6, 7, 12, 13, 14, 15}))
+
+	var freed syscall.Stat_t
+	assert.Nil(t, syscall.Fstat(hpf.fd, &freed))
+	// Blocks are 512 byte units
+	assert.Equal(t, before.Blocks-8*4096/512, freed.Blocks)
+	assert.Equal(t, before.Size, freed.Size)
+
+	// reuse fallocates the blocks again , the old contents are gone
+	reused, err := heapFile.Malloc(4)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{4, 5, 6, 7}, reused)
+
+	var allocated syscall.Stat_t
+	assert.Nil(t, syscall.Fstat(hpf.fd, &allocated))
+	assert.Equal(t, before.Blocks-4*4096/512, allocated.Blocks)
+
+	buffer := make([]byte, options.PageSizeByte)
+	assert.Nil(t, heapFile.ReadContext(ctx, reused[0], buffer))
+	assert.Equal(t, make([]byte, options.PageSizeByte), buffer)
+	assert.Nil(t, heapFile.ReadContext(ctx, 3, buffer))
+	assert.Equal(t, page, buffer)
+}
+
+func TestHeapStatsAndQuota(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-stats")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(20))
+	_, err = heapFile.Malloc(20)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.Free([]uint64{2, 3, 4, 10}))
+
+	stats, err := heapFile.Stats()
+	assert.Nil(t, err)
+	metaSize := uint64(getHeapFileMetaSize(options))
+	assert.Equal(t, uint64(20), stats.TotalPages)
+	assert.Equal(t, uint64(16), stats.AllocatedPages)
+	assert.Equal(t, uint64(4), stats.FreePages)
+	assert.Equal(t, 2, stats.FileCount)
+	assert.Equal(t, 2*metaSize+20*4096, stats.FileBytes)
+	assert.Greater(t, stats.BytesOnDisk, uint64(0))
+	// largest free run is 2-4
+	assert.InDelta(t, 0.25, stats.FragmentationRatio, 0.0001)
+	assert.Equal(t, uint64(0), stats.QuotaBytes)
+
+	options.QuotaBytes = stats.FileBytes + 2*4096
+	err = heapFile.ExtendBy(3)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Nil(t, heapFile.ExtendBy(2))
+
+	// a new heap file brings its meta along
+	options.QuotaBytes += 10*4096 + metaSize
+	assert.ErrorIs(t, heapFile.ExtendBy(11), ErrQuotaExceeded)
+	assert.Nil(t, heapFile.ExtendBy(10))
+
+	stats, err = heapFile.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(32), stats.TotalPages)
+	assert.Equal(t, options.QuotaBytes-metaSize, stats.FileBytes)
+}
+
+func TestHeapDirectories(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-directories")
+	volumes := []string{filepath.Join(pt, "test-directories-vol1"), filepath.Join(pt, "test-directories-vol2")}
+
+	defer func() {
+		os.RemoveAll(dir)
+		for _, volume := range volumes {
+			os.RemoveAll(volume)
+		}
+	}()
+
+	options := &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+		Directories:         volumes,
+	}
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(64))
+
+	// round robin per heap file
+	for start, directory := range map[uint64]string{0: dir, 16: volumes[0], 32: volumes[1], 48: dir} {
+		_, err := os.Stat(filepath.Join(directory, heapFileName(start)))
+		assert.Nil(t, err, "heap file %d should be in %s", start, directory)
+	}
+
+	// every volume is owned by the open heap
+	_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       volumes[0],
+		MaxHeapFileSizeByte: 4096 * 16,
+	})
+	assert.ErrorIs(t, err, ErrDirectoryLocked)
+
+	ctx := context.Background()
+	pages, err := heapFile.Malloc(64)
+	assert.Nil(t, err)
+	buffer := make([]byte, 4096)
+	for _, page := range pages {
+		buffer[0] = byte(page)
+		assert.Nil(t, heapFile.WriteContext(ctx, page, buffer))
+	}
+	assert.Nil(t, heapFile.Close(ctx))
+
+	// a volume left out leaves a hole in the address space
+	_, err = NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+		Directories:         volumes[:1],
+	})
+	assert.ErrorIs(t, err, ErrHeapFileMissing)
+
+	report, err := Check(*logging.CreateDebugLogger(), dir, CheckOptions{Directories: volumes})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 4, report.FilesChecked)
+
+	heapFile, err = NewHeap(*logging.CreateDebugLogger(), options)
+	assert.Nil(t, err)
+	defer heapFile.Close(ctx)
+	assert.Equal(t, [2]uint64{0, 63}, heapFile.ValidAddressRange())
+	for _, page := range []uint64{5, 20, 40, 60} {
+		assert.Nil(t, heapFile.ReadContext(ctx, page, buffer))
+		assert.Equal(t, byte(page), buffer[0])
+	}
+
+	// trimming deletes files wherever they live
+	assert.Nil(t, heapFile.TrimHead(40))
+	_, err = os.Stat(filepath.Join(volumes[1], heapFileName(32)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHeapCallbacksRunUnlocked(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-callbacks")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapFile, err := NewHeap(*logging.CreateDebugLogger(), &HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 4,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(4))
+	pages, err := heapFile.Malloc(1)
+	assert.Nil(t, err)
+
+	// callbacks take other locks (the page cache) , a heap lock held across them
+	// deadlocks against Malloc / Free waiting for it
+	buffer := make([]byte, 4096)
+	heapFile.Write(pages[0], buffer, func(err error) {
+		assert.Nil(t, err)
+		more, err := heapFile.Malloc(1)
+		assert.Nil(t, err)
+		assert.Nil(t, heapFile.Free(more))
+	})
+	heapFile.Read(pages[0], buffer, func(err error) {
+		assert.Nil(t, err)
+		more, err := heapFile.Malloc(1)
+		assert.Nil(t, err)
+		assert.Nil(t, heapFile.Free(more))
+	})
+	assert.Nil(t, heapFile.Close(context.Background()))
+}
@@ -0,0 +1,81 @@
+package heap
+
+import (
+	"fmt"
+	"slices"
+	"syscall"
+)
+
+/*
+Hole punching for freed pages
+┌──────────────────────────────────────────────────────────────┐
+| page | page |----- punched -----| page |---- punched ----|   |
+└──────────────────────────────────────────────────────────────┘
+  - with PunchHolesOnFree , Free hands the blocks of the released pages back to the filesystem
+    the file keeps its size , a punched page reads as zeros
+  - adjacent pages go out as one fallocate call , ranges shrink to filesystem block boundaries
+  - allocating a page fallocates its blocks again so writing it later can not fail with ENOSPC
+    an allocation the filesystem has no room for fails up front and is rolled back
+  - punching is best effort , the free list is the source of truth and a failed punch only costs space
+*/
+
+// contiguous runs of sorted locations as (first , count)
+func locationRuns(locs []uint64) [][2]uint64 {
+	sorted := slices.Clone(locs)
+	slices.Sort(sorted)
+	runs := make([][2]uint64, 0)
+	for _, loc := range sorted {
+		if n := len(runs); n > 0 && runs[n-1][0]+runs[n-1][1] == loc {
+			runs[n-1][1]++
+			continue
+		}
+		runs = append(runs, [2]uint64{loc, 1})
+	}
+	return runs
+}
+
+// byte range of a run of free list locations with in its heap file
+func (fsh *fileSystemHeap) runByteRange(ref freeListRef, run [2]uint64) (int64, int64) {
+	pageSize := int64(fsh.option.PageSizeByte)
+	fileOffset := int64(ref.idx)*pageSize*8 + int64(run[0])
+	start := int64(fsh.heapMetaSize) + fileOffset*pageSize
+	return start, start + int64(run[1])*pageSize
+}
+
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) punchFreedPages(refs []freeListRef, locs [][]uint64) {
+	if !fsh.option.PunchHolesOnFree {
+		return
+	}
+	blockSize := int64(fsh.blockSize)
+	for i, ref := range refs {
+		for _, run := range locationRuns(locs[i]) {
+			start, end := fsh.runByteRange(ref, run)
+			start = (start + blockSize - 1) / blockSize * blockSize
+			end = end / blockSize * blockSize
+			if start >= end {
+				continue
+			}
+			if err := syscall.Fallocate(ref.hpf.fd, fallocPunchHole|fallocKeepSize, start, end-start); err != nil {
+				fsh.logger.Warn().Err(err).Msg(fmt.Sprintf("Failed to punch hole for %d freed pages in heap file %d", run[1], ref.hpf.addressSpaceStart))
+			}
+		}
+	}
+}
+
+// gives punched pages their blocks back before they are handed out , caller must hold the heapFileLock
+func (fsh *fileSystemHeap) reserveAllocatedPages(refs []freeListRef, locs [][]uint64) error {
+	if !fsh.option.PunchHolesOnFree {
+		return nil
+	}
+	for i, ref := range refs {
+		for _, run := range locationRuns(locs[i]) {
+			start, end := fsh.runByteRange(ref, run)
+			if err := syscall.Fallocate(ref.hpf.fd, fallocKeepSize, start, end-start); err != nil {
+				fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to fallocate %d allocated pages in heap file %d", run[1], ref.hpf.addressSpaceStart))
+				return err
+			}
+		}
+	}
+	return nil
+}
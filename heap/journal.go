@@ -0,0 +1,219 @@
+package heap
+
+import (
+	"boro-db/utils/checksums"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/phuslu/log"
+)
+
+/*
+Allocation journal
+┌──────────────────────────────────────────────────────────────┐
+| crc (4byte) | image count (4byte)                            |
+| heap file start (8byte) | free list index (4byte) | pad (4)  |
+| free list page image (PageSizeByte)                          |
+| ......                                                       |
+└──────────────────────────────────────────────────────────────┘
+  - Malloc / MallocContiguous / Free can touch free list pages in several heap files
+    writing them one by one in place can leave half an allocation on disk after a crash
+  - every change first writes the new images of all touched free list pages here and fsyncs
+    only then are the pages written in place
+  - on open the journal is replayed (redo) , replaying images that already made it is harmless
+  - a crash while writing the journal is caught by its crc , nothing was written in place yet
+  - only the last change is kept , the previous one finished in place before the next one started
+  - ExtendBy / Trim reset the journal , images must not outlive the files they were taken from
+*/
+const allocationJournalFileName = "FREELIST-JOURNAL"
+const allocationJournalHeaderSize = 8
+const allocationJournalEntryHeaderSize = 16
+
+// test hook , called at named points of an allocation so crash tests can kill the process there
+var failpoint = func(name string) {}
+
+type allocationJournal struct {
+	file     *os.File
+	pageSize int
+}
+
+// a free list page touched by an allocation
+type freeListRef struct {
+	hpf *heapfilemeta
+	idx int
+}
+
+func openAllocationJournal(directory string, pageSize uint32) (*allocationJournal, error) {
+	file, err := os.OpenFile(filepath.Join(directory, allocationJournalFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &allocationJournal{
+		file:     file,
+		pageSize: int(pageSize),
+	}, nil
+}
+
+func (j *allocationJournal) entrySize() int {
+	return allocationJournalEntryHeaderSize + j.pageSize
+}
+
+// writes the current images of the free list pages and fsyncs them
+func (j *allocationJournal) log(refs []freeListRef) error {
+	buffer := make([]byte, allocationJournalHeaderSize+len(refs)*j.entrySize())
+	offset := allocationJournalHeaderSize
+	for _, ref := range refs {
+		binary.BigEndian.PutUint64(buffer[offset:offset+8], ref.hpf.addressSpaceStart)
+		binary.BigEndian.PutUint32(buffer[offset+8:offset+12], uint32(ref.idx))
+		copy(buffer[offset+allocationJournalEntryHeaderSize:offset+j.entrySize()], ref.hpf.freelist[ref.idx].CurrentBuffer())
+		offset += j.entrySize()
+	}
+	binary.BigEndian.PutUint32(buffer[4:8], uint32(len(refs)))
+	checksums.CalculateCRC(buffer[0:4], buffer[4:])
+
+	failpoint("allocation-journal-write")
+	if _, err := j.file.WriteAt(buffer, 0); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(int64(len(buffer))); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+/*
+applies the images of the last change to the heap files
+runs before the heap files are read so the free lists are built from the replayed pages
+*/
+func (j *allocationJournal) replay(logger log.Logger, option *HeapFileOptions) error {
+	content, err := os.ReadFile(j.file.Name())
+	if err != nil {
+		return err
+	}
+	if len(content) < allocationJournalHeaderSize {
+		return nil
+	}
+
+	count := int(binary.BigEndian.Uint32(content[4:8]))
+	size := allocationJournalHeaderSize + count*j.entrySize()
+	crc := make([]byte, 4)
+	if size != len(content) {
+		logger.Warn().Msg("allocation journal is truncated , discarding it")
+		return j.reset()
+	}
+	checksums.CalculateCRC(crc, content[4:size])
+	if !checksums.CompareCRC(crc, content[0:4]) {
+		// torn while writing the journal , no free list page was touched in place
+		logger.Warn().Msg("allocation journal crc mismatch , discarding it")
+		return j.reset()
+	}
+
+	for offset := allocationJournalHeaderSize; offset < size; offset += j.entrySize() {
+		start := binary.BigEndian.Uint64(content[offset : offset+8])
+		idx := int(binary.BigEndian.Uint32(content[offset+8 : offset+12]))
+		image := content[offset+allocationJournalEntryHeaderSize : offset+j.entrySize()]
+
+		path := findHeapFile(option, start)
+		if path == "" {
+			logger.Warn().Msg(fmt.Sprintf("skipping allocation journal image of missing heap file %d", start))
+			continue
+		}
+		fd, err := syscall.Open(path, syscall.O_RDWR, permissionBits)
+		if errors.Is(err, syscall.ENOENT) {
+			logger.Warn().Msg(fmt.Sprintf("skipping allocation journal image of missing heap file %d", start))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = syscall.Pwrite(fd, image, int64((idx+1)*j.pageSize))
+		if err == nil {
+			err = syscall.Fsync(fd)
+		}
+		syscall.Close(fd)
+		if err != nil {
+			logger.Error().Err(err).Msg(fmt.Sprintf("Failed to replay allocation journal into heap file %d", start))
+			return err
+		}
+	}
+	logger.Info().Msg(fmt.Sprintf("replayed %d free list pages from the allocation journal", count))
+
+	return j.reset()
+}
+
+func (j *allocationJournal) reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *allocationJournal) close() error {
+	return j.file.Close()
+}
+
+/*
+makes the in memory state of the touched free list pages durable
+journal first , then in place. an error before the journal is synced leaves the disk untouched
+caller must hold the heapFileLock
+*/
+func (fsh *fileSystemHeap) persistFreeLists(refs []freeListRef) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	if err := fsh.journal.log(refs); err != nil {
+		fsh.logger.Error().Err(err).Msg("Error while writing the allocation journal")
+		return err
+	}
+	failpoint("allocation-journaled")
+
+	for i, ref := range refs {
+		_, err := syscall.Pwrite(ref.hpf.fd, ref.hpf.freelist[ref.idx].CurrentBuffer(), int64((ref.idx+1)*int(fsh.option.PageSizeByte)))
+		if err != nil {
+			fsh.logger.Error().Err(err).Msg("Error while writing FreeSpaceInfo to heap file")
+			return err
+		}
+		if i == 0 {
+			failpoint("allocation-partially-applied")
+		}
+	}
+	return nil
+}
+
+/*
+undoes an allocation that could not be persisted
+the journal may already hold the new images , persisting the rolled back state
+replaces them so a later replay can not resurrect the allocation
+*/
+func (fsh *fileSystemHeap) rollbackFreeLists(refs []freeListRef, rollback func() error, cause error) error {
+	if err := rollback(); err != nil {
+		fsh.logger.Error().Err(err).Msg("Failed to roll back free lists in memory")
+		cause = errors.Join(cause, err)
+	}
+	if err := fsh.persistFreeLists(refs); err != nil {
+		fsh.logger.Error().Err(err).Msg("Failed to persist rolled back free lists")
+		return errors.Join(cause, err)
+	}
+	return cause
+}
+
+// replays whatever the last run left behind , before any heap file is read
+func replayAllocationJournal(logger log.Logger, option *HeapFileOptions) error {
+	journal, err := openAllocationJournal(option.FileDirectory, option.PageSizeByte)
+	if err != nil {
+		return err
+	}
+	defer journal.close()
+	return journal.replay(logger, option)
+}
+
+// caller must hold the heapFileLock
+func (fsh *fileSystemHeap) resetJournal() {
+	if err := fsh.journal.reset(); err != nil {
+		fsh.logger.Error().Err(err).Msg("Failed to reset the allocation journal")
+	}
+}
@@ -0,0 +1,77 @@
+package heap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var ErrDirectoryLocked = fmt.Errorf("heap directory is locked")
+
+const lockFileName = "LOCK"
+
+/*
+LOCK file
+- one per heap directory , holds an exclusive flock for as long as the heap is open
+- the holder writes its pid in the file so the next opener can say who has it
+- flock is released by the kernel if the process dies , so a stale LOCK file is harmless
+- the file itself is never deleted , unlinking it would let two processes lock different inodes
+*/
+type directoryLock struct {
+	fd   int
+	path string
+}
+
+func acquireDirectoryLock(directory string) (*directoryLock, error) {
+	path := filepath.Join(directory, lockFileName)
+
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_CLOEXEC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer syscall.Close(fd)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			pid := readLockHolder(fd)
+			return nil, fmt.Errorf("%w : %s is held by pid %s", ErrDirectoryLocked, directory, pid)
+		}
+		return nil, err
+	}
+
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := syscall.Ftruncate(fd, 0); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if _, err := syscall.Pwrite(fd, pid, 0); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &directoryLock{
+		fd:   fd,
+		path: path,
+	}, nil
+}
+
+func readLockHolder(fd int) string {
+	buffer := make([]byte, 32)
+	n, err := syscall.Pread(fd, buffer, 0)
+	if err != nil || n == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(buffer[:n]))
+}
+
+func (dl *directoryLock) release() error {
+	// clear the pid first , once unlocked someone else may already own the file
+	truncateErr := syscall.Ftruncate(dl.fd, 0)
+	unlockErr := syscall.Flock(dl.fd, syscall.LOCK_UN)
+	closeErr := syscall.Close(dl.fd)
+	return errors.Join(truncateErr, unlockErr, closeErr)
+}
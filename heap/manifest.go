@@ -0,0 +1,265 @@
+package heap
+
+import (
+	"boro-db/utils/checksums"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/phuslu/log"
+)
+
+var ErrManifestMismatch = fmt.Errorf("heap manifest mismatch")
+var ErrManifestCorrupted = fmt.Errorf("heap manifest corrupted")
+
+/*
+MANIFEST
+┌──────────────────────────────────────────────────────────────┐
+| crc (4byte) | version (4byte) | pageSize (4byte)             |
+| maxHeapFileSize (4byte) | creation uuid (16byte)             |
+| checksum algorithm (1byte , v2) | padding (3byte)            |
+└──────────────────────────────────────────────────────────────┘
+- written once when the heap directory is created
+- pins the values that decide how heap files are laid out , they can never change
+- replaced atomically (write temp + fsync + rename + fsync dir)
+- the manifest crc itself is always crc32 (IEEE) , it has to be readable before the algorithm is known
+*/
+const manifestFileName = "MANIFEST"
+const manifestVersion = uint32(2)
+
+var manifestSizes = map[uint32]int{
+	1: 32,
+	2: 36,
+}
+
+type Manifest struct {
+	FormatVersion       uint32
+	PageSizeByte        uint32
+	MaxHeapFileSizeByte uint32
+	CreationUUID        [16]byte
+	ChecksumAlgorithm   checksums.Algorithm
+}
+
+func (m *Manifest) UUID() string {
+	u := m.CreationUUID
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hex.EncodeToString(u[0:4]), hex.EncodeToString(u[4:6]), hex.EncodeToString(u[6:8]), hex.EncodeToString(u[8:10]), hex.EncodeToString(u[10:16]))
+}
+
+// always written in the latest manifest version
+func (m *Manifest) serialize() []byte {
+	buffer := make([]byte, manifestSizes[manifestVersion])
+	binary.BigEndian.PutUint32(buffer[4:8], manifestVersion)
+	binary.BigEndian.PutUint32(buffer[8:12], m.PageSizeByte)
+	binary.BigEndian.PutUint32(buffer[12:16], m.MaxHeapFileSizeByte)
+	copy(buffer[16:32], m.CreationUUID[:])
+	buffer[32] = byte(m.ChecksumAlgorithm)
+	checksums.CalculateCRC(buffer[0:4], buffer[4:])
+	return buffer
+}
+
+func deserializeManifest(buffer []byte) (*Manifest, error) {
+	if len(buffer) < 8 {
+		return nil, fmt.Errorf("%w : expected at least 8 bytes found %d", ErrManifestCorrupted, len(buffer))
+	}
+	version := binary.BigEndian.Uint32(buffer[4:8])
+	size, ok := manifestSizes[version]
+	if !ok {
+		crcBuffer := make([]byte, 4)
+		checksums.CalculateCRC(crcBuffer, buffer[4:])
+		if checksums.CompareCRC(crcBuffer, buffer[0:4]) && version > manifestVersion {
+			return nil, fmt.Errorf("%w : manifest version %d is newer than supported version %d", ErrManifestMismatch, version, manifestVersion)
+		}
+		return nil, fmt.Errorf("%w : unknown version %d", ErrManifestCorrupted, version)
+	}
+	if len(buffer) < size {
+		return nil, fmt.Errorf("%w : expected %d bytes found %d", ErrManifestCorrupted, size, len(buffer))
+	}
+	crcBuffer := make([]byte, 4)
+	checksums.CalculateCRC(crcBuffer, buffer[4:size])
+	if !checksums.CompareCRC(crcBuffer, buffer[0:4]) {
+		return nil, fmt.Errorf("%w : CRC mismatch", ErrManifestCorrupted)
+	}
+	m := &Manifest{
+		FormatVersion:       version,
+		PageSizeByte:        binary.BigEndian.Uint32(buffer[8:12]),
+		MaxHeapFileSizeByte: binary.BigEndian.Uint32(buffer[12:16]),
+		// v1 manifests predate pluggable checksums
+		ChecksumAlgorithm: checksums.CRC32IEEE,
+	}
+	copy(m.CreationUUID[:], buffer[16:32])
+	if version >= 2 {
+		m.ChecksumAlgorithm = checksums.Algorithm(buffer[32])
+	}
+	return m, nil
+}
+
+// ReadManifest loads the manifest of a heap directory without opening the heap
+func ReadManifest(directory string) (*Manifest, error) {
+	buffer, err := os.ReadFile(filepath.Join(directory, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	return deserializeManifest(buffer)
+}
+
+func writeManifest(directory string, m *Manifest) error {
+	path := filepath.Join(directory, manifestFileName)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(m.serialize()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDirectory(directory)
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (m *Manifest) validate(option *HeapFileOptions) error {
+	if m.PageSizeByte != option.PageSizeByte {
+		return fmt.Errorf("%w : page size is %d bytes in manifest %s but options ask for %d bytes", ErrManifestMismatch, m.PageSizeByte, m.UUID(), option.PageSizeByte)
+	}
+	if m.MaxHeapFileSizeByte != option.MaxHeapFileSizeByte {
+		return fmt.Errorf("%w : max heap file size is %d bytes in manifest %s but options ask for %d bytes", ErrManifestMismatch, m.MaxHeapFileSizeByte, m.UUID(), option.MaxHeapFileSizeByte)
+	}
+	if m.ChecksumAlgorithm != option.ChecksumAlgorithm {
+		return fmt.Errorf("%w : checksum algorithm is %s in manifest %s but options ask for %s", ErrManifestMismatch, m.ChecksumAlgorithm, m.UUID(), option.ChecksumAlgorithm)
+	}
+	return nil
+}
+
+/*
+Loads the manifest and checks the options against it.
+Directories without one get a manifest built from the options , if heap
+files already exist (created before manifests) their headers are checked
+against the options first , a mismatch is refused instead of being pinned.
+*/
+func loadOrCreateManifest(logger log.Logger, option *HeapFileOptions) (*Manifest, error) {
+	if _, err := checksums.Get(option.ChecksumAlgorithm); err != nil {
+		return nil, err
+	}
+
+	m, err := ReadManifest(option.FileDirectory)
+
+	if err == nil {
+		if err := m.validate(option); err != nil {
+			return nil, err
+		}
+		if m.FormatVersion < manifestVersion && option.UpgradeFormatOnOpen {
+			if err := writeManifest(option.FileDirectory, m); err != nil {
+				return nil, err
+			}
+			m.FormatVersion = manifestVersion
+		}
+		return m, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		logger.Error().Err(err).Msg("Failed to read heap manifest")
+		return nil, err
+	}
+
+	existing, err := filepath.Glob(filepath.Join(option.FileDirectory, heapFileNamePrefix+heapfileNameSepparate+"*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) != 0 {
+		if err := validateHeapHeaders(existing, option); err != nil {
+			logger.Error().Err(err).Msg(fmt.Sprintf("Heap directory %s has no manifest and its heap files do not match the options", option.FileDirectory))
+			return nil, err
+		}
+		logger.Warn().Msg(fmt.Sprintf("Heap directory %s has no manifest , recording current options", option.FileDirectory))
+	}
+
+	m, err = newManifest(option)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeManifest(option.FileDirectory, m); err != nil {
+		logger.Error().Err(err).Msg("Failed to write heap manifest")
+		return nil, err
+	}
+	logger.Info().Msg(fmt.Sprintf("Created heap manifest %s", m.UUID()))
+
+	return m, nil
+}
+
+/*
+Checks heap files written before manifests against the options
+  - v1+ headers record the free list page count , it follows from the page size and max heap file size
+  - every version records the page count , it can not exceed a heap file of the option size
+  - the raw fields are read , the header checksum itself is left to openHeap
+*/
+func validateHeapHeaders(paths []string, option *HeapFileOptions) error {
+	buffer := make([]byte, headerChecksumOffset)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(file, buffer)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%w : heap file %s has no readable header : %v", ErrManifestMismatch, filepath.Base(path), err)
+		}
+
+		pageCount := binary.BigEndian.Uint32(buffer[4:8])
+		if pageCount > totalPagesInHeapFile(option) {
+			return fmt.Errorf("%w : heap file %s has %d pages , options allow %d", ErrManifestMismatch, filepath.Base(path), pageCount, totalPagesInHeapFile(option))
+		}
+
+		// v0 has no version field , an unsupported value is treated the same way openHeap does
+		version := readHeaderVersion(buffer)
+		if version < heapFileFormatV1 || !isSupportedFormat(version) {
+			continue
+		}
+		freeListPages := binary.BigEndian.Uint32(buffer[headerFreeListPagesOffset : headerFreeListPagesOffset+4])
+		if freeListPages != freeListPageCount(option) {
+			return fmt.Errorf("%w : heap file %s has %d free list pages , options expect %d", ErrManifestMismatch, filepath.Base(path), freeListPages, freeListPageCount(option))
+		}
+	}
+	return nil
+}
+
+// manifest recording the options , with a fresh creation uuid
+func newManifest(option *HeapFileOptions) (*Manifest, error) {
+	m := &Manifest{
+		FormatVersion:       manifestVersion,
+		PageSizeByte:        option.PageSizeByte,
+		MaxHeapFileSizeByte: option.MaxHeapFileSizeByte,
+		ChecksumAlgorithm:   option.ChecksumAlgorithm,
+	}
+	if _, err := rand.Read(m.CreationUUID[:]); err != nil {
+		return nil, err
+	}
+	// uuid v4 layout
+	m.CreationUUID[6] = (m.CreationUUID[6] & 0x0f) | 0x40
+	m.CreationUUID[8] = (m.CreationUUID[8] & 0x3f) | 0x80
+	return m, nil
+}
@@ -0,0 +1,144 @@
+package heap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/phuslu/log"
+)
+
+var ErrHeapFileMissing = fmt.Errorf("heap file missing")
+
+type Placement uint8
+
+const (
+	// heap file n goes to directory n % len(directories)
+	PlacementRoundRobin Placement = iota
+	// a new heap file goes to the directory with the most available bytes
+	PlacementCapacityWeighted
+)
+
+func (p Placement) String() string {
+	switch p {
+	case PlacementRoundRobin:
+		return "round-robin"
+	case PlacementCapacityWeighted:
+		return "capacity-weighted"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(p))
+}
+
+/*
+Heap directories (tablespaces)
+┌─────────────────────┐ ┌─────────────────────┐ ┌─────────────────────┐
+| FileDirectory       | | Directories[0]      | | Directories[1]      |
+| LOCK MANIFEST       | | LOCK                | | LOCK                |
+| FREELIST-JOURNAL .. | |                     | |                     |
+| heapFile-0          | | heapFile-16         | | heapFile-32         |
+| heapFile-48         | | ......              | | ......              |
+└─────────────────────┘ └─────────────────────┘ └─────────────────────┘
+  - one address space spread over several volumes , FileDirectory always takes part
+    and is the only one holding the manifest / journals
+  - a heap file never moves once created , the placement policy only picks where new files go
+  - every directory is locked while the heap is open , a directory belongs to a single heap
+  - opening scans all directories , a file found twice or a hole in the address space
+    (a directory left out of the options) fails the open instead of silently losing pages
+*/
+func heapDirectories(option *HeapFileOptions) []string {
+	directories := []string{filepath.Clean(option.FileDirectory)}
+	seen := map[string]bool{directories[0]: true}
+	for _, directory := range option.Directories {
+		directory = filepath.Clean(directory)
+		if !seen[directory] {
+			seen[directory] = true
+			directories = append(directories, directory)
+		}
+	}
+	return directories
+}
+
+func (hpm *heapfilemeta) path() string {
+	return filepath.Join(hpm.directory, heapFileName(hpm.addressSpaceStart))
+}
+
+// directory for the heap file starting at addressSpaceStart , caller must hold the heapFileLock
+func (fsh *fileSystemHeap) placeHeapFile(addressSpaceStart uint64) string {
+	directories := heapDirectories(fsh.option)
+	if fsh.option.Placement == PlacementCapacityWeighted {
+		best, bestAvailable := directories[0], uint64(0)
+		for _, directory := range directories {
+			var stat syscall.Statfs_t
+			if err := syscall.Statfs(directory, &stat); err != nil {
+				fsh.logger.Warn().Err(err).Msg(fmt.Sprintf("Failed to statfs heap directory %s", directory))
+				continue
+			}
+			if available := stat.Bavail * uint64(stat.Bsize); available > bestAvailable {
+				best, bestAvailable = directory, available
+			}
+		}
+		return best
+	}
+	fileNumber := addressSpaceStart / uint64(fsh.maxTotalPagesInHeapFile)
+	return directories[fileNumber%uint64(len(directories))]
+}
+
+// path of an existing heap file , empty when no directory has it
+func findHeapFile(option *HeapFileOptions, addressSpaceStart uint64) string {
+	for _, directory := range heapDirectories(option) {
+		path := filepath.Join(directory, heapFileName(addressSpaceStart))
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func createHeapDirectories(logger log.Logger, option *HeapFileOptions) error {
+	for _, directory := range heapDirectories(option) {
+		if _, err := os.Stat(directory); err == nil {
+			continue
+		}
+		logger.Info().Msg(fmt.Sprintf("Creating heap file directory %s", directory))
+		if err := os.Mkdir(directory, os.ModePerm); err != nil {
+			logger.Error().Err(err).Msg(fmt.Sprintf("Failed to create heap file directory %s", directory))
+			return err
+		}
+	}
+	return nil
+}
+
+// locks every directory or none
+func acquireDirectoryLocks(directories []string) ([]*directoryLock, error) {
+	locks := make([]*directoryLock, 0, len(directories))
+	for _, directory := range directories {
+		lock, err := acquireDirectoryLock(directory)
+		if err != nil {
+			releaseDirectoryLocks(locks)
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+func releaseDirectoryLocks(locks []*directoryLock) error {
+	var err error
+	for _, lock := range locks {
+		err = errors.Join(err, lock.release())
+	}
+	return err
+}
+
+// the address space must have no holes , files in between may only be missing if a directory is
+func checkHeapFilesContiguous(files []*heapfilemeta, maxPages uint32) error {
+	for i := 1; i < len(files); i++ {
+		expected := files[i-1].addressSpaceStart + uint64(maxPages)
+		if files[i].addressSpaceStart != expected {
+			return fmt.Errorf("%w : %s follows %s , %s is in none of the heap directories", ErrHeapFileMissing, files[i].path(), files[i-1].path(), heapFileName(expected))
+		}
+	}
+	return nil
+}
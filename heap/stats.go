@@ -0,0 +1,93 @@
+package heap
+
+import (
+	"fmt"
+	"syscall"
+)
+
+var ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+
+/*
+Capacity of a heap directory
+  - FileBytes is the apparent size of the heap files (meta + pages) , the quota is checked against it
+  - BytesOnDisk is what the filesystem actually allocated , less than FileBytes with punched / compressed pages
+  - FragmentationRatio is 1 - largest free run / free pages
+    0 when the free pages form a single run (or there are none) , close to 1 when they are scattered
+*/
+type Stats struct {
+	TotalPages         uint64
+	AllocatedPages     uint64
+	FreePages          uint64
+	FileCount          int
+	FileBytes          uint64
+	BytesOnDisk        uint64
+	FragmentationRatio float64
+	QuotaBytes         uint64 // 0 means no quota
+}
+
+func (fsh *fileSystemHeap) Stats() (Stats, error) {
+	fsh.heapFileLock.RLock()
+	defer fsh.heapFileLock.RUnlock()
+	if fsh.closed {
+		return Stats{}, ErrClosed
+	}
+
+	stats := Stats{
+		FreePages:  fsh.freePages,
+		FileCount:  len(fsh.fileIdentifiers),
+		QuotaBytes: fsh.option.QuotaBytes,
+	}
+	largestFreeRun := uint64(0)
+	for _, hpf := range fsh.fileIdentifiers {
+		stats.TotalPages += uint64(hpf.pageCount)
+		stats.FileBytes += uint64(hpf.SizeWithMetaBytes())
+
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(hpf.fd, &stat); err != nil {
+			fsh.logger.Error().Err(err).Msg(fmt.Sprintf("Failed to stat heap file %d", hpf.addressSpaceStart))
+			return Stats{}, err
+		}
+		// Blocks are 512 byte units
+		stats.BytesOnDisk += uint64(stat.Blocks) * 512
+
+		// free runs end at free list page boundaries like the runs MallocContiguous can hand out
+		for _, freeList := range hpf.freelist {
+			if freeList.TotalFreeLocs() <= largestFreeRun {
+				continue
+			}
+			run := uint64(0)
+			for loc := uint64(0); loc < uint64(fsh.option.PageSizeByte)*8; loc++ {
+				if !freeList.IsLocFree(loc) {
+					run = 0
+					continue
+				}
+				run++
+				largestFreeRun = max(largestFreeRun, run)
+			}
+		}
+	}
+	stats.AllocatedPages = stats.TotalPages - stats.FreePages
+	if stats.FreePages != 0 {
+		stats.FragmentationRatio = 1 - float64(largestFreeRun)/float64(stats.FreePages)
+	}
+	return stats, nil
+}
+
+/*
+apparent bytes the heap files take after extending by pageCount pages
+the last file is topped up first , the rest goes to new files which each bring their meta
+caller must hold the heapFileLock
+*/
+func (fsh *fileSystemHeap) fileBytesAfterExtend(pageCount uint64) uint64 {
+	bytes := uint64(0)
+	for _, hpf := range fsh.fileIdentifiers {
+		bytes += uint64(hpf.SizeWithMetaBytes())
+	}
+	bytes += pageCount * uint64(fsh.option.PageSizeByte)
+
+	lastHeapFile := fsh.fileIdentifiers[len(fsh.fileIdentifiers)-1]
+	room := uint64(fsh.maxTotalPagesInHeapFile) - uint64(lastHeapFile.pageCount)
+	remaining := pageCount - min(room, pageCount)
+	newFiles := (remaining + uint64(fsh.maxTotalPagesInHeapFile) - 1) / uint64(fsh.maxTotalPagesInHeapFile)
+	return bytes + newFiles*uint64(fsh.heapMetaSize)
+}
@@ -5,11 +5,17 @@ import (
 	"boro-db/heap"
 	"boro-db/logging"
 	"boro-db/paging"
+	"context"
+	"os"
 )
 
 func main() {
 	logger := logging.CreateDebugLogger()
 
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsck(logger, os.Args[2:]))
+	}
+
 	heapFileOptions := heap.HeapFileOptions{
 		PageSizeByte:        4096,
 		FileDirectory:       "./test",
@@ -31,6 +37,7 @@ func main() {
 		logger.Error().Err(err).Msg("failed to create filesystem")
 		return
 	}
+	defer fs.Close(context.Background())
 
 	pages, err := fs.Malloc(1)
 
@@ -39,15 +46,26 @@ func main() {
 		return
 	}
 
-	fs.Write(pages[0], func(p *paging.Page, err error) {
-		p.SetPageBuffer(0, []byte("hello world"), 0)
+	ctx := context.Background()
+
+	err = fs.WriteContext(ctx, pages[0], func(p *paging.Page) error {
+		return p.SetPageBuffer(0, []byte("hello world"), 0)
 	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to write page")
+		return
+	}
 
-	fs.Read(pages[0], func(p *paging.Page, err error) {
-		p.GetPageBuffer(func(b []byte) {
-			logger.Info().Msg(string(b))
-		})
+	page, err := fs.ReadContext(ctx, pages[0])
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read page")
+		return
+	}
+	page.GetPageBuffer(func(b []byte) {
+		logger.Info().Msg(string(b))
 	})
 
-	fs.Flush()
+	if err := fs.FlushContext(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to flush")
+	}
 }
@@ -0,0 +1,117 @@
+package paging
+
+import (
+	"sort"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+/*
+Background writer
+- wakes up on every flush tick and looks at the dirty page ratio (dirty pages / cache size)
+- does nothing while the ratio is below the high watermark
+- once above, writes dirty pages oldest LSN first until the ratio drops to the low watermark
+- writes are paced by a MB/s limit so a flush burst does not hog the disk
+*/
+// pages written per batch , also the granularity of the double write buffer fsyncs
+const backgroundWriterBatchSize = doubleWriteBatchPages
+
+type backgroundWriter struct {
+	logger  log.Logger
+	ps      *pageSystem
+	high    float64
+	low     float64
+	limiter *rateLimiter
+}
+
+func newBackgroundWriter(logger log.Logger, ps *pageSystem) *backgroundWriter {
+	return &backgroundWriter{
+		logger:  logger,
+		ps:      ps,
+		high:    ps.options.DirtyPageHighWatermark,
+		low:     ps.options.DirtyPageLowWatermark,
+		limiter: newRateLimiter(ps.options.BackgroundWriterRateLimitMBps),
+	}
+}
+
+func (bw *backgroundWriter) dirtyRatio() float64 {
+	if bw.ps.options.PageBufferCacheSize <= 0 {
+		return 0
+	}
+	return float64(bw.ps.dirtyPages.Load()) / float64(bw.ps.options.PageBufferCacheSize)
+}
+
+func (bw *backgroundWriter) run() {
+
+	if bw.ps.dirtyPages.Load() == 0 || bw.dirtyRatio() < bw.high {
+		return
+	}
+
+	// only collect under the cache lock, writes happen outside of it
+	// the LSN is read under the page lock , writers keep moving it while we sort
+	candidates := make([]*Page, 0, bw.ps.dirtyPages.Load())
+	lsns := make(map[*Page]uint32)
+	bw.ps.cache.Range(func(u uint64, pfb *Page) bool {
+		pfb.mutex.RLock()
+		if pfb.dirty.Load() {
+			candidates = append(candidates, pfb)
+			lsns[pfb] = pfb.currentLSN
+		}
+		pfb.mutex.RUnlock()
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return lsns[candidates[i]] < lsns[candidates[j]]
+	})
+
+	bw.limiter.reset()
+	written := 0
+	for len(candidates) != 0 {
+		// write just enough to get back to the low watermark
+		excess := int(bw.ps.dirtyPages.Load() - int64(bw.low*float64(bw.ps.options.PageBufferCacheSize)))
+		if excess <= 0 {
+			break
+		}
+		batch := candidates[:min(excess, backgroundWriterBatchSize, len(candidates))]
+		candidates = candidates[len(batch):]
+
+		n, err := bw.ps.writeIfDirty(batch)
+		if err != nil {
+			bw.logger.Error().Err(err).Msg("background writer failed flushing pages")
+		}
+		written += n / int(bw.ps.options.PageSizeByte)
+		bw.limiter.wait(n)
+	}
+	bw.logger.Debug().Msgf("background writer flushed %d pages", written)
+}
+
+// paces writes to a fixed number of bytes per second over one writer run
+type rateLimiter struct {
+	bytesPerSecond float64
+	start          time.Time
+	bytes          int64
+}
+
+func newRateLimiter(mbps int) *rateLimiter {
+	return &rateLimiter{
+		bytesPerSecond: float64(mbps) * 1024 * 1024,
+	}
+}
+
+func (rl *rateLimiter) reset() {
+	rl.start = time.Now()
+	rl.bytes = 0
+}
+
+func (rl *rateLimiter) wait(n int) {
+	if rl.bytesPerSecond <= 0 {
+		return
+	}
+	rl.bytes += int64(n)
+	expected := time.Duration(float64(rl.bytes) / rl.bytesPerSecond * float64(time.Second))
+	if elapsed := time.Since(rl.start); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+}
@@ -0,0 +1,152 @@
+package paging
+
+import (
+	"boro-db/heap"
+	"boro-db/logging"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackgroundWriterWatermarks(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 8,
+	}
+	heapFile, err := heap.NewHeap(*logging.CreateDebugLogger(), &heapOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(8))
+	pageNumbers, err := heapFile.Malloc(8)
+	assert.Nil(t, err)
+
+	ps, err := NewPageSystem(*logging.CreateDebugLogger(), heapFile, PageSystemOption{
+		HeapFileOptions:              heapOptions,
+		PageBufferCacheSize:          8,
+		BufferPoolEvictionIntervalms: 3600 * 1000,
+		BufferPoolFlushIntervalms:    3600 * 1000,
+		DirtyPageHighWatermark:       0.5,
+		DirtyPageLowWatermark:        0.25,
+	})
+	assert.Nil(t, err)
+	pageSys := ps.(*pageSystem)
+
+	pages := make([]*Page, 0, len(pageNumbers))
+	for _, pageNumber := range pageNumbers {
+		ps.ReadPage(pageNumber, func(p *Page, err error) {
+			assert.Nil(t, err)
+			pages = append(pages, p)
+		})
+	}
+
+	// below the high watermark nothing gets written
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, pages[i].SetPageBuffer(0, []byte("hello"), uint32(10-i)))
+	}
+	pageSys.bgWriter.run()
+	assert.Equal(t, int64(3), pageSys.dirtyPages.Load())
+
+	for i := 3; i < 6; i++ {
+		assert.Nil(t, pages[i].SetPageBuffer(0, []byte("hello"), uint32(10-i)))
+	}
+	pageSys.bgWriter.run()
+
+	// oldest LSNs go first, the two newest stay dirty
+	assert.Equal(t, int64(2), pageSys.dirtyPages.Load())
+	assert.True(t, pages[0].dirty.Load())
+	assert.True(t, pages[1].dirty.Load())
+	for i := 2; i < 6; i++ {
+		assert.False(t, pages[i].dirty.Load())
+	}
+
+	assert.Nil(t, pages[0].SetPageBuffer(0, []byte("hello"), 11))
+	assert.Nil(t, ps.Close(context.Background()))
+	assert.Equal(t, int64(0), pageSys.dirtyPages.Load())
+	assert.ErrorIs(t, ps.Flush(), ErrClosed)
+	assert.Nil(t, heapFile.Close(context.Background()))
+}
+
+func TestConcurrentFlushers(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-flushers")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+	}
+	heapFile, err := heap.NewHeap(*logging.CreateDebugLogger(), &heapOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, heapFile.ExtendBy(16))
+	pageNumbers, err := heapFile.Malloc(16)
+	assert.Nil(t, err)
+
+	ps, err := NewPageSystem(*logging.CreateDebugLogger(), heapFile, PageSystemOption{
+		HeapFileOptions:              heapOptions,
+		PageBufferCacheSize:          16,
+		BufferPoolEvictionIntervalms: 3600 * 1000,
+		BufferPoolFlushIntervalms:    3600 * 1000,
+		EnablePageMeta:               true,
+	})
+	assert.Nil(t, err)
+	pageSys := ps.(*pageSystem)
+
+	ctx := context.Background()
+	pages := make([]*Page, 0, len(pageNumbers))
+	for _, pageNumber := range pageNumbers {
+		page, err := ps.ReadPageContext(ctx, pageNumber)
+		assert.Nil(t, err)
+		pages = append(pages, page)
+	}
+
+	// writers , Flush , single page flushes and the background writer all overlap
+	// every page has to be counted clean exactly once
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				page := pages[(w*7+i)%len(pages)]
+				assert.Nil(t, page.SetPageBuffer(0, []byte{byte(w), byte(i)}, uint32(i)))
+				switch w {
+				case 0:
+					assert.Nil(t, ps.Flush())
+				case 1:
+					pageSys.bgWriter.run()
+				case 2:
+					assert.Nil(t, ps.FlushPageBlockContext(ctx, page))
+				case 3:
+					_, err := pageSys.writeIfDirty(pages)
+					assert.Nil(t, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Nil(t, ps.Flush())
+	assert.Equal(t, int64(0), pageSys.dirtyPages.Load())
+	for _, page := range pages {
+		assert.False(t, page.dirty.Load())
+	}
+	assert.Nil(t, ps.Close(ctx))
+	assert.Nil(t, heapFile.Close(context.Background()))
+}
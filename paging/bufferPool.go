@@ -3,8 +3,15 @@ package paging
 import (
 	"boro-db/heap"
 	"boro-db/utils/cache"
+	"boro-db/utils/checksums"
+	"boro-db/utils/future"
+	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/phuslu/log"
@@ -19,12 +26,29 @@ What is a buffer pool or paging system for us
 - pageBlock = page + metadata
 - page = 4kb which is a OS / Hardware standard. this is also what our WAL logs will posibly follow
 */
+// shared with heap so callers can check errors.Is(err, ErrClosed) at any layer
+var ErrClosed = heap.ErrClosed
+
 type PageSystemOption struct {
 	heap.HeapFileOptions
 	PageBufferCacheSize          int
 	BufferPoolEvictionIntervalms int
 	BufferPoolFlushIntervalms    int
 	EnablePageMeta               bool
+
+	// background writer wakes up every BufferPoolFlushIntervalms and starts writing
+	// once dirty pages / PageBufferCacheSize goes above DirtyPageHighWatermark
+	// it keeps writing (oldest LSN first) until the ratio drops to DirtyPageLowWatermark
+	// leaving both at 0 flushes every dirty page on each tick
+	DirtyPageHighWatermark float64
+	DirtyPageLowWatermark  float64
+	// caps the background writer throughput so flush bursts don't starve foreground I/O
+	// 0 means no limit
+	BackgroundWriterRateLimitMBps int
+
+	// write every flushed batch to a double write file before writing it in place
+	// protects against torn pages , requires EnablePageMeta to detect them
+	EnableDoubleWrite bool
 }
 
 type PageSystem interface {
@@ -50,16 +74,71 @@ type PageSystem interface {
 		- Flush all the pages in the buffer pool force flush
 	*/
 	Flush() error
+
+	/*
+		- blocking variants of the above returning (value, error)
+		- a context done before the call starts it returns ctx.Err() , a started call always runs to its result
+		- FlushContext stops picking up new dirty pages once the context is done
+	*/
+	ReadPageContext(ctx context.Context, pageNumber uint64) (*Page, error)
+	FlushPageBlockContext(ctx context.Context, pfb *Page) error
+	FlushContext(ctx context.Context) error
+
+	// async variant of ReadPage
+	ReadPageAsync(pageNumber uint64) *future.Future[*Page]
+
+	/*
+		- with EnablePageMeta every page read from disk has its checksum verified
+		- mismatching pages are never cached , the read fails with *ErrPageCorrupted
+		- and the page number is kept here until a later read verifies fine again
+	*/
+	Quarantined() []uint64
+
+	/*
+		- drops the cached copies of the pages , dirty changes are discarded
+		- for pages that were freed or moved on disk under the page system
+	*/
+	Invalidate(pageNumbers []uint64)
+
+	// usable bytes of a page , Page.Size() without reading one
+	PageSize() int
+
+	/*
+		- stops the eviction / background writer goroutine
+		- flushes every dirty page still in the buffer pool
+		- the heap file is not closed, whoever created it owns it
+		- until the flush went through it is not closed , Close can be called again
+	*/
+	Close(ctx context.Context) error
 }
 
 type pageSystem struct {
-	heapfs  heap.HeapFile
-	options PageSystemOption
-	cache   cache.Cache[uint64, *Page]
+	heapfs     heap.HeapFile
+	options    PageSystemOption
+	cache      cache.Cache[uint64, *Page]
+	dirtyPages *atomic.Int64
+	bgWriter   *backgroundWriter
+	closed     atomic.Bool
+	stop       chan struct{}
+	stopped    chan struct{}
+	// Close can be retried , one attempt at a time
+	closeLock sync.Mutex
+	stopOnce  sync.Once
+
+	quarantineLock sync.Mutex
+	quarantine     map[uint64]struct{}
+
+	// nil unless EnableDoubleWrite
+	doubleWrite *doubleWriteBuffer
 }
 
 func (ps *pageSystem) ReadPage(pageNumber uint64, onRead func(*Page, error)) {
 
+	if ps.closed.Load() {
+		onRead(nil, ErrClosed)
+		return
+	}
+
 	pfb, ok := ps.cache.Get(pageNumber)
 
 	if ok {
@@ -73,58 +152,233 @@ func (ps *pageSystem) ReadPage(pageNumber uint64, onRead func(*Page, error)) {
 	// expand the array judiciously not at once
 	// use the PageFileBlock to create a free size list which always points to first free block
 	pfb = &Page{
-		pageNumber:      pageNumber,
-		buffer:          make([]byte, ps.options.PageSizeByte),
-		pageMetaEnabled: ps.options.EnablePageMeta,
+		pageNumber:        pageNumber,
+		buffer:            make([]byte, ps.options.PageSizeByte),
+		pageMetaEnabled:   ps.options.EnablePageMeta,
+		checksumAlgorithm: ps.options.ChecksumAlgorithm,
+		dirtyPages:        ps.dirtyPages,
 	}
 	ps.heapfs.Read(pageNumber, pfb.buffer, func(err error) {
 		if err != nil {
 			onRead(nil, err)
+			return
+		}
+		if !pfb.CheckCRCMatch() {
+			log.Error().Msg(fmt.Sprintf("checksum mismatch reading page : %d , quarantined", pageNumber))
+			ps.setQuarantined(pageNumber, true)
+			onRead(nil, &ErrPageCorrupted{PageNumber: pageNumber})
+			return
 		}
+		ps.setQuarantined(pageNumber, false)
 		ps.cache.Put(pageNumber, pfb)
 		onRead(pfb, nil)
 	})
 }
 
+func (ps *pageSystem) setQuarantined(pageNumber uint64, corrupted bool) {
+	ps.quarantineLock.Lock()
+	defer ps.quarantineLock.Unlock()
+	if corrupted {
+		ps.quarantine[pageNumber] = struct{}{}
+	} else {
+		delete(ps.quarantine, pageNumber)
+	}
+}
+
+func (ps *pageSystem) Quarantined() []uint64 {
+	ps.quarantineLock.Lock()
+	defer ps.quarantineLock.Unlock()
+	pages := make([]uint64, 0, len(ps.quarantine))
+	for pageNumber := range ps.quarantine {
+		pages = append(pages, pageNumber)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return pages
+}
+
+func (ps *pageSystem) Invalidate(pageNumbers []uint64) {
+	for _, pageNumber := range pageNumbers {
+		ps.cache.Evict(pageNumber, func(pfb *Page) bool {
+			pfb.mutex.Lock()
+			defer pfb.mutex.Unlock()
+			pfb.markClean()
+			return true
+		})
+		ps.setQuarantined(pageNumber, false)
+	}
+}
+
+func (ps *pageSystem) PageSize() int {
+	if ps.options.EnablePageMeta {
+		return int(ps.options.PageSizeByte) - pageMetaSize(ps.options.ChecksumAlgorithm)
+	}
+	return int(ps.options.PageSizeByte)
+}
+
+func (ps *pageSystem) ReadPageContext(ctx context.Context, pageNumber uint64) (*Page, error) {
+	return future.Await(ctx, func(onRead func(*Page, error)) {
+		ps.ReadPage(pageNumber, onRead)
+	})
+}
+
+func (ps *pageSystem) ReadPageAsync(pageNumber uint64) *future.Future[*Page] {
+	return future.FromCallback(func(onRead func(*Page, error)) {
+		ps.ReadPage(pageNumber, onRead)
+	})
+}
+
 func (ps *pageSystem) FlushPageBlock(pfb *Page, onWrite func(error)) {
-	pfb.mutex.RLock()
-	defer pfb.mutex.RUnlock()
-	ps.heapfs.Write(pfb.pageNumber, pfb.serialize(), func(err error) {
-		if err != nil {
-			onWrite(err)
-		}
-		onWrite(nil)
+	if ps.closed.Load() {
+		onWrite(ErrClosed)
+		return
+	}
+	pages := lockDirty([]*Page{pfb})
+	defer unlockFlushed(pages)
+	onWrite(ps.writePages(pages))
+}
+
+func (ps *pageSystem) FlushPageBlockContext(ctx context.Context, pfb *Page) error {
+	_, err := future.Await(ctx, func(onWrite func(struct{}, error)) {
+		ps.FlushPageBlock(pfb, func(err error) {
+			onWrite(struct{}{}, err)
+		})
 	})
+	return err
 }
 
 func (ps *pageSystem) Flush() error {
-	var flushWg sync.WaitGroup
+	return ps.FlushContext(context.Background())
+}
+
+func (ps *pageSystem) FlushContext(ctx context.Context) error {
+	if ps.closed.Load() {
+		return ErrClosed
+	}
+	return ps.flush(ctx)
+}
+
+func (ps *pageSystem) flush(ctx context.Context) error {
+	var flushErr error
+	candidates := make([]*Page, 0, ps.dirtyPages.Load())
 	ps.cache.Range(func(u uint64, pfb *Page) bool {
+		if err := ctx.Err(); err != nil {
+			flushErr = err
+			return false
+		}
+		if pfb.dirty.Load() {
+			candidates = append(candidates, pfb)
+		}
+		return true
+	})
+
+	pages := lockDirty(candidates)
+	flushErr = errors.Join(flushErr, ps.writePages(pages))
+	unlockFlushed(pages)
+	return flushErr
+}
+
+// writes the given pages if they are still dirty , used by the background writer
+// returns the number of bytes written
+func (ps *pageSystem) writeIfDirty(candidates []*Page) (int, error) {
+	pages := lockDirty(candidates)
+	err := ps.writePages(pages)
+	unlockFlushed(pages)
+	return len(pages) * int(ps.options.PageSizeByte), err
+}
+
+/*
+locks the candidates that are still dirty for writing them out
+- flush lock first , only one flusher serializes and cleans a page at a time
+- then the read lock , reads go on but writes wait until the page is on disk
+- pages are locked in page number order so concurrent flushers never wait on each other in a cycle
+- release with unlockFlushed
+*/
+func lockDirty(candidates []*Page) []*Page {
+	sorted := slices.Clone(candidates)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].pageNumber < sorted[j].pageNumber })
+	pages := make([]*Page, 0, len(sorted))
+	for _, pfb := range sorted {
+		pfb.flushLock.Lock()
 		pfb.mutex.RLock()
-		if pfb.dirty {
-			// if dirty , do not wait for the write op to complete
-			// increment semaphor
-			// start page write op in disk
-			// don't unlock the mutex until the write is complete (its a read lock so all reads are still allowed)
-			// writes would be blocked (internally dity is set to false and writes turn dirty to true)
-			// we unlock only once write is complete
-
-			flushWg.Add(1)
-			ps.heapfs.Write(pfb.pageNumber, pfb.serialize(), func(err error) {
-				if err != nil {
-					log.Error().Err(err).Msg(fmt.Sprintf("error flushing page : %d", pfb.pageNumber))
-				} else {
-					pfb.dirty = false
-				}
-				pfb.mutex.RUnlock()
-				flushWg.Done()
-			})
-			return true
+		if pfb.dirty.Load() {
+			pages = append(pages, pfb)
+			continue
 		}
 		pfb.mutex.RUnlock()
-		return true
+		pfb.flushLock.Unlock()
+	}
+	return pages
+}
+
+func unlockFlushed(pages []*Page) {
+	for _, pfb := range pages {
+		pfb.mutex.RUnlock()
+		pfb.flushLock.Unlock()
+	}
+}
+
+/*
+Every flush path ends up here
+- callers hold the flush lock and read lock of every page (see lockDirty)
+- pages go through the double write buffer first when enabled
+- a page is marked clean only once its in place write succeeded
+*/
+func (ps *pageSystem) writePages(pages []*Page) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	buffers := make([][]byte, len(pages))
+	for i, pfb := range pages {
+		buffers[i] = pfb.serialize()
+	}
+	if ps.doubleWrite != nil {
+		return ps.doubleWrite.write(pages, buffers, ps.writeInPlace)
+	}
+	return ps.writeInPlace(pages, buffers)
+}
+
+func (ps *pageSystem) writeInPlace(pages []*Page, buffers [][]byte) error {
+	var writeErr error
+	for i, pfb := range pages {
+		ps.heapfs.Write(pfb.pageNumber, buffers[i], func(err error) {
+			if err != nil {
+				log.Error().Err(err).Msg(fmt.Sprintf("error flushing page : %d", pfb.pageNumber))
+				writeErr = errors.Join(writeErr, fmt.Errorf("flushing page %d : %w", pfb.pageNumber, err))
+				return
+			}
+			pfb.markClean()
+		})
+	}
+	return writeErr
+}
+
+/*
+- the page system only counts as closed once every dirty page is flushed
+- a Close that runs out of time (or fails flushing) leaves it open , call Close again to finish
+*/
+func (ps *pageSystem) Close(ctx context.Context) error {
+	ps.closeLock.Lock()
+	defer ps.closeLock.Unlock()
+	if ps.closed.Load() {
+		return ErrClosed
+	}
+
+	ps.stopOnce.Do(func() {
+		close(ps.stop)
 	})
-	flushWg.Wait()
+	select {
+	case <-ps.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := ps.flush(ctx); err != nil {
+		return err
+	}
+	ps.closed.Store(true)
+	if ps.doubleWrite != nil {
+		return ps.doubleWrite.close()
+	}
 	return nil
 }
 
@@ -135,22 +389,65 @@ PageSystem gives heapfile page block structure
 */
 func NewPageSystem(logger log.Logger, heapfs heap.HeapFile, options PageSystemOption) (PageSystem, error) {
 
+	if options.DirtyPageLowWatermark < 0 || options.DirtyPageHighWatermark > 1 || options.DirtyPageLowWatermark > options.DirtyPageHighWatermark {
+		return nil, fmt.Errorf("invalid dirty page watermarks low : %f high : %f", options.DirtyPageLowWatermark, options.DirtyPageHighWatermark)
+	}
+
+	if options.EnablePageMeta {
+		// checked once here , page checksums are calculated on every flush
+		if _, err := checksums.Get(options.ChecksumAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.EnableDoubleWrite && !options.EnablePageMeta {
+		return nil, fmt.Errorf("double write buffer requires EnablePageMeta to detect torn pages")
+	}
+
 	cache := cache.NewLRUCache[uint64, *Page](options.PageBufferCacheSize)
 	ps := &pageSystem{
 		heapfs: heapfs,
 
-		options: options,
-		cache:   cache,
+		options:    options,
+		cache:      cache,
+		dirtyPages: &atomic.Int64{},
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		quarantine: make(map[uint64]struct{}),
 	}
+	ps.bgWriter = newBackgroundWriter(logger, ps)
+
+	if options.EnableDoubleWrite {
+		doubleWrite, err := openDoubleWriteBuffer(options.FileDirectory, int(options.PageSizeByte), options.ChecksumAlgorithm, options.KeyProvider)
+		if err != nil {
+			logger.Error().Err(err).Msg("error opening double write buffer")
+			return nil, err
+		}
+		restored, err := doubleWrite.recover(logger, heapfs)
+		if err != nil {
+			logger.Error().Err(err).Msg("error recovering from double write buffer")
+			doubleWrite.close()
+			return nil, err
+		}
+		if len(restored) != 0 {
+			logger.Info().Msg(fmt.Sprintf("restored %d torn pages from double write buffer", len(restored)))
+		}
+		ps.doubleWrite = doubleWrite
+	}
+
 	go func() {
+		defer close(ps.stopped)
 		evictionTicker := time.NewTicker(time.Millisecond * time.Duration(options.BufferPoolEvictionIntervalms))
 		flushTicker := time.NewTicker(time.Millisecond * time.Duration(options.BufferPoolFlushIntervalms))
-		var wg sync.WaitGroup
+		defer evictionTicker.Stop()
+		defer flushTicker.Stop()
 		lastEvictionTickerTime := time.Now()
 		for {
 			select {
+			case <-ps.stop:
+				return
 			case <-flushTicker.C:
-				ps.Flush()
+				ps.bgWriter.run()
 			case <-evictionTicker.C:
 				now := time.Now()
 
@@ -161,32 +458,19 @@ func NewPageSystem(logger log.Logger, heapfs heap.HeapFile, options PageSystemOp
 					continue
 				}
 
+				// dirty pages are only collected under the cache lock , written once it is released
+				// and evicted on a later tick
+				dirty := make([]*Page, 0)
 				cache.Compact(func(u uint64, pfb *Page) bool {
-					pfb.mutex.RLock()
-					if pfb.dirty {
-						// if dirty , do not wait for the write op to complete
-						// incremental semaphor
-						// start page write op in disk
-						// don't unlock the mutex until the write is complete (its a read lock so all reads are still allowed)
-						// writes would be blocked (internally dity is set to false and writes turn dirty to true)
-						// we unlock only once write is complete
-						wg.Add(1)
-						heapfs.Write(pfb.pageNumber, pfb.serialize(), func(err error) {
-							if err != nil {
-								log.Error().Err(err).Msg(fmt.Sprintf("error flushing page : %d", pfb.pageNumber))
-							}
-							pfb.dirty = false
-							pfb.mutex.RUnlock()
-							wg.Done()
-						})
+					if pfb.dirty.Load() {
+						dirty = append(dirty, pfb)
 						return false
 					}
-					pfb.mutex.RUnlock()
 					return true
 				})
-
-				// wait for all the files to get flushed before moving to next tick
-				wg.Wait()
+				if _, err := ps.writeIfDirty(dirty); err != nil {
+					logger.Error().Err(err).Msg("error flushing pages held back from eviction")
+				}
 			}
 		}
 	}()
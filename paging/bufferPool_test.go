@@ -0,0 +1,259 @@
+package paging
+
+import (
+	"boro-db/heap"
+	"boro-db/logging"
+	"boro-db/utils/checksums"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageChecksumVerification(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-checksum")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 8,
+	}
+	options := PageSystemOption{
+		HeapFileOptions:              heapOptions,
+		PageBufferCacheSize:          8,
+		BufferPoolEvictionIntervalms: 3600 * 1000,
+		BufferPoolFlushIntervalms:    3600 * 1000,
+		EnablePageMeta:               true,
+	}
+
+	heapFile, err := heap.NewHeap(*logging.CreateDebugLogger(), &heapOptions)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(2))
+	pageNumbers, err := heapFile.Malloc(2)
+	assert.Nil(t, err)
+
+	unknown := options
+	unknown.ChecksumAlgorithm = checksums.Algorithm(200)
+	_, err = NewPageSystem(*logging.CreateDebugLogger(), heapFile, unknown)
+	assert.ErrorIs(t, err, checksums.ErrUnknownAlgorithm)
+
+	ps, err := NewPageSystem(*logging.CreateDebugLogger(), heapFile, options)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for _, pageNumber := range pageNumbers {
+		page, err := ps.ReadPageContext(ctx, pageNumber)
+		assert.Nil(t, err)
+		assert.Equal(t, page.Size(), ps.PageSize())
+		assert.Nil(t, page.SetPageBuffer(0, []byte("hello world"), 1))
+	}
+	assert.Nil(t, ps.Close(ctx))
+
+	// flip a byte of the second page behind the page system's back
+	buffer := make([]byte, heapOptions.PageSizeByte)
+	assert.Nil(t, heapFile.ReadContext(ctx, pageNumbers[1], buffer))
+	buffer[100] ^= 0xFF
+	assert.Nil(t, heapFile.WriteContext(ctx, pageNumbers[1], buffer))
+
+	ps, err = NewPageSystem(*logging.CreateDebugLogger(), heapFile, options)
+	assert.Nil(t, err)
+	defer ps.Close(ctx)
+
+	page, err := ps.ReadPageContext(ctx, pageNumbers[0])
+	assert.Nil(t, err)
+	page.GetPageBuffer(func(b []byte) {
+		assert.Equal(t, "hello world", string(b[:11]))
+	})
+
+	_, err = ps.ReadPageContext(ctx, pageNumbers[1])
+	var corrupted *ErrPageCorrupted
+	assert.True(t, errors.As(err, &corrupted))
+	assert.Equal(t, pageNumbers[1], corrupted.PageNumber)
+	assert.Equal(t, []uint64{pageNumbers[1]}, ps.Quarantined())
+}
+
+func TestDoubleWriteRestoresTornPages(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-doublewrite")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 8,
+	}
+	options := PageSystemOption{
+		HeapFileOptions:              heapOptions,
+		PageBufferCacheSize:          8,
+		BufferPoolEvictionIntervalms: 3600 * 1000,
+		BufferPoolFlushIntervalms:    3600 * 1000,
+		EnablePageMeta:               true,
+		EnableDoubleWrite:            true,
+	}
+
+	heapFile, err := heap.NewHeap(*logging.CreateDebugLogger(), &heapOptions)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(4))
+	pageNumbers, err := heapFile.Malloc(4)
+	assert.Nil(t, err)
+
+	ps, err := NewPageSystem(*logging.CreateDebugLogger(), heapFile, options)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for _, pageNumber := range pageNumbers {
+		page, err := ps.ReadPageContext(ctx, pageNumber)
+		assert.Nil(t, err)
+		assert.Nil(t, page.SetPageBuffer(0, []byte("hello world"), 1))
+	}
+	assert.Nil(t, ps.Close(ctx))
+
+	// tear the second half of a page as if the crash happened mid write
+	buffer := make([]byte, heapOptions.PageSizeByte)
+	assert.Nil(t, heapFile.ReadContext(ctx, pageNumbers[2], buffer))
+	for i := len(buffer) / 2; i < len(buffer); i++ {
+		buffer[i] = 0xAB
+	}
+	assert.Nil(t, heapFile.WriteContext(ctx, pageNumbers[2], buffer))
+
+	ps, err = NewPageSystem(*logging.CreateDebugLogger(), heapFile, options)
+	assert.Nil(t, err)
+	defer ps.Close(ctx)
+
+	page, err := ps.ReadPageContext(ctx, pageNumbers[2])
+	assert.Nil(t, err)
+	page.GetPageBuffer(func(b []byte) {
+		assert.Equal(t, "hello world", string(b[:11]))
+	})
+	assert.Empty(t, ps.Quarantined())
+
+	_, err = NewPageSystem(*logging.CreateDebugLogger(), heapFile, PageSystemOption{
+		HeapFileOptions:   heapOptions,
+		EnableDoubleWrite: true,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestPageSystemInvalidate(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-invalidate")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 8,
+	}
+	options := PageSystemOption{
+		HeapFileOptions:              heapOptions,
+		PageBufferCacheSize:          8,
+		BufferPoolEvictionIntervalms: 3600 * 1000,
+		BufferPoolFlushIntervalms:    3600 * 1000,
+	}
+
+	heapFile, err := heap.NewHeap(*logging.CreateDebugLogger(), &heapOptions)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(2))
+	pageNumbers, err := heapFile.Malloc(2)
+	assert.Nil(t, err)
+
+	ps, err := NewPageSystem(*logging.CreateDebugLogger(), heapFile, options)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	defer ps.Close(ctx)
+
+	page, err := ps.ReadPageContext(ctx, pageNumbers[0])
+	assert.Nil(t, err)
+	assert.Equal(t, page.Size(), ps.PageSize())
+	assert.Nil(t, page.SetPageBuffer(0, []byte("stale"), 1))
+
+	// the dirty copy is dropped , nothing reaches the heap file
+	ps.Invalidate([]uint64{pageNumbers[0]})
+	assert.Nil(t, ps.Flush())
+
+	page, err = ps.ReadPageContext(ctx, pageNumbers[0])
+	assert.Nil(t, err)
+	page.GetPageBuffer(func(b []byte) {
+		assert.Equal(t, make([]byte, 5), b[:5])
+	})
+}
+
+func TestEvictionOverCacheSize(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-eviction")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 16,
+	}
+	heapFile, err := heap.NewHeap(*logging.CreateDebugLogger(), &heapOptions)
+	assert.Nil(t, err)
+	defer heapFile.Close(context.Background())
+	assert.Nil(t, heapFile.ExtendBy(16))
+	pageNumbers, err := heapFile.Malloc(16)
+	assert.Nil(t, err)
+
+	ps, err := NewPageSystem(*logging.CreateDebugLogger(), heapFile, PageSystemOption{
+		HeapFileOptions:              heapOptions,
+		PageBufferCacheSize:          4,
+		BufferPoolEvictionIntervalms: 10,
+		BufferPoolFlushIntervalms:    3600 * 1000,
+		EnablePageMeta:               true,
+	})
+	assert.Nil(t, err)
+	pageSys := ps.(*pageSystem)
+
+	// twice the cache size , every other page dirty
+	ctx := context.Background()
+	for i, pageNumber := range pageNumbers[:8] {
+		page, err := ps.ReadPageContext(ctx, pageNumber)
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.Nil(t, page.SetPageBuffer(0, []byte{byte(i + 1)}, uint32(i)))
+		}
+	}
+
+	// clean pages go right away , dirty ones are written after the walk and go on a later tick
+	assert.Eventually(t, func() bool {
+		return pageSys.cache.Size() <= 4 && pageSys.dirtyPages.Load() < 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// evicted pages come back from disk with their writes , the ticker keeps compacting meanwhile
+	for i, pageNumber := range pageNumbers[:8] {
+		page, err := ps.ReadPageContext(ctx, pageNumber)
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			page.GetPageBuffer(func(b []byte) {
+				assert.Equal(t, byte(i+1), b[0])
+			})
+		}
+	}
+	assert.Nil(t, ps.Close(ctx))
+}
@@ -0,0 +1,210 @@
+package paging
+
+import (
+	"boro-db/heap"
+	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/phuslu/log"
+)
+
+/*
+Double write buffer
+┌──────────────────────────────────────────────────────────────┐
+| crc (4byte) | page count (4byte)                             |
+| key id (4byte) | encrypted (1byte) | padding (3byte)         |
+| pageNumber (8byte) | page (PageSizeByte)                     |
+| pageNumber (8byte) | page (PageSizeByte)                     |
+| ......                                                       |
+└──────────────────────────────────────────────────────────────┘
+- every batch of dirty pages is written here and fsynced before any of them is written in place
+- a crash during the in place writes can tear a page , the copy here is still intact
+- on startup every page of the last batch is checked in place , torn ones are restored from here
+- a crash while writing this file is caught by its crc , in place pages were not touched yet
+- needs EnablePageMeta , torn pages are detected through the page checksum
+- with a KeyProvider the copies are encrypted with the current key like the heap files
+*/
+const doubleWriteFileName = "DOUBLEWRITE"
+const doubleWriteHeaderSize = 16
+const doubleWriteBatchPages = 64
+
+type doubleWriteBuffer struct {
+	lock     sync.Mutex
+	file     *os.File
+	pageSize int
+	buffer   []byte
+	// page checksum algorithm , used to detect torn pages
+	algorithm   checksums.Algorithm
+	keyProvider encryption.KeyProvider
+	keyID       uint32
+	cipher      *encryption.PageCipher
+}
+
+func openDoubleWriteBuffer(directory string, pageSize int, algorithm checksums.Algorithm, keyProvider encryption.KeyProvider) (*doubleWriteBuffer, error) {
+	dw := &doubleWriteBuffer{
+		pageSize:    pageSize,
+		buffer:      make([]byte, doubleWriteHeaderSize+doubleWriteBatchPages*(8+pageSize)),
+		algorithm:   algorithm,
+		keyProvider: keyProvider,
+	}
+	if keyProvider != nil {
+		cipher, err := dw.loadCipher(keyProvider.CurrentKeyID())
+		if err != nil {
+			return nil, err
+		}
+		dw.keyID = keyProvider.CurrentKeyID()
+		dw.cipher = cipher
+	}
+	file, err := os.OpenFile(filepath.Join(directory, doubleWriteFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	dw.file = file
+	return dw, nil
+}
+
+func (dw *doubleWriteBuffer) loadCipher(keyID uint32) (*encryption.PageCipher, error) {
+	if dw.keyProvider == nil {
+		return nil, fmt.Errorf("%w : double write buffer is encrypted with key %d but no key provider is configured", encryption.ErrKeyNotFound, keyID)
+	}
+	key, err := dw.keyProvider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewPageCipher(key, dw.pageSize)
+}
+
+func (dw *doubleWriteBuffer) entrySize() int {
+	return 8 + dw.pageSize
+}
+
+/*
+writes the pages in batches , each batch lands in the double write file first
+inPlace is invoked with the batch once the copy is durable
+the lock is held until the in place writes finish so the file always holds the batch in flight
+*/
+func (dw *doubleWriteBuffer) write(pages []*Page, buffers [][]byte, inPlace func([]*Page, [][]byte) error) error {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	var writeErr error
+	for start := 0; start < len(pages); start += doubleWriteBatchPages {
+		end := min(start+doubleWriteBatchPages, len(pages))
+
+		size := doubleWriteHeaderSize
+		for i := start; i < end; i++ {
+			binary.BigEndian.PutUint64(dw.buffer[size:size+8], pages[i].pageNumber)
+			copy(dw.buffer[size+8:size+dw.entrySize()], buffers[i])
+			if dw.cipher != nil {
+				if err := dw.cipher.Encrypt(dw.buffer[size+8:size+dw.entrySize()], pages[i].pageNumber); err != nil {
+					return errors.Join(writeErr, err)
+				}
+			}
+			size += dw.entrySize()
+		}
+		binary.BigEndian.PutUint32(dw.buffer[4:8], uint32(end-start))
+		binary.BigEndian.PutUint32(dw.buffer[8:12], dw.keyID)
+		dw.buffer[12] = 0
+		if dw.cipher != nil {
+			dw.buffer[12] = 1
+		}
+		checksums.CalculateCRC(dw.buffer[0:4], dw.buffer[4:size])
+
+		if _, err := dw.file.WriteAt(dw.buffer[:size], 0); err != nil {
+			return errors.Join(writeErr, err)
+		}
+		if err := dw.file.Sync(); err != nil {
+			return errors.Join(writeErr, err)
+		}
+
+		writeErr = errors.Join(writeErr, inPlace(pages[start:end], buffers[start:end]))
+	}
+	return writeErr
+}
+
+// restores torn pages of the last batch , returns the restored page numbers
+func (dw *doubleWriteBuffer) recover(logger log.Logger, heapfs heap.HeapFile) ([]uint64, error) {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	stat, err := dw.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < doubleWriteHeaderSize {
+		return nil, nil
+	}
+
+	content := make([]byte, stat.Size())
+	if _, err := dw.file.ReadAt(content, 0); err != nil {
+		return nil, err
+	}
+
+	count := int(binary.BigEndian.Uint32(content[4:8]))
+	size := doubleWriteHeaderSize + count*dw.entrySize()
+	crc := make([]byte, 4)
+	if size > len(content) {
+		logger.Warn().Msg("double write buffer is truncated , discarding it")
+		return nil, dw.reset()
+	}
+	checksums.CalculateCRC(crc, content[4:size])
+	if !checksums.CompareCRC(crc, content[0:4]) {
+		// torn while writing the double write file itself , in place pages were never touched
+		logger.Warn().Msg("double write buffer crc mismatch , discarding it")
+		return nil, dw.reset()
+	}
+
+	var cipher *encryption.PageCipher
+	if content[12] == 1 {
+		if cipher, err = dw.loadCipher(binary.BigEndian.Uint32(content[8:12])); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := context.Background()
+	restored := make([]uint64, 0)
+	inPlace := make([]byte, dw.pageSize)
+	for offset := doubleWriteHeaderSize; offset < size; offset += dw.entrySize() {
+		pageNumber := binary.BigEndian.Uint64(content[offset : offset+8])
+		copyBuffer := content[offset+8 : offset+dw.entrySize()]
+		if cipher != nil {
+			if err := cipher.Decrypt(copyBuffer, pageNumber); err != nil {
+				return restored, err
+			}
+		}
+
+		if err := heapfs.ReadContext(ctx, pageNumber, inPlace); err != nil {
+			// the page may not exist any more (trimmed) , nothing to restore
+			logger.Warn().Err(err).Msg(fmt.Sprintf("skipping double write copy of page : %d", pageNumber))
+			continue
+		}
+		if verifyPageChecksum(dw.algorithm, inPlace) || !verifyPageChecksum(dw.algorithm, copyBuffer) {
+			continue
+		}
+		if err := heapfs.WriteContext(ctx, pageNumber, copyBuffer); err != nil {
+			return restored, err
+		}
+		restored = append(restored, pageNumber)
+		logger.Info().Msg(fmt.Sprintf("restored torn page %d from double write buffer", pageNumber))
+	}
+
+	return restored, dw.reset()
+}
+
+func (dw *doubleWriteBuffer) reset() error {
+	if err := dw.file.Truncate(0); err != nil {
+		return err
+	}
+	return dw.file.Sync()
+}
+
+func (dw *doubleWriteBuffer) close() error {
+	return dw.file.Close()
+}
@@ -4,49 +4,75 @@ import (
 	"boro-db/utils/checksums"
 	"encoding/binary"
 	"fmt"
-	"hash/crc32"
 	"sync"
+	"sync/atomic"
 )
 
 /*
 PagefileBlock inside heap file
 ┌──────────────────────────────────────────────────────────────┐
-| checkSum (4 bytes) | LSN (4byte)                             |
+| checkSum (4 or 8 bytes) | LSN (4byte)                        |
 |──────────────────────────────────────────────────────────────|
 | ......                                                       |
 |-------------------------- System Page Size (4096) -----------|
 └──────────────────────────────────────────────────────────────┘
+- checksum size depends on HeapFileOptions.ChecksumAlgorithm (crc32 variants 4 , xxhash64 8)
 */
-const pageBufferBlockByteOffset = 8
+const pageLSNSize = 4
+
+// bytes taken by the page meta for the given checksum algorithm
+func pageMetaSize(algorithm checksums.Algorithm) int {
+	return algorithm.Size() + pageLSNSize
+}
 
 var ErrOutOfBounds = fmt.Errorf("out of bounds")
 
+// returned by reads when the checksum stored in the page header does not match its contents
+type ErrPageCorrupted struct {
+	PageNumber uint64
+}
+
+func (e *ErrPageCorrupted) Error() string {
+	return fmt.Sprintf("page %d corrupted : checksum mismatch", e.PageNumber)
+}
+
 type Page struct {
 
 	// buffer contains entire page data use getter and setters
 	pageNumber uint64
-	dirty      bool
-	buffer     []byte
-	crcMatch   bool
+	// set under the write lock , cleared by the one flusher holding flushLock
+	dirty    atomic.Bool
+	buffer   []byte
+	crcMatch bool
 	// TODO : remove the mutex lock , and try a CAS operation + Scheduler
-	mutex           sync.RWMutex
+	mutex sync.RWMutex
+	// held (before the read lock) while the page is written to disk
+	// flushers share the read lock with readers , this keeps two of them from serializing the meta at once
+	flushLock       sync.Mutex
 	currentLSN      uint32
 	pageMetaEnabled bool
+	// checksum stored in the page meta
+	checksumAlgorithm checksums.Algorithm
+	// shared with the owning page system, tracks how many pages are dirty
+	dirtyPages *atomic.Int64
 }
 
-func (pfb *Page) Size() int {
-
+// offset of the data region with in the buffer
+func (pfb *Page) dataOffset() int {
 	if pfb.pageMetaEnabled {
-		return len(pfb.buffer) - pageBufferBlockByteOffset
+		return pageMetaSize(pfb.checksumAlgorithm)
 	}
+	return 0
+}
 
-	return (len(pfb.buffer))
+func (pfb *Page) Size() int {
+	return len(pfb.buffer) - pfb.dataOffset()
 }
 
 func (pfb *Page) GetCheckSumBuffer() []byte {
 
 	if pfb.pageMetaEnabled {
-		return pfb.buffer[0:4]
+		return pfb.buffer[0:pfb.checksumAlgorithm.Size()]
 	}
 
 	return nil
@@ -54,7 +80,7 @@ func (pfb *Page) GetCheckSumBuffer() []byte {
 
 func (pfb *Page) GetPostCRCBuffer() []byte {
 	if pfb.pageMetaEnabled {
-		return pfb.buffer[4:]
+		return pfb.buffer[pfb.checksumAlgorithm.Size():]
 	}
 	return nil
 }
@@ -62,25 +88,42 @@ func (pfb *Page) GetPostCRCBuffer() []byte {
 func (pfb *Page) GetLSNBUffer() []byte {
 
 	if pfb.pageMetaEnabled {
-		return pfb.buffer[4:8]
+		size := pfb.checksumAlgorithm.Size()
+		return pfb.buffer[size : size+pageLSNSize]
 	}
 	return nil
 }
 
+// pages that were allocated but never written are all zeros and count as a match
 func (pfb *Page) CheckCRCMatch() bool {
 
 	if !pfb.pageMetaEnabled {
 		return true
 	}
 
-	crc := crc32.ChecksumIEEE(pfb.GetPostCRCBuffer())
-	crcMatch := crc == binary.BigEndian.Uint32(pfb.GetCheckSumBuffer())
-
-	pfb.crcMatch = crcMatch
+	pfb.crcMatch = verifyPageChecksum(pfb.checksumAlgorithm, pfb.buffer)
 
 	return pfb.crcMatch
 }
 
+// checks a raw page buffer written with page meta enabled
+func verifyPageChecksum(algorithm checksums.Algorithm, buffer []byte) bool {
+	if isZeroPage(buffer) {
+		return true
+	}
+	size := algorithm.Size()
+	return checksums.Verify(algorithm, buffer[0:size], buffer[size:])
+}
+
+func isZeroPage(buffer []byte) bool {
+	for _, b := range buffer {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (pfb *Page) SetPageBuffer(offset int, buffer []byte, currentLSN uint32) error {
 
 	pfb.mutex.Lock()
@@ -88,10 +131,11 @@ func (pfb *Page) SetPageBuffer(offset int, buffer []byte, currentLSN uint32) err
 
 	dataRegion := pfb.buffer
 	if pfb.pageMetaEnabled {
-		if offset > len(pfb.buffer)-pageBufferBlockByteOffset || len(buffer) > len(pfb.buffer)-pageBufferBlockByteOffset {
+		metaSize := pfb.dataOffset()
+		if offset > len(pfb.buffer)-metaSize || len(buffer) > len(pfb.buffer)-metaSize {
 			return ErrOutOfBounds
 		}
-		dataRegion = pfb.buffer[pageBufferBlockByteOffset+offset : pageBufferBlockByteOffset+offset+len(buffer)]
+		dataRegion = pfb.buffer[metaSize+offset : metaSize+offset+len(buffer)]
 	}
 
 	if offset > len(pfb.buffer) || len(buffer) > len(pfb.buffer) {
@@ -100,28 +144,43 @@ func (pfb *Page) SetPageBuffer(offset int, buffer []byte, currentLSN uint32) err
 
 	copy(dataRegion, buffer)
 	pfb.currentLSN = currentLSN
-	pfb.dirty = true
+	pfb.markDirty()
 
 	return nil
 }
 
-func (pfb *Page) GetPageBuffer(onRead func([]byte)) {
-	pfb.mutex.RLock()
-	defer pfb.mutex.RUnlock()
-	if pfb.pageMetaEnabled {
-		onRead(pfb.buffer[pageBufferBlockByteOffset:])
-	} else {
-		onRead(pfb.buffer)
+// caller must hold the page mutex
+func (pfb *Page) markDirty() {
+	if !pfb.dirty.CompareAndSwap(false, true) {
+		return
+	}
+	if pfb.dirtyPages != nil {
+		pfb.dirtyPages.Add(1)
 	}
 }
 
-func (pfb *Page) serialize() []byte {
+// called once the page has been written to disk , only the caller that flips the flag counts it
+func (pfb *Page) markClean() {
+	if !pfb.dirty.CompareAndSwap(true, false) {
+		return
+	}
+	if pfb.dirtyPages != nil {
+		pfb.dirtyPages.Add(-1)
+	}
+}
+
+func (pfb *Page) GetPageBuffer(onRead func([]byte)) {
 	pfb.mutex.RLock()
 	defer pfb.mutex.RUnlock()
+	onRead(pfb.buffer[pfb.dataOffset():])
+}
 
-	if pfb.dirty && pfb.pageMetaEnabled {
-		checksums.CalculateCRC(pfb.GetCheckSumBuffer(), pfb.GetPostCRCBuffer())
+// serialize expects the caller to hold the flush lock and the page mutex (read lock is enough)
+func (pfb *Page) serialize() []byte {
+	if pfb.dirty.Load() && pfb.pageMetaEnabled {
+		// LSN is covered by the checksum so it goes in first
 		binary.BigEndian.PutUint32(pfb.GetLSNBUffer(), pfb.currentLSN)
+		checksums.Calculate(pfb.checksumAlgorithm, pfb.GetCheckSumBuffer(), pfb.GetPostCRCBuffer())
 	}
 
 	return pfb.buffer
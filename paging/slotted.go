@@ -0,0 +1,295 @@
+package paging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+var ErrPageFull = fmt.Errorf("not enough free space in page")
+var ErrSlotNotFound = fmt.Errorf("slot not found")
+var ErrNotSlotted = fmt.Errorf("not a slotted page")
+
+/*
+Slotted page (data region of a Page)
+┌──────────────────────────────────────────────────────────────┐
+| magic (2byte) | slot count (2byte) | free end (2byte)        |
+| fragmented bytes (2byte) | slot 0 | slot 1 | slot 2 | ...    |
+|──────────────────────────────────────────────────────────────|
+| ......                 free space                            |
+|──────────────────────────────────────────────────────────────|
+|            ... | record 2 | record 0 | record 1             |
+└──────────────────────────────────────────────────────────────┘
+slot : | record offset (2byte) | record length (2byte) |
+
+  - the slot directory grows from the front , records from the back , free space sits in between
+  - a record keeps its slot for life , so RecordID (page , slot) stays valid while records move inside the page
+  - deleting or shrinking a record leaves a hole that is counted as fragmented bytes ,
+    an insert / update that only fits with them compacts the page first
+  - a deleted slot has offset 0 and is reused by the next insert , trailing deleted slots are dropped
+  - works on a copy of the page data , write Bytes() back with SetPageBuffer(0 , ...)
+*/
+const slottedPageMagic = uint16(0x510D)
+const slottedHeaderSize = 8
+const slotSize = 4
+
+// page + slot of a record
+type RecordID struct {
+	Page uint64
+	Slot uint16
+}
+
+const RecordIDSize = 10
+
+func (rid RecordID) String() string {
+	return fmt.Sprintf("(%d,%d)", rid.Page, rid.Slot)
+}
+
+func (rid RecordID) Bytes() []byte {
+	buffer := make([]byte, RecordIDSize)
+	binary.BigEndian.PutUint64(buffer[0:8], rid.Page)
+	binary.BigEndian.PutUint16(buffer[8:10], rid.Slot)
+	return buffer
+}
+
+func RecordIDFromBytes(buffer []byte) RecordID {
+	return RecordID{
+		Page: binary.BigEndian.Uint64(buffer[0:8]),
+		Slot: binary.BigEndian.Uint16(buffer[8:10]),
+	}
+}
+
+type SlottedPage struct {
+	buffer []byte
+}
+
+// formats buffer as an empty slotted page
+func NewSlottedPage(buffer []byte) (*SlottedPage, error) {
+	if len(buffer) <= slottedHeaderSize || len(buffer) > 0xFFFF {
+		return nil, fmt.Errorf("%w : %d bytes can not hold a slotted page", ErrOutOfBounds, len(buffer))
+	}
+	clear(buffer)
+	sp := &SlottedPage{buffer: buffer}
+	binary.BigEndian.PutUint16(buffer[0:2], slottedPageMagic)
+	sp.setFreeEnd(len(buffer))
+	return sp, nil
+}
+
+// wraps a buffer formatted by NewSlottedPage , changes go to the buffer
+func LoadSlottedPage(buffer []byte) (*SlottedPage, error) {
+	if len(buffer) <= slottedHeaderSize || len(buffer) > 0xFFFF || binary.BigEndian.Uint16(buffer[0:2]) != slottedPageMagic {
+		return nil, ErrNotSlotted
+	}
+	sp := &SlottedPage{buffer: buffer}
+	if sp.freeStart() > sp.freeEnd() || sp.freeEnd() > len(buffer) {
+		return nil, fmt.Errorf("%w : free space %d - %d out of bounds", ErrNotSlotted, sp.freeStart(), sp.freeEnd())
+	}
+	for slot := uint16(0); slot < sp.SlotCount(); slot++ {
+		offset, length := sp.slot(slot)
+		if offset != 0 && (offset < sp.freeEnd() || offset+length > len(buffer)) {
+			return nil, fmt.Errorf("%w : slot %d points at %d - %d", ErrNotSlotted, slot, offset, offset+length)
+		}
+	}
+	return sp, nil
+}
+
+// the page data to write back
+func (sp *SlottedPage) Bytes() []byte {
+	return sp.buffer
+}
+
+// slots including deleted ones , valid slots are 0 ... SlotCount()-1
+func (sp *SlottedPage) SlotCount() uint16 {
+	return binary.BigEndian.Uint16(sp.buffer[2:4])
+}
+
+// live records in the page
+func (sp *SlottedPage) RecordCount() int {
+	count := 0
+	for slot := uint16(0); slot < sp.SlotCount(); slot++ {
+		if offset, _ := sp.slot(slot); offset != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// largest record an Insert can take right now (compacting if needed)
+func (sp *SlottedPage) FreeSpace() int {
+	free := sp.freeEnd() - sp.freeStart() + sp.fragmented()
+	if _, ok := sp.deletedSlot(); !ok {
+		free -= slotSize
+	}
+	return max(free, 0)
+}
+
+// largest record an empty slotted page of pageSize bytes can take
+func MaxRecordSize(pageSize int) int {
+	return pageSize - slottedHeaderSize - slotSize
+}
+
+func (sp *SlottedPage) Insert(record []byte) (uint16, error) {
+	if len(record) > sp.FreeSpace() {
+		return 0, fmt.Errorf("%w : record of %d bytes , %d free", ErrPageFull, len(record), sp.FreeSpace())
+	}
+	slot, ok := sp.deletedSlot()
+	if !ok {
+		// the new slot entry takes the front of the gap , it must not land on the lowest record
+		if sp.freeEnd()-sp.freeStart() < slotSize+len(record) {
+			sp.Compact()
+		}
+		slot = sp.SlotCount()
+		sp.setSlotCount(slot + 1)
+		sp.setSlot(slot, 0, 0)
+	}
+	offset := sp.place(record)
+	sp.setSlot(slot, offset, len(record))
+	return slot, nil
+}
+
+// copy of the record in slot
+func (sp *SlottedPage) Get(slot uint16) ([]byte, error) {
+	offset, length, err := sp.liveSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(sp.buffer[offset : offset+length]), nil
+}
+
+// replaces the record in slot , on ErrPageFull the page is left unchanged
+func (sp *SlottedPage) Update(slot uint16, record []byte) error {
+	offset, length, err := sp.liveSlot(slot)
+	if err != nil {
+		return err
+	}
+	if len(record) <= length {
+		copy(sp.buffer[offset:], record)
+		sp.setFragmented(sp.fragmented() + length - len(record))
+		sp.setSlot(slot, offset, len(record))
+		return nil
+	}
+	if free := sp.freeEnd() - sp.freeStart() + sp.fragmented() + length; len(record) > free {
+		return fmt.Errorf("%w : record of %d bytes , %d free", ErrPageFull, len(record), free)
+	}
+	// the old copy becomes a hole , compaction may reclaim it for the new one
+	sp.setFragmented(sp.fragmented() + length)
+	sp.setSlot(slot, 0, 0)
+	offset = sp.place(record)
+	sp.setSlot(slot, offset, len(record))
+	return nil
+}
+
+func (sp *SlottedPage) Delete(slot uint16) error {
+	_, length, err := sp.liveSlot(slot)
+	if err != nil {
+		return err
+	}
+	sp.setFragmented(sp.fragmented() + length)
+	sp.setSlot(slot, 0, 0)
+	count := sp.SlotCount()
+	for count > 0 {
+		if offset, _ := sp.slot(count - 1); offset != 0 {
+			break
+		}
+		count--
+	}
+	sp.setSlotCount(count)
+	return nil
+}
+
+// moves the records to the back of the page so the free space is one run , slots keep their records
+func (sp *SlottedPage) Compact() {
+	type entry struct {
+		slot   uint16
+		offset int
+		length int
+	}
+	entries := make([]entry, 0, sp.SlotCount())
+	for slot := uint16(0); slot < sp.SlotCount(); slot++ {
+		if offset, length := sp.slot(slot); offset != 0 {
+			entries = append(entries, entry{slot, offset, length})
+		}
+	}
+	// the highest record moves first so nothing is overwritten before it is moved
+	sort.Slice(entries, func(i, j int) bool { return entries[i].offset > entries[j].offset })
+	end := len(sp.buffer)
+	for _, e := range entries {
+		end -= e.length
+		copy(sp.buffer[end:end+e.length], sp.buffer[e.offset:e.offset+e.length])
+		sp.setSlot(e.slot, end, e.length)
+	}
+	clear(sp.buffer[sp.freeStart():end])
+	sp.setFreeEnd(end)
+	sp.setFragmented(0)
+}
+
+/*
+copies record in front of the free end , compacting first if it does not fit there
+the slot taking the record must read as deleted so compaction leaves it alone
+an empty record still gets a non zero offset , the free end never drops below the header
+*/
+func (sp *SlottedPage) place(record []byte) int {
+	if sp.freeEnd()-len(record) < sp.freeStart() {
+		sp.Compact()
+	}
+	offset := sp.freeEnd() - len(record)
+	copy(sp.buffer[offset:], record)
+	sp.setFreeEnd(offset)
+	return offset
+}
+
+func (sp *SlottedPage) liveSlot(slot uint16) (int, int, error) {
+	if slot >= sp.SlotCount() {
+		return 0, 0, fmt.Errorf("%w : slot %d of %d", ErrSlotNotFound, slot, sp.SlotCount())
+	}
+	offset, length := sp.slot(slot)
+	if offset == 0 {
+		return 0, 0, fmt.Errorf("%w : slot %d was deleted", ErrSlotNotFound, slot)
+	}
+	return offset, length, nil
+}
+
+func (sp *SlottedPage) deletedSlot() (uint16, bool) {
+	for slot := uint16(0); slot < sp.SlotCount(); slot++ {
+		if offset, _ := sp.slot(slot); offset == 0 {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+func (sp *SlottedPage) slot(slot uint16) (int, int) {
+	entry := sp.buffer[slottedHeaderSize+int(slot)*slotSize:]
+	return int(binary.BigEndian.Uint16(entry[0:2])), int(binary.BigEndian.Uint16(entry[2:4]))
+}
+
+func (sp *SlottedPage) setSlot(slot uint16, offset int, length int) {
+	entry := sp.buffer[slottedHeaderSize+int(slot)*slotSize:]
+	binary.BigEndian.PutUint16(entry[0:2], uint16(offset))
+	binary.BigEndian.PutUint16(entry[2:4], uint16(length))
+}
+
+func (sp *SlottedPage) setSlotCount(count uint16) {
+	binary.BigEndian.PutUint16(sp.buffer[2:4], count)
+}
+
+func (sp *SlottedPage) freeStart() int {
+	return slottedHeaderSize + int(sp.SlotCount())*slotSize
+}
+
+func (sp *SlottedPage) freeEnd() int {
+	return int(binary.BigEndian.Uint16(sp.buffer[4:6]))
+}
+
+func (sp *SlottedPage) setFreeEnd(end int) {
+	binary.BigEndian.PutUint16(sp.buffer[4:6], uint16(end))
+}
+
+func (sp *SlottedPage) fragmented() int {
+	return int(binary.BigEndian.Uint16(sp.buffer[6:8]))
+}
+
+func (sp *SlottedPage) setFragmented(bytes int) {
+	binary.BigEndian.PutUint16(sp.buffer[6:8], uint16(bytes))
+}
@@ -0,0 +1,108 @@
+package paging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlottedPage(t *testing.T) {
+
+	buffer := make([]byte, 256)
+	sp, err := NewSlottedPage(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxRecordSize(len(buffer)), sp.FreeSpace())
+
+	_, err = LoadSlottedPage(make([]byte, 256))
+	assert.ErrorIs(t, err, ErrNotSlotted)
+
+	records := [][]byte{[]byte("alice"), []byte(""), bytes.Repeat([]byte{'b'}, 40), []byte("carol")}
+	for i, record := range records {
+		slot, err := sp.Insert(record)
+		assert.Nil(t, err)
+		assert.Equal(t, uint16(i), slot)
+	}
+	for i, record := range records {
+		got, err := sp.Get(uint16(i))
+		assert.Nil(t, err)
+		assert.Equal(t, record, got)
+	}
+	assert.Equal(t, 4, sp.RecordCount())
+
+	// shrinking stays in place , growing moves the record
+	assert.Nil(t, sp.Update(0, []byte("al")))
+	assert.Nil(t, sp.Update(3, bytes.Repeat([]byte{'c'}, 30)))
+	got, _ := sp.Get(0)
+	assert.Equal(t, []byte("al"), got)
+	got, _ = sp.Get(3)
+	assert.Equal(t, bytes.Repeat([]byte{'c'}, 30), got)
+
+	// a deleted slot is reused , record ids of the others do not move
+	assert.Nil(t, sp.Delete(1))
+	_, err = sp.Get(1)
+	assert.ErrorIs(t, err, ErrSlotNotFound)
+	assert.ErrorIs(t, sp.Delete(1), ErrSlotNotFound)
+	slot, err := sp.Insert([]byte("dave"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1), slot)
+
+	// survives a round trip through the page bytes
+	sp, err = LoadSlottedPage(bytes.Clone(sp.Bytes()))
+	assert.Nil(t, err)
+	got, _ = sp.Get(2)
+	assert.Equal(t, bytes.Repeat([]byte{'b'}, 40), got)
+
+	// fill the page , the last insert only fits once the holes are compacted
+	free := sp.FreeSpace()
+	_, err = sp.Insert(make([]byte, free+1))
+	assert.ErrorIs(t, err, ErrPageFull)
+	assert.Nil(t, sp.Delete(2))
+	free = sp.FreeSpace()
+	slot, err = sp.Insert(bytes.Repeat([]byte{'e'}, free))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(2), slot)
+	assert.Equal(t, 0, sp.FreeSpace())
+	assert.ErrorIs(t, sp.Update(1, []byte("david")), ErrPageFull)
+
+	for slot, want := range map[uint16][]byte{0: []byte("al"), 1: []byte("dave"), 2: bytes.Repeat([]byte{'e'}, free), 3: bytes.Repeat([]byte{'c'}, 30)} {
+		got, err := sp.Get(slot)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	// trailing deleted slots are dropped
+	assert.Nil(t, sp.Delete(3))
+	assert.Nil(t, sp.Delete(2))
+	assert.Equal(t, uint16(2), sp.SlotCount())
+
+	rid := RecordID{Page: 42, Slot: 7}
+	assert.Equal(t, rid, RecordIDFromBytes(rid.Bytes()))
+	assert.Equal(t, "(42,7)", rid.String())
+}
+
+func TestSlottedPageInsertIntoFragmentedPage(t *testing.T) {
+
+	sp, err := NewSlottedPage(make([]byte, 64))
+	assert.Nil(t, err)
+	// header 8 + 3 slots 12 , records 20 + 16 + 6 , a 2 byte gap is left
+	records := [][]byte{bytes.Repeat([]byte{'a'}, 20), bytes.Repeat([]byte{'b'}, 16), []byte("dddddd")}
+	for _, record := range records {
+		_, err := sp.Insert(record)
+		assert.Nil(t, err)
+	}
+	// shrinking leaves room only in the hole , not in front of the lowest record
+	assert.Nil(t, sp.Update(0, []byte("a")))
+	records[0] = []byte("a")
+	assert.Less(t, sp.freeEnd()-sp.freeStart(), slotSize)
+
+	slot, err := sp.Insert([]byte("eeeeee"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(3), slot)
+	records = append(records, []byte("eeeeee"))
+	for i, record := range records {
+		got, err := sp.Get(uint16(i))
+		assert.Nil(t, err)
+		assert.Equal(t, record, got)
+	}
+}
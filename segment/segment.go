@@ -0,0 +1,663 @@
+package segment
+
+import (
+	"boro-db/filesystem"
+	"boro-db/heap"
+	"boro-db/paging"
+	"boro-db/utils/checksums"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/phuslu/log"
+)
+
+var ErrSegmentExists = fmt.Errorf("segment already exists")
+var ErrSegmentNotFound = fmt.Errorf("segment not found")
+var ErrPageNotOwned = fmt.Errorf("page is not owned by the segment")
+var ErrInvalidName = fmt.Errorf("invalid segment name")
+var ErrCatalogCorrupted = fmt.Errorf("segment catalog corrupted")
+
+const MaxNameLength = 255
+
+// page 0 of the address space , Root() of a segment without a root
+const superblockPage = uint64(0)
+const NoRoot = superblockPage
+
+/*
+Segments
+┌──────────────────────────────────────────────────────────────┐
+| page 0 : superblock                                          |
+| magic (4byte) | version (4byte) | generation (8byte)         |
+| directory head page (8byte) | directory length (8byte)       |
+| directory crc (4byte) | superblock crc (4byte)               |
+└──────────────────────────────────────────────────────────────┘
+┌──────────────────────────────────────────────────────────────┐
+| chain page : next page (8byte) | used bytes (4byte)          |
+| directory or extent bytes ......                             |
+└──────────────────────────────────────────────────────────────┘
+directory , per segment sorted by name
+| name length (2byte) | name | root (8byte) | extent count (4byte) | extent chain head (8byte) | extent crc (4byte) |
+extent chain of a segment , in allocation order
+| first page (8byte) | page count (4byte) | ...
+
+  - named page lists ("lsm/L0/000123.sst" , "btree/users_idx") sharing one FileSystem address space
+    every data structure allocates through its segment and only touches its own pages
+  - each segment has a root page pointer for the structure to find its way back in after a restart
+  - the pages of a segment are kept as extents (runs of consecutive pages) in a chain of its own
+    pages handed out one after the other by Malloc extend the last extent
+  - a change rewrites the extent chain of the segment it touches and the directory into fresh pages ,
+    flushes only those , then points the superblock at the new directory and frees the replaced chains
+    the other segments keep their extent chains , so a change costs the extents of one segment
+    plus one directory entry per segment
+  - the superblock is a single page so it flips in one write (enable paging EnableDoubleWrite to rule out torn pages)
+  - a crash before the flip leaves the old directory intact , the pages written for the new one are leaked
+    so are pages malloced for a segment right before the crash
+*/
+const superblockMagic = uint32(0x5E65B10C)
+const superblockVersion = uint32(1)
+const superblockSize = 40
+const chainPageHeaderSize = 12
+const extentSize = 12
+
+type Manager struct {
+	logger   log.Logger
+	fs       filesystem.FileSystem
+	lock     sync.Mutex
+	segments map[string]*Segment
+	// directory chain the superblock points at
+	chain      []uint64
+	generation uint64
+	// usable bytes of a page , page meta excluded
+	pageSize int
+}
+
+// pages first .. first+count-1
+type extent struct {
+	first uint64
+	count uint64
+}
+
+type Segment struct {
+	manager *Manager
+	name    string
+	root    uint64
+	extents []extent
+	owned   map[uint64]struct{}
+	// extent chain on disk and the crc of its bytes , what the directory entry points at
+	chain    []uint64
+	chainCRC []byte
+	dropped  bool
+}
+
+func validName(name string) error {
+	if name == "" || len(name) > MaxNameLength || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%w : %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+/*
+Creates a segment with no pages
+names are free form , "/" is only a convention for grouping with List
+*/
+func (m *Manager) Create(name string) (*Segment, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.segments[name]; ok {
+		return nil, fmt.Errorf("%w : %s", ErrSegmentExists, name)
+	}
+	segment := &Segment{
+		manager: m,
+		name:    name,
+		root:    NoRoot,
+		owned:   make(map[uint64]struct{}),
+	}
+	m.segments[name] = segment
+	if err := m.persist(segment); err != nil {
+		delete(m.segments, name)
+		return nil, err
+	}
+	return segment, nil
+}
+
+func (m *Manager) Get(name string) (*Segment, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	segment, ok := m.segments[name]
+	if !ok {
+		return nil, fmt.Errorf("%w : %s", ErrSegmentNotFound, name)
+	}
+	return segment, nil
+}
+
+// names starting with prefix in order
+func (m *Manager) List(prefix string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0)
+	for name := range m.segments {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removes the segment and frees every page it owns
+func (m *Manager) Drop(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	segment, ok := m.segments[name]
+	if !ok {
+		return fmt.Errorf("%w : %s", ErrSegmentNotFound, name)
+	}
+
+	delete(m.segments, name)
+	if err := m.persist(); err != nil {
+		m.segments[name] = segment
+		return err
+	}
+	segment.dropped = true
+	// the directory no longer references them , a failed free only leaks
+	if err := m.fs.Free(append(segment.pages(), segment.chain...)); err != nil {
+		m.logger.Error().Err(err).Msg(fmt.Sprintf("error freeing pages of dropped segment %s", name))
+		return err
+	}
+	return nil
+}
+
+func (s *Segment) Name() string {
+	return s.name
+}
+
+func (s *Segment) Root() uint64 {
+	s.manager.lock.Lock()
+	defer s.manager.lock.Unlock()
+	return s.root
+}
+
+// the root must be one of the segment's pages , NoRoot clears it
+func (s *Segment) SetRoot(page uint64) error {
+	s.manager.lock.Lock()
+	defer s.manager.lock.Unlock()
+	if err := s.usable(); err != nil {
+		return err
+	}
+	if _, ok := s.owned[page]; !ok && page != NoRoot {
+		return fmt.Errorf("%w : %s does not own %d", ErrPageNotOwned, s.name, page)
+	}
+	previous := s.root
+	s.root = page
+	if err := s.manager.persist(); err != nil {
+		s.root = previous
+		return err
+	}
+	return nil
+}
+
+// pages in allocation order
+func (s *Segment) Pages() []uint64 {
+	s.manager.lock.Lock()
+	defer s.manager.lock.Unlock()
+	return s.pages()
+}
+
+func (s *Segment) Owns(page uint64) bool {
+	s.manager.lock.Lock()
+	defer s.manager.lock.Unlock()
+	_, ok := s.owned[page]
+	return ok
+}
+
+// allocates count pages from the FileSystem for this segment
+func (s *Segment) Allocate(count uint64) ([]uint64, error) {
+	s.manager.lock.Lock()
+	defer s.manager.lock.Unlock()
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+
+	pages, err := s.manager.fs.Malloc(count)
+	if err != nil {
+		return nil, err
+	}
+	s.adopt(pages)
+	if err := s.manager.persist(s); err != nil {
+		s.disown(pages)
+		return nil, errors.Join(err, s.manager.fs.Free(pages))
+	}
+	return pages, nil
+}
+
+// hands pages of this segment back to the FileSystem , the root can not be released
+func (s *Segment) Release(pages []uint64) error {
+	s.manager.lock.Lock()
+	defer s.manager.lock.Unlock()
+	if err := s.usable(); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if _, ok := s.owned[page]; !ok {
+			return fmt.Errorf("%w : %s does not own %d", ErrPageNotOwned, s.name, page)
+		}
+		if page == s.root {
+			return fmt.Errorf("page %d is the root of %s , move the root first", page, s.name)
+		}
+	}
+
+	previous := slices.Clone(s.extents)
+	s.disown(pages)
+	if err := s.manager.persist(s); err != nil {
+		s.extents = previous
+		for _, page := range pages {
+			s.owned[page] = struct{}{}
+		}
+		return err
+	}
+	return s.manager.fs.Free(pages)
+}
+
+// caller must hold the manager lock
+func (s *Segment) usable() error {
+	if s.dropped {
+		return fmt.Errorf("%w : %s was dropped", ErrSegmentNotFound, s.name)
+	}
+	return nil
+}
+
+// caller must hold the manager lock
+func (s *Segment) pages() []uint64 {
+	pages := make([]uint64, 0, len(s.owned))
+	for _, e := range s.extents {
+		for i := uint64(0); i < e.count; i++ {
+			pages = append(pages, e.first+i)
+		}
+	}
+	return pages
+}
+
+// caller must hold the manager lock
+func (s *Segment) adopt(pages []uint64) {
+	if s.owned == nil {
+		s.owned = make(map[uint64]struct{}, len(pages))
+	}
+	for _, page := range pages {
+		s.owned[page] = struct{}{}
+		last := len(s.extents) - 1
+		if last >= 0 && s.extents[last].first+s.extents[last].count == page && s.extents[last].count < math.MaxUint32 {
+			s.extents[last].count++
+			continue
+		}
+		s.extents = append(s.extents, extent{first: page, count: 1})
+	}
+}
+
+// caller must hold the manager lock
+func (s *Segment) disown(pages []uint64) {
+	for _, page := range pages {
+		delete(s.owned, page)
+	}
+	// split the extents around the pages that left
+	extents := make([]extent, 0, len(s.extents))
+	for _, e := range s.extents {
+		run := extent{first: e.first}
+		for page := e.first; page < e.first+e.count; page++ {
+			if _, ok := s.owned[page]; ok {
+				run.count++
+				continue
+			}
+			if run.count != 0 {
+				extents = append(extents, run)
+			}
+			run = extent{first: page + 1}
+		}
+		if run.count != 0 {
+			extents = append(extents, run)
+		}
+	}
+	s.extents = extents
+}
+
+// caller must hold the manager lock
+func (s *Segment) serializeExtents() []byte {
+	buffer := make([]byte, 0, len(s.extents)*extentSize)
+	for _, e := range s.extents {
+		buffer = binary.BigEndian.AppendUint64(buffer, e.first)
+		buffer = binary.BigEndian.AppendUint32(buffer, uint32(e.count))
+	}
+	return buffer
+}
+
+func (s *Segment) deserializeExtents(buffer []byte) error {
+	if len(buffer)%extentSize != 0 {
+		return fmt.Errorf("%w : truncated extents of %s", ErrCatalogCorrupted, s.name)
+	}
+	s.extents = make([]extent, 0, len(buffer)/extentSize)
+	s.owned = make(map[uint64]struct{})
+	for offset := 0; offset < len(buffer); offset += extentSize {
+		e := extent{
+			first: binary.BigEndian.Uint64(buffer[offset:]),
+			count: uint64(binary.BigEndian.Uint32(buffer[offset+8:])),
+		}
+		s.extents = append(s.extents, e)
+		for page := e.first; page < e.first+e.count; page++ {
+			s.owned[page] = struct{}{}
+		}
+	}
+	return nil
+}
+
+/*
+directory entries , segments not in chains keep the extent chain they already have
+caller must hold the manager lock
+*/
+func (m *Manager) serialize(chains map[*Segment][]uint64, crcs map[*Segment][]byte) []byte {
+	names := make([]string, 0, len(m.segments))
+	for name := range m.segments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	directory := make([]byte, 0)
+	for _, name := range names {
+		segment := m.segments[name]
+		chain, crc := segment.chain, segment.chainCRC
+		if _, ok := chains[segment]; ok {
+			chain, crc = chains[segment], crcs[segment]
+		}
+		head := superblockPage
+		if len(chain) != 0 {
+			head = chain[0]
+		}
+		directory = binary.BigEndian.AppendUint16(directory, uint16(len(name)))
+		directory = append(directory, name...)
+		directory = binary.BigEndian.AppendUint64(directory, segment.root)
+		directory = binary.BigEndian.AppendUint32(directory, uint32(len(segment.extents)))
+		directory = binary.BigEndian.AppendUint64(directory, head)
+		directory = append(directory, crc...)
+	}
+	return directory
+}
+
+// reads the extent chain of every segment it finds
+func (m *Manager) deserialize(ctx context.Context, directory []byte) error {
+	m.segments = make(map[string]*Segment)
+	for offset := 0; offset < len(directory); {
+		if offset+2 > len(directory) {
+			return fmt.Errorf("%w : truncated directory", ErrCatalogCorrupted)
+		}
+		nameLength := int(binary.BigEndian.Uint16(directory[offset:]))
+		offset += 2
+		if offset+nameLength+24 > len(directory) {
+			return fmt.Errorf("%w : truncated directory", ErrCatalogCorrupted)
+		}
+		segment := &Segment{
+			manager: m,
+			name:    string(directory[offset : offset+nameLength]),
+		}
+		offset += nameLength
+		segment.root = binary.BigEndian.Uint64(directory[offset:])
+		extentCount := uint64(binary.BigEndian.Uint32(directory[offset+8:]))
+		head := binary.BigEndian.Uint64(directory[offset+12:])
+		segment.chainCRC = slices.Clone(directory[offset+20 : offset+24])
+		offset += 24
+
+		extents, chain, err := m.readChain(ctx, head, extentCount*extentSize)
+		if err != nil {
+			return err
+		}
+		if !checksums.CompareCRC(crcOf(extents), segment.chainCRC) {
+			return fmt.Errorf("%w : extent crc mismatch of %s", ErrCatalogCorrupted, segment.name)
+		}
+		if err := segment.deserializeExtents(extents); err != nil {
+			return err
+		}
+		segment.chain = chain
+		m.segments[segment.name] = segment
+	}
+	return nil
+}
+
+/*
+writes the extent chains of the changed segments and the directory into fresh pages ,
+flushes them and flips the superblock to the new directory
+the in memory state is already changed , callers undo it when this fails
+caller must hold the manager lock
+*/
+func (m *Manager) persist(changed ...*Segment) error {
+	ctx := context.Background()
+
+	// everything written for the new directory , given back if the flip does not happen
+	written := make([]uint64, 0)
+	abandon := func(err error) error {
+		if len(written) == 0 {
+			return err
+		}
+		return errors.Join(err, m.fs.Free(written))
+	}
+
+	chains := make(map[*Segment][]uint64, len(changed))
+	crcs := make(map[*Segment][]byte, len(changed))
+	for _, segment := range changed {
+		extents := segment.serializeExtents()
+		chain, err := m.writeChain(ctx, extents)
+		written = append(written, chain...)
+		if err != nil {
+			return abandon(err)
+		}
+		chains[segment] = chain
+		crcs[segment] = crcOf(extents)
+	}
+
+	directory := m.serialize(chains, crcs)
+	chain, err := m.writeChain(ctx, directory)
+	written = append(written, chain...)
+	if err != nil {
+		return abandon(err)
+	}
+	// the chains must be durable before the superblock points at them
+	if err := m.fs.FlushPagesContext(ctx, written); err != nil {
+		return abandon(err)
+	}
+
+	superblock := make([]byte, superblockSize)
+	binary.BigEndian.PutUint32(superblock[0:4], superblockMagic)
+	binary.BigEndian.PutUint32(superblock[4:8], superblockVersion)
+	binary.BigEndian.PutUint64(superblock[8:16], m.generation+1)
+	if len(chain) != 0 {
+		binary.BigEndian.PutUint64(superblock[16:24], chain[0])
+	}
+	binary.BigEndian.PutUint64(superblock[24:32], uint64(len(directory)))
+	checksums.CalculateCRC(superblock[32:36], directory)
+	checksums.CalculateCRC(superblock[36:40], superblock[0:36])
+	if err := m.writePage(ctx, superblockPage, superblock); err != nil {
+		return abandon(err)
+	}
+	if err := m.fs.FlushPagesContext(ctx, []uint64{superblockPage}); err != nil {
+		// may or may not have reached the disk , keep both directories
+		m.logger.Error().Err(err).Msg("error flushing segment superblock")
+		return err
+	}
+
+	replaced := m.chain
+	m.chain = chain
+	m.generation++
+	for _, segment := range changed {
+		replaced = append(replaced, segment.chain...)
+		segment.chain = chains[segment]
+		segment.chainCRC = crcs[segment]
+	}
+	if len(replaced) != 0 {
+		if err := m.fs.Free(replaced); err != nil {
+			m.logger.Warn().Err(err).Msg("error freeing replaced segment chains , pages leaked")
+		}
+	}
+	return nil
+}
+
+/*
+mallocs and writes a chain holding buffer , the malloced pages are returned
+even when a write fails so the caller can free them
+*/
+func (m *Manager) writeChain(ctx context.Context, buffer []byte) ([]uint64, error) {
+	if len(buffer) == 0 {
+		return nil, nil
+	}
+	perPage := m.pageSize - chainPageHeaderSize
+	chain, err := m.fs.Malloc(uint64((len(buffer) + perPage - 1) / perPage))
+	if err != nil {
+		m.logger.Error().Err(err).Msg("error allocating segment chain pages")
+		return nil, err
+	}
+	for i, page := range chain {
+		part := buffer[i*perPage : min((i+1)*perPage, len(buffer))]
+		pageBuffer := make([]byte, chainPageHeaderSize+len(part))
+		if i+1 < len(chain) {
+			binary.BigEndian.PutUint64(pageBuffer[0:8], chain[i+1])
+		}
+		binary.BigEndian.PutUint32(pageBuffer[8:12], uint32(len(part)))
+		copy(pageBuffer[chainPageHeaderSize:], part)
+		if err := m.writePage(ctx, page, pageBuffer); err != nil {
+			return chain, err
+		}
+	}
+	return chain, nil
+}
+
+// follows a chain from head , length is the number of bytes it must hold
+func (m *Manager) readChain(ctx context.Context, head uint64, length uint64) ([]byte, []uint64, error) {
+	buffer := make([]byte, 0, length)
+	chain := make([]uint64, 0)
+	for next := head; next != superblockPage; {
+		if len(chain) > 0 && uint64(len(buffer)) >= length {
+			return nil, nil, fmt.Errorf("%w : chain at %d longer than %d bytes", ErrCatalogCorrupted, head, length)
+		}
+		page, err := m.readPage(ctx, next)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, next)
+		used := int(binary.BigEndian.Uint32(page[8:12]))
+		if used > len(page)-chainPageHeaderSize {
+			return nil, nil, fmt.Errorf("%w : chain page %d claims %d bytes", ErrCatalogCorrupted, next, used)
+		}
+		buffer = append(buffer, page[chainPageHeaderSize:chainPageHeaderSize+used]...)
+		next = binary.BigEndian.Uint64(page[0:8])
+	}
+	if uint64(len(buffer)) != length {
+		return nil, nil, fmt.Errorf("%w : chain at %d holds %d bytes , expected %d", ErrCatalogCorrupted, head, len(buffer), length)
+	}
+	return buffer, chain, nil
+}
+
+func (m *Manager) writePage(ctx context.Context, pageNumber uint64, buffer []byte) error {
+	return m.fs.WriteContext(ctx, pageNumber, func(page *paging.Page) error {
+		return page.SetPageBuffer(0, buffer, 0)
+	})
+}
+
+func (m *Manager) readPage(ctx context.Context, pageNumber uint64) ([]byte, error) {
+	page, err := m.fs.ReadContext(ctx, pageNumber)
+	if err != nil {
+		return nil, err
+	}
+	var buffer []byte
+	page.GetPageBuffer(func(b []byte) {
+		buffer = slices.Clone(b)
+	})
+	return buffer, nil
+}
+
+func (m *Manager) load(ctx context.Context, superblock []byte) error {
+	if binary.BigEndian.Uint32(superblock[0:4]) != superblockMagic {
+		return fmt.Errorf("%w : page %d is not a segment superblock", ErrCatalogCorrupted, superblockPage)
+	}
+	if !checksums.CompareCRC(crcOf(superblock[0:36]), superblock[36:40]) {
+		return fmt.Errorf("%w : superblock crc mismatch", ErrCatalogCorrupted)
+	}
+	if version := binary.BigEndian.Uint32(superblock[4:8]); version != superblockVersion {
+		return fmt.Errorf("%w : unsupported superblock version %d", ErrCatalogCorrupted, version)
+	}
+	m.generation = binary.BigEndian.Uint64(superblock[8:16])
+	head := binary.BigEndian.Uint64(superblock[16:24])
+	length := binary.BigEndian.Uint64(superblock[24:32])
+
+	directory, chain, err := m.readChain(ctx, head, length)
+	if err != nil {
+		return err
+	}
+	if !checksums.CompareCRC(crcOf(directory), superblock[32:36]) {
+		return fmt.Errorf("%w : directory crc mismatch", ErrCatalogCorrupted)
+	}
+	m.chain = chain
+	return m.deserialize(ctx, directory)
+}
+
+func crcOf(buffer []byte) []byte {
+	crc := make([]byte, 4)
+	checksums.CalculateCRC(crc, buffer)
+	return crc
+}
+
+/*
+Opens the segments of the FileSystem , formatting it on first use
+page 0 belongs to the segment manager , the FileSystem must be empty the first time
+or have page 0 free
+*/
+func NewManager(logger log.Logger, fs filesystem.FileSystem) (*Manager, error) {
+	ctx := context.Background()
+	m := &Manager{
+		logger:   logger,
+		fs:       fs,
+		segments: make(map[string]*Segment),
+		pageSize: fs.PageSize(),
+	}
+
+	_, err := fs.ReadContext(ctx, superblockPage)
+	if errors.Is(err, filesystem.ErrPageNotAllocated) || errors.Is(err, heap.ErrPageNotFound) {
+		// free or past the end of an empty address space
+		pages, mallocErr := fs.Malloc(1)
+		if mallocErr != nil {
+			return nil, mallocErr
+		}
+		if pages[0] != superblockPage {
+			fs.Free(pages)
+			return nil, fmt.Errorf("page %d is taken , the segment superblock must be page %d", superblockPage, superblockPage)
+		}
+		_, err = fs.ReadContext(ctx, superblockPage)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("error reading segment superblock")
+		return nil, err
+	}
+
+	superblock, err := m.readPage(ctx, superblockPage)
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(superblock[0:4]) == 0 && binary.BigEndian.Uint64(superblock[8:16]) == 0 {
+		// allocated but never written , a crash during the first open
+		logger.Info().Msg("formatting segment superblock")
+		if err := m.persist(); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if err := m.load(ctx, superblock); err != nil {
+		logger.Error().Err(err).Msg("error loading segment directory")
+		return nil, err
+	}
+	return m, nil
+}
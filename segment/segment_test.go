@@ -0,0 +1,186 @@
+package segment
+
+import (
+	"boro-db/filesystem"
+	"boro-db/heap"
+	"boro-db/logging"
+	"boro-db/paging"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestFileSystem(t *testing.T, dir string) filesystem.FileSystem {
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 64,
+	}
+	fs, err := filesystem.NewFileSystem(*logging.CreateDebugLogger(), &filesystem.FileSystemOptions{
+		HeapFileOptions: heapOptions,
+		PageSystemOption: paging.PageSystemOption{
+			HeapFileOptions:              heapOptions,
+			PageBufferCacheSize:          256,
+			BufferPoolEvictionIntervalms: 3600 * 1000,
+			BufferPoolFlushIntervalms:    3600 * 1000,
+			EnablePageMeta:               true,
+		},
+		ExtendAddressSpaceByPageCount: 16,
+	})
+	assert.Nil(t, err)
+	return fs
+}
+
+func TestSegments(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-segments")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	ctx := context.Background()
+	fs := openTestFileSystem(t, dir)
+	manager, err := NewManager(*logging.CreateDebugLogger(), fs)
+	assert.Nil(t, err)
+
+	sst, err := manager.Create("lsm/L0/000123.sst")
+	assert.Nil(t, err)
+	index, err := manager.Create("btree/users_idx")
+	assert.Nil(t, err)
+	_, err = manager.Create("btree/users_idx")
+	assert.ErrorIs(t, err, ErrSegmentExists)
+	_, err = manager.Create("")
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	sstPages, err := sst.Allocate(3)
+	assert.Nil(t, err)
+	indexPages, err := index.Allocate(2)
+	assert.Nil(t, err)
+	assert.NotContains(t, sstPages, uint64(0))
+	for _, page := range indexPages {
+		assert.False(t, sst.Owns(page))
+	}
+
+	assert.ErrorIs(t, sst.SetRoot(indexPages[0]), ErrPageNotOwned)
+	assert.Nil(t, index.SetRoot(indexPages[1]))
+	assert.NotNil(t, index.Release([]uint64{indexPages[1]}))
+	assert.ErrorIs(t, sst.Release(indexPages[:1]), ErrPageNotOwned)
+	assert.Nil(t, sst.Release(sstPages[1:2]))
+	assert.Equal(t, []uint64{sstPages[0], sstPages[2]}, sst.Pages())
+
+	page, err := fs.ReadContext(ctx, indexPages[1])
+	assert.Nil(t, err)
+	assert.Nil(t, page.SetPageBuffer(0, []byte("users root"), 1))
+	assert.Nil(t, fs.Close(ctx))
+
+	// a restart finds everything where it was left
+	fs = openTestFileSystem(t, dir)
+	defer fs.Close(ctx)
+	manager, err = NewManager(*logging.CreateDebugLogger(), fs)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"btree/users_idx", "lsm/L0/000123.sst"}, manager.List(""))
+	assert.Equal(t, []string{"lsm/L0/000123.sst"}, manager.List("lsm/"))
+
+	index, err = manager.Get("btree/users_idx")
+	assert.Nil(t, err)
+	assert.Equal(t, indexPages, index.Pages())
+	page, err = fs.ReadContext(ctx, index.Root())
+	assert.Nil(t, err)
+	page.GetPageBuffer(func(b []byte) {
+		assert.Equal(t, "users root", string(b[:10]))
+	})
+
+	sst, err = manager.Get("lsm/L0/000123.sst")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{sstPages[0], sstPages[2]}, sst.Pages())
+	assert.Equal(t, NoRoot, sst.Root())
+
+	// dropping gives the pages back
+	assert.Nil(t, manager.Drop("lsm/L0/000123.sst"))
+	_, err = manager.Get("lsm/L0/000123.sst")
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+	_, err = sst.Allocate(1)
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+	_, err = fs.ReadContext(ctx, sstPages[0])
+	assert.ErrorIs(t, err, filesystem.ErrPageNotAllocated)
+}
+
+func TestSegmentChainsSpanPages(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-segments-large")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	ctx := context.Background()
+	fs := openTestFileSystem(t, dir)
+	manager, err := NewManager(*logging.CreateDebugLogger(), fs)
+	assert.Nil(t, err)
+
+	// consecutive pages collapse into one extent
+	large, err := manager.Create("large")
+	assert.Nil(t, err)
+	pages, err := large.Allocate(800)
+	assert.Nil(t, err)
+	assert.Len(t, large.extents, 1)
+
+	// every other page released , 400 extents * 12 bytes do not fit a single page
+	released := make([]uint64, 0, len(pages)/2)
+	kept := make([]uint64, 0, len(pages)/2)
+	for i, page := range pages {
+		if i%2 == 0 {
+			kept = append(kept, page)
+		} else {
+			released = append(released, page)
+		}
+	}
+	assert.Nil(t, large.Release(released))
+	assert.Len(t, large.extents, 400)
+	assert.Greater(t, len(large.chain), 1)
+
+	// 200 directory entries do not fit a single page either
+	other, err := manager.Create("other")
+	assert.Nil(t, err)
+	_, err = other.Allocate(1)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		_, err := manager.Create(fmt.Sprintf("btree/index_%04d", i))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(manager.chain), 1)
+
+	// a change only rewrites the extents of the segment it touches
+	otherChain := slices.Clone(other.chain)
+	largeChain := slices.Clone(large.chain)
+	grown, err := large.Allocate(1)
+	assert.Nil(t, err)
+	assert.Equal(t, otherChain, other.chain)
+	assert.NotEqual(t, largeChain, large.chain)
+	kept = append(kept, grown...)
+	assert.Nil(t, fs.Close(ctx))
+
+	fs = openTestFileSystem(t, dir)
+	defer fs.Close(ctx)
+	manager, err = NewManager(*logging.CreateDebugLogger(), fs)
+	assert.Nil(t, err)
+	assert.Len(t, manager.List("btree/"), 200)
+	large, err = manager.Get("large")
+	assert.Nil(t, err)
+	assert.Equal(t, kept, large.Pages())
+
+	// dropping frees the extent chain along with the pages
+	chain := slices.Clone(large.chain)
+	assert.Nil(t, manager.Drop("large"))
+	_, err = fs.ReadContext(ctx, chain[0])
+	assert.ErrorIs(t, err, filesystem.ErrPageNotAllocated)
+}
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"boro-db/filesystem"
+	"boro-db/paging"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/phuslu/log"
+)
+
+var ErrOverflowCorrupted = fmt.Errorf("overflow chain corrupted")
+
+/*
+Overflow chain
+┌──────────────────────────────────────────────────────────────┐
+| next page (8byte) | used bytes (4byte) | value bytes ......  |
+└──────────────────────────────────────────────────────────────┘
+value in the owning record
+| inline (1byte) = 0 | length (2byte) | value | zero padding   |
+| overflow (1byte) = 1 | first page (8byte) | length (8byte)    |
+
+  - values that do not fit the record are cut into page sized pieces on pages from FileSystem.Malloc
+    the record only keeps a 17 byte reference to the first page
+  - inline values are padded to the size of a reference , so a record can always swap its value
+    for a reference in place
+  - the length in the reference bounds the walk , the next page of the last page is never followed
+    (page 0 is a valid chain page when nothing else claimed it)
+  - readers stream the value a page at a time , large values never have to sit in memory whole
+  - overwriting writes the new chain before the old one is freed , deleting frees the chain
+  - pages go through the page system like any other write , flush the FileSystem to make them durable
+*/
+const overflowHeaderSize = 12
+const OverflowReferenceSize = 17
+const inlineHeaderSize = 3
+
+const (
+	valueInline   = byte(0)
+	valueOverflow = byte(1)
+)
+
+type OverflowStore struct {
+	logger log.Logger
+	fs     filesystem.FileSystem
+}
+
+// first page and length of a value stored in an overflow chain
+type OverflowReference struct {
+	FirstPage uint64
+	Length    uint64
+}
+
+func NewOverflowStore(logger log.Logger, fs filesystem.FileSystem) *OverflowStore {
+	return &OverflowStore{
+		logger: logger,
+		fs:     fs,
+	}
+}
+
+// bytes of a value an overflow page holds
+func (o *OverflowStore) perPage() int {
+	return o.fs.PageSize() - overflowHeaderSize
+}
+
+// writes value into a new chain
+func (o *OverflowStore) Write(value []byte) (OverflowReference, error) {
+	ctx := context.Background()
+	if len(value) == 0 {
+		return OverflowReference{}, fmt.Errorf("empty values are stored inline")
+	}
+
+	perPage := o.perPage()
+	pages, err := o.fs.Malloc(uint64((len(value) + perPage - 1) / perPage))
+	if err != nil {
+		return OverflowReference{}, err
+	}
+
+	for i, pageNumber := range pages {
+		part := value[i*perPage : min((i+1)*perPage, len(value))]
+		buffer := make([]byte, overflowHeaderSize+len(part))
+		if i+1 < len(pages) {
+			binary.BigEndian.PutUint64(buffer[0:8], pages[i+1])
+		}
+		binary.BigEndian.PutUint32(buffer[8:12], uint32(len(part)))
+		copy(buffer[overflowHeaderSize:], part)
+		err := o.fs.WriteContext(ctx, pageNumber, func(page *paging.Page) error {
+			return page.SetPageBuffer(0, buffer, 0)
+		})
+		if err != nil {
+			o.logger.Error().Err(err).Msg(fmt.Sprintf("error writing overflow page %d", pageNumber))
+			return OverflowReference{}, errors.Join(err, o.fs.Free(pages))
+		}
+	}
+	return OverflowReference{FirstPage: pages[0], Length: uint64(len(value))}, nil
+}
+
+// streams the value of the chain
+func (o *OverflowStore) NewReader(ref OverflowReference) io.Reader {
+	return &overflowReader{
+		store:     o,
+		next:      ref.FirstPage,
+		remaining: ref.Length,
+	}
+}
+
+func (o *OverflowStore) Read(ref OverflowReference) ([]byte, error) {
+	value := make([]byte, ref.Length)
+	if _, err := io.ReadFull(o.NewReader(ref), value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// frees every page of the chain
+func (o *OverflowStore) Free(ref OverflowReference) error {
+	pages, err := o.chain(ref)
+	if err != nil {
+		return err
+	}
+	return o.fs.Free(pages)
+}
+
+// page numbers of the chain , checked against the length in the reference
+func (o *OverflowStore) chain(ref OverflowReference) ([]uint64, error) {
+	pages := make([]uint64, 0)
+	reader := o.NewReader(ref).(*overflowReader)
+	for {
+		current := reader.next
+		_, err := reader.nextPage()
+		if err == io.EOF {
+			return pages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, current)
+	}
+}
+
+type overflowReader struct {
+	store     *OverflowStore
+	next      uint64
+	remaining uint64
+	// unread bytes of the current page
+	pending []byte
+}
+
+func (r *overflowReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		part, err := r.nextPage()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = part
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// value bytes of the next page , io.EOF once the length is read
+func (r *overflowReader) nextPage() ([]byte, error) {
+	if r.remaining == 0 {
+		return nil, io.EOF
+	}
+	page, err := r.store.fs.ReadContext(context.Background(), r.next)
+	if err != nil {
+		return nil, err
+	}
+	var next uint64
+	var used int
+	var buffer []byte
+	page.GetPageBuffer(func(b []byte) {
+		next = binary.BigEndian.Uint64(b[0:8])
+		used = int(binary.BigEndian.Uint32(b[8:12]))
+		if used <= len(b)-overflowHeaderSize {
+			buffer = slices.Clone(b[overflowHeaderSize : overflowHeaderSize+used])
+		}
+	})
+	if used == 0 || used > page.Size()-overflowHeaderSize || uint64(used) > r.remaining {
+		return nil, fmt.Errorf("%w : page %d claims %d bytes , %d left", ErrOverflowCorrupted, r.next, used, r.remaining)
+	}
+	r.next = next
+	r.remaining -= uint64(used)
+	return buffer, nil
+}
+
+func (ref OverflowReference) Bytes() []byte {
+	buffer := make([]byte, 0, OverflowReferenceSize-1)
+	buffer = binary.BigEndian.AppendUint64(buffer, ref.FirstPage)
+	return binary.BigEndian.AppendUint64(buffer, ref.Length)
+}
+
+/*
+encodes value for the owning record , inline when it is at most inlineLimit bytes
+otherwise in an overflow chain with the reference stored inline
+an inlineLimit of 0 always writes a chain , empty values excepted
+*/
+func (o *OverflowStore) EncodeValue(value []byte, inlineLimit int) ([]byte, error) {
+	if (len(value) <= inlineLimit && len(value) <= math.MaxUint16) || len(value) == 0 {
+		encoded := make([]byte, max(inlineHeaderSize+len(value), OverflowReferenceSize))
+		encoded[0] = valueInline
+		binary.BigEndian.PutUint16(encoded[1:3], uint16(len(value)))
+		copy(encoded[inlineHeaderSize:], value)
+		return encoded, nil
+	}
+	ref, err := o.Write(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{valueOverflow}, ref.Bytes()...), nil
+}
+
+// inline bytes or the reference of an encoded value
+func decodeValue(encoded []byte) ([]byte, OverflowReference, bool, error) {
+	if len(encoded) < OverflowReferenceSize {
+		return nil, OverflowReference{}, false, fmt.Errorf("%w : encoded value of %d bytes", ErrOverflowCorrupted, len(encoded))
+	}
+	switch encoded[0] {
+	case valueInline:
+		length := int(binary.BigEndian.Uint16(encoded[1:3]))
+		if inlineHeaderSize+length > len(encoded) {
+			return nil, OverflowReference{}, false, fmt.Errorf("%w : value of %d bytes in %d", ErrOverflowCorrupted, length, len(encoded))
+		}
+		return encoded[inlineHeaderSize : inlineHeaderSize+length], OverflowReference{}, false, nil
+	case valueOverflow:
+		if len(encoded) != OverflowReferenceSize {
+			return nil, OverflowReference{}, false, fmt.Errorf("%w : reference of %d bytes", ErrOverflowCorrupted, len(encoded))
+		}
+		return nil, OverflowReference{
+			FirstPage: binary.BigEndian.Uint64(encoded[1:9]),
+			Length:    binary.BigEndian.Uint64(encoded[9:17]),
+		}, true, nil
+	}
+	return nil, OverflowReference{}, false, fmt.Errorf("%w : unknown value kind %d", ErrOverflowCorrupted, encoded[0])
+}
+
+func (o *OverflowStore) DecodeValue(encoded []byte) ([]byte, error) {
+	inline, ref, overflow, err := decodeValue(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if !overflow {
+		return slices.Clone(inline), nil
+	}
+	return o.Read(ref)
+}
+
+// streams an encoded value , inline or not
+func (o *OverflowStore) ValueReader(encoded []byte) (io.Reader, error) {
+	inline, ref, overflow, err := decodeValue(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if !overflow {
+		return &overflowReader{pending: slices.Clone(inline)}, nil
+	}
+	return o.NewReader(ref), nil
+}
+
+/*
+frees the overflow chain of an encoded value that is deleted or overwritten , inline values own no pages
+an owner overwriting a value frees the old one only once the record holding the new one is written
+*/
+func (o *OverflowStore) ReleaseValue(encoded []byte) error {
+	_, ref, overflow, err := decodeValue(encoded)
+	if err != nil || !overflow {
+		return err
+	}
+	return o.Free(ref)
+}
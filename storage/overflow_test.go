@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"boro-db/filesystem"
+	"boro-db/heap"
+	"boro-db/logging"
+	"boro-db/paging"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestFileSystem(t *testing.T, dir string) filesystem.FileSystem {
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 64,
+	}
+	fs, err := filesystem.NewFileSystem(*logging.CreateDebugLogger(), &filesystem.FileSystemOptions{
+		HeapFileOptions: heapOptions,
+		PageSystemOption: paging.PageSystemOption{
+			HeapFileOptions:              heapOptions,
+			PageBufferCacheSize:          256,
+			BufferPoolEvictionIntervalms: 3600 * 1000,
+			BufferPoolFlushIntervalms:    3600 * 1000,
+			EnablePageMeta:               true,
+		},
+		ExtendAddressSpaceByPageCount: 16,
+	})
+	assert.Nil(t, err)
+	return fs
+}
+
+func freePages(t *testing.T, fs filesystem.FileSystem) uint64 {
+	stats, err := fs.Stats()
+	assert.Nil(t, err)
+	return stats.FreePages
+}
+
+func TestOverflowValues(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-overflow")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	fs := openTestFileSystem(t, dir)
+	store := NewOverflowStore(*logging.CreateDebugLogger(), fs)
+
+	small := []byte("fits in the record")
+	encoded, err := store.EncodeValue(small, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, max(len(small)+3, OverflowReferenceSize), len(encoded))
+	decoded, err := store.DecodeValue(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, small, decoded)
+
+	// a bit over 3 pages of data
+	large := make([]byte, 4096*3+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	// grow the heap so the free page count is only moved by the chains
+	pages, err := fs.Malloc(1)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Free(pages))
+	before := freePages(t, fs)
+	encoded, err = store.EncodeValue(large, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, OverflowReferenceSize, len(encoded))
+	assert.Equal(t, before-4, freePages(t, fs))
+
+	decoded, err = store.DecodeValue(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, large, decoded)
+
+	// streamed a few bytes at a time
+	reader, err := store.ValueReader(encoded)
+	assert.Nil(t, err)
+	streamed := bytes.NewBuffer(nil)
+	_, err = io.CopyBuffer(streamed, struct{ io.Reader }{reader}, make([]byte, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, large, streamed.Bytes())
+
+	// overwriting with a small value frees the chain
+	replaced, err := store.EncodeValue(small, 64)
+	assert.Nil(t, err)
+	assert.Nil(t, store.ReleaseValue(encoded))
+	assert.Equal(t, before, freePages(t, fs))
+	reader, err = store.ValueReader(replaced)
+	assert.Nil(t, err)
+	all, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, small, all)
+
+	// an inline limit of 0 forces a chain , empty values stay inline
+	forced, err := store.EncodeValue(small, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(valueOverflow), forced[0])
+	empty, err := store.EncodeValue(nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, OverflowReferenceSize, len(empty))
+	assert.Nil(t, store.ReleaseValue(forced))
+	assert.Nil(t, store.ReleaseValue(empty))
+
+	// and deleting an overflow value frees its pages
+	encoded, err = store.EncodeValue(large[:5000], 64)
+	assert.Nil(t, err)
+	assert.Equal(t, before-2, freePages(t, fs))
+	assert.Nil(t, store.ReleaseValue(encoded))
+	assert.Nil(t, store.ReleaseValue(replaced))
+	assert.Equal(t, before, freePages(t, fs))
+
+	_, err = store.DecodeValue([]byte{7, 1, 2})
+	assert.ErrorIs(t, err, ErrOverflowCorrupted)
+
+	assert.Nil(t, fs.Close(context.Background()))
+}
@@ -0,0 +1,96 @@
+package table
+
+import (
+	"math/bits"
+)
+
+/*
+Free space map
+  - room is the size of the largest record a page takes right now (SlottedPage.FreeSpace)
+  - pages are kept in one bucket per room in bytes , a bitmap marks the buckets holding pages
+  - an insert takes a page from the smallest bucket with enough room (best fit)
+    found by scanning the bitmap a word at a time , 64 words for a 4K page
+  - pages with less room than the smallest record are only counted , never handed out
+*/
+type freeSpaceMap struct {
+	// room of every page of the table
+	room map[uint64]int
+	// pages with room , by room in bytes
+	buckets [][]uint64
+	// index of a page in its bucket
+	position map[uint64]int
+	// bit set for every non empty bucket
+	nonEmpty []uint64
+}
+
+func newFreeSpaceMap(maxRoom int) *freeSpaceMap {
+	return &freeSpaceMap{
+		room:     make(map[uint64]int),
+		buckets:  make([][]uint64, maxRoom+1),
+		position: make(map[uint64]int),
+		nonEmpty: make([]uint64, (maxRoom+64)/64),
+	}
+}
+
+func (f *freeSpaceMap) contains(pageNumber uint64) bool {
+	_, ok := f.room[pageNumber]
+	return ok
+}
+
+// records the room left in the page , adding it to the map if it is new
+func (f *freeSpaceMap) set(pageNumber uint64, room int) {
+	f.remove(pageNumber)
+	room = min(room, len(f.buckets)-1)
+	f.room[pageNumber] = room
+	if room < minRecordSize {
+		return
+	}
+	f.position[pageNumber] = len(f.buckets[room])
+	f.buckets[room] = append(f.buckets[room], pageNumber)
+	f.nonEmpty[room/64] |= 1 << (room % 64)
+}
+
+func (f *freeSpaceMap) remove(pageNumber uint64) {
+	room, ok := f.room[pageNumber]
+	if !ok {
+		return
+	}
+	delete(f.room, pageNumber)
+	index, ok := f.position[pageNumber]
+	if !ok {
+		return
+	}
+	delete(f.position, pageNumber)
+	bucket := f.buckets[room]
+	last := bucket[len(bucket)-1]
+	bucket[index] = last
+	f.position[last] = index
+	if last == pageNumber {
+		delete(f.position, last)
+	}
+	f.buckets[room] = bucket[:len(bucket)-1]
+	if len(f.buckets[room]) == 0 {
+		f.nonEmpty[room/64] &^= 1 << (room % 64)
+	}
+}
+
+// page with the least room that still takes a record of size bytes
+func (f *freeSpaceMap) find(size int) (uint64, bool) {
+	if size >= len(f.buckets) {
+		return 0, false
+	}
+	size = max(size, 0)
+	word := size / 64
+	mask := f.nonEmpty[word] &^ (1<<(size%64) - 1)
+	for {
+		if mask != 0 {
+			bucket := f.buckets[word*64+bits.TrailingZeros64(mask)]
+			return bucket[len(bucket)-1], true
+		}
+		word++
+		if word == len(f.nonEmpty) {
+			return 0, false
+		}
+		mask = f.nonEmpty[word]
+	}
+}
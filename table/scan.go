@@ -0,0 +1,98 @@
+package table
+
+import (
+	"boro-db/paging"
+	"context"
+	"errors"
+)
+
+/*
+Full table scan in page order
+  - rows are read a page at a time , each page is a snapshot taken under the table lock
+    its rows are decoded under the lock too , an Update or Delete can not free an overflow chain
+    while the scan reads it
+  - rows inserted , updated or deleted in a page the scan already passed are not seen
+    pages added to the table while scanning are
+  - call Next until it returns false , then Err tells an error from the end of the table
+*/
+type Scanner struct {
+	table *Table
+	// index in table.pages of the next page to load
+	nextPage int
+	// decoded rows of the current page
+	rows []scannedRow
+	rid  RID
+	row  []byte
+	err  error
+}
+
+type scannedRow struct {
+	rid RID
+	row []byte
+}
+
+func (t *Table) Scan() *Scanner {
+	return &Scanner{table: t}
+}
+
+// advances to the next row , false at the end or on error
+func (s *Scanner) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	ctx := context.Background()
+	for len(s.rows) == 0 {
+		if !s.loadPage(ctx) {
+			return false
+		}
+	}
+	s.rid, s.row = s.rows[0].rid, s.rows[0].row
+	s.rows = s.rows[1:]
+	return true
+}
+
+func (s *Scanner) loadPage(ctx context.Context) bool {
+	s.table.lock.RLock()
+	defer s.table.lock.RUnlock()
+	if s.nextPage >= len(s.table.pages) {
+		return false
+	}
+	pageNumber := s.table.pages[s.nextPage]
+	page, err := s.table.readPage(ctx, pageNumber)
+	if err != nil {
+		s.err = err
+		return false
+	}
+	rows := make([]scannedRow, 0, page.SlotCount())
+	for slot := uint16(0); slot < page.SlotCount(); slot++ {
+		record, err := page.Get(slot)
+		if errors.Is(err, paging.ErrSlotNotFound) {
+			continue
+		}
+		var row []byte
+		if err == nil {
+			row, err = s.table.decode(record)
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		rows = append(rows, scannedRow{rid: RID{Page: pageNumber, Slot: slot}, row: row})
+	}
+	s.nextPage++
+	s.rows = rows
+	return true
+}
+
+func (s *Scanner) RID() RID {
+	return s.rid
+}
+
+// the current row , valid until the next call to Next
+func (s *Scanner) Row() []byte {
+	return s.row
+}
+
+func (s *Scanner) Err() error {
+	return s.err
+}
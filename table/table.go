@@ -0,0 +1,320 @@
+package table
+
+import (
+	"boro-db/filesystem"
+	"boro-db/paging"
+	"boro-db/segment"
+	"boro-db/storage"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/phuslu/log"
+)
+
+var ErrRowNotFound = fmt.Errorf("row not found")
+var ErrRowCorrupted = fmt.Errorf("row corrupted")
+
+// page + slot of a row , what indexes store
+type RID = paging.RecordID
+
+/*
+Table heap
+┌──────────────────────────────────────────────────────────────┐
+| slotted page | slotted page | slotted page | ...             |
+| rows ....... | rows ....... | rows ....... |                 |
+└──────────────────────────────────────────────────────────────┘
+row record , the row encoded by storage.OverflowStore.EncodeValue
+| inline (1byte) = 0 | row length (2byte) | row | zero padding |
+| overflow (1byte) = 1 | first page (8byte) | length (8byte)   |
+
+  - the pages of the table are the pages of its segment , a row is addressed by RID (page , slot)
+  - the free space map tracks the room left in every page , inserts go to the page with the least
+    room that fits (see freespace.go) , a new page is only allocated when none has room
+    it is rebuilt from the pages on open
+  - rows over a quarter of a page go to an overflow chain and the record keeps the reference
+  - every record takes at least the size of an overflow reference , an update that no longer
+    fits its page turns into an overflow row in the same slot , so a RID never changes
+  - slots of deleted rows are reused , an index must drop a RID when its row is deleted
+  - rows are not logged , flush the FileSystem to make them durable
+*/
+const minRecordSize = storage.OverflowReferenceSize
+
+type Table struct {
+	logger   log.Logger
+	fs       filesystem.FileSystem
+	segment  *segment.Segment
+	overflow *storage.OverflowStore
+	lock     sync.RWMutex
+	// scan order
+	pages []uint64
+	free  *freeSpaceMap
+	// usable bytes of a page
+	pageSize int
+}
+
+// rows longer than this go to an overflow chain
+func (t *Table) inlineLimit() int {
+	return paging.MaxRecordSize(t.pageSize) / 4
+}
+
+func (t *Table) Insert(row []byte) (RID, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ctx := context.Background()
+
+	record, err := t.overflow.EncodeValue(row, t.inlineLimit())
+	if err != nil {
+		return RID{}, err
+	}
+
+	pageNumber, ok := t.free.find(len(record))
+	if !ok {
+		if pageNumber, err = t.allocatePage(ctx); err != nil {
+			return RID{}, errors.Join(err, t.overflow.ReleaseValue(record))
+		}
+	}
+	sp, err := t.readPage(ctx, pageNumber)
+	if err != nil {
+		return RID{}, errors.Join(err, t.overflow.ReleaseValue(record))
+	}
+	slot, err := sp.Insert(record)
+	if err != nil {
+		return RID{}, errors.Join(err, t.overflow.ReleaseValue(record))
+	}
+	if err := t.writePage(ctx, pageNumber, sp); err != nil {
+		return RID{}, errors.Join(err, t.overflow.ReleaseValue(record))
+	}
+	return RID{Page: pageNumber, Slot: slot}, nil
+}
+
+func (t *Table) Get(rid RID) ([]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	record, _, err := t.record(context.Background(), rid)
+	if err != nil {
+		return nil, err
+	}
+	return t.decode(record)
+}
+
+// replaces the row , the RID stays the same
+func (t *Table) Update(rid RID, row []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ctx := context.Background()
+
+	previous, sp, err := t.record(ctx, rid)
+	if err != nil {
+		return err
+	}
+	record, err := t.overflow.EncodeValue(row, t.inlineLimit())
+	if err != nil {
+		return err
+	}
+	err = sp.Update(rid.Slot, record)
+	if errors.Is(err, paging.ErrPageFull) && len(row) <= t.inlineLimit() {
+		// no room left in the page , an overflow reference is never larger than the old record
+		if record, err = t.overflow.EncodeValue(row, 0); err != nil {
+			return err
+		}
+		err = sp.Update(rid.Slot, record)
+	}
+	if err == nil {
+		err = t.writePage(ctx, rid.Page, sp)
+	}
+	if err != nil {
+		return errors.Join(err, t.overflow.ReleaseValue(record))
+	}
+	if err := t.overflow.ReleaseValue(previous); err != nil {
+		// the new row is in place , the old chain is only leaked
+		t.logger.Warn().Err(err).Msg(fmt.Sprintf("error freeing overflow chain of row %s", rid))
+	}
+	return nil
+}
+
+func (t *Table) Delete(rid RID) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ctx := context.Background()
+
+	record, sp, err := t.record(ctx, rid)
+	if err != nil {
+		return err
+	}
+	if err := sp.Delete(rid.Slot); err != nil {
+		return err
+	}
+	if err := t.writePage(ctx, rid.Page, sp); err != nil {
+		return err
+	}
+	return t.overflow.ReleaseValue(record)
+}
+
+// rows in the table
+func (t *Table) Count() (int, error) {
+	count := 0
+	scanner := t.Scan()
+	for scanner.Next() {
+		count++
+	}
+	return count, scanner.Err()
+}
+
+/*
+deletes every row and hands the pages back to the segment
+drop the rows this way before dropping the segment , the segment does not know the overflow chains
+a page is written back empty before the chains of its rows are freed , a Truncate that fails
+half way leaves every remaining row readable and at worst leaks chains
+*/
+func (t *Table) Truncate() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ctx := context.Background()
+
+	for _, pageNumber := range t.pages {
+		sp, err := t.readPage(ctx, pageNumber)
+		if err != nil {
+			return err
+		}
+		records := make([][]byte, 0, sp.SlotCount())
+		for slot := uint16(0); slot < sp.SlotCount(); slot++ {
+			record, err := sp.Get(slot)
+			if errors.Is(err, paging.ErrSlotNotFound) {
+				continue
+			}
+			records = append(records, record)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		empty, err := paging.NewSlottedPage(make([]byte, t.pageSize))
+		if err != nil {
+			return err
+		}
+		if err := t.writePage(ctx, pageNumber, empty); err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := t.overflow.ReleaseValue(record); err != nil {
+				// no slot references the chain any more , it is only leaked
+				t.logger.Warn().Err(err).Msg(fmt.Sprintf("error freeing overflow chain in page %d", pageNumber))
+			}
+		}
+	}
+	if err := t.segment.Release(t.pages); err != nil {
+		return err
+	}
+	t.pages = make([]uint64, 0)
+	t.free = newFreeSpaceMap(paging.MaxRecordSize(t.pageSize))
+	return nil
+}
+
+// caller must hold the lock
+func (t *Table) allocatePage(ctx context.Context) (uint64, error) {
+	pages, err := t.segment.Allocate(1)
+	if err != nil {
+		t.logger.Error().Err(err).Msg("error allocating table page")
+		return 0, err
+	}
+	sp, err := paging.NewSlottedPage(make([]byte, t.pageSize))
+	if err == nil {
+		err = t.writePage(ctx, pages[0], sp)
+	}
+	if err != nil {
+		return 0, errors.Join(err, t.segment.Release(pages))
+	}
+	t.pages = append(t.pages, pages[0])
+	return pages[0], nil
+}
+
+/*
+slotted page of a table page
+a page allocated right before a crash was never formatted and reads as an empty page
+caller must hold the lock
+*/
+func (t *Table) readPage(ctx context.Context, pageNumber uint64) (*paging.SlottedPage, error) {
+	page, err := t.fs.ReadContext(ctx, pageNumber)
+	if err != nil {
+		return nil, err
+	}
+	var buffer []byte
+	page.GetPageBuffer(func(b []byte) {
+		buffer = slices.Clone(b)
+	})
+
+	sp, err := paging.LoadSlottedPage(buffer)
+	if errors.Is(err, paging.ErrNotSlotted) && !slices.ContainsFunc(buffer, func(b byte) bool { return b != 0 }) {
+		return paging.NewSlottedPage(buffer)
+	}
+	if err != nil {
+		t.logger.Error().Err(err).Msg(fmt.Sprintf("error loading table page %d", pageNumber))
+		return nil, err
+	}
+	return sp, nil
+}
+
+// writes the page and updates the free space map , caller must hold the lock
+func (t *Table) writePage(ctx context.Context, pageNumber uint64, sp *paging.SlottedPage) error {
+	err := t.fs.WriteContext(ctx, pageNumber, func(page *paging.Page) error {
+		return page.SetPageBuffer(0, sp.Bytes(), 0)
+	})
+	if err != nil {
+		t.logger.Error().Err(err).Msg(fmt.Sprintf("error writing table page %d", pageNumber))
+		return err
+	}
+	t.free.set(pageNumber, sp.FreeSpace())
+	return nil
+}
+
+// record of a live row and the page holding it , caller must hold the lock
+func (t *Table) record(ctx context.Context, rid RID) ([]byte, *paging.SlottedPage, error) {
+	if !t.free.contains(rid.Page) {
+		return nil, nil, fmt.Errorf("%w : %s is not a page of the table", ErrRowNotFound, rid)
+	}
+	sp, err := t.readPage(ctx, rid.Page)
+	if err != nil {
+		return nil, nil, err
+	}
+	record, err := sp.Get(rid.Slot)
+	if errors.Is(err, paging.ErrSlotNotFound) {
+		return nil, nil, fmt.Errorf("%w : %s", ErrRowNotFound, rid)
+	}
+	return record, sp, err
+}
+
+// rows with a corrupted record or overflow chain fail with ErrRowCorrupted
+func (t *Table) decode(record []byte) ([]byte, error) {
+	row, err := t.overflow.DecodeValue(record)
+	if errors.Is(err, storage.ErrOverflowCorrupted) {
+		return nil, fmt.Errorf("%w : %w", ErrRowCorrupted, err)
+	}
+	return row, err
+}
+
+/*
+Opens the table stored in the pages of seg (see catalog.Table.Segment)
+reads every page once to build the free space map
+*/
+func NewTable(logger log.Logger, fs filesystem.FileSystem, seg *segment.Segment) (*Table, error) {
+	t := &Table{
+		logger:   logger,
+		fs:       fs,
+		segment:  seg,
+		overflow: storage.NewOverflowStore(logger, fs),
+		pages:    seg.Pages(),
+		pageSize: fs.PageSize(),
+	}
+	t.free = newFreeSpaceMap(paging.MaxRecordSize(t.pageSize))
+	ctx := context.Background()
+	for _, pageNumber := range t.pages {
+		sp, err := t.readPage(ctx, pageNumber)
+		if err != nil {
+			return nil, err
+		}
+		t.free.set(pageNumber, sp.FreeSpace())
+	}
+	return t, nil
+}
@@ -0,0 +1,249 @@
+package table
+
+import (
+	"boro-db/filesystem"
+	"boro-db/heap"
+	"boro-db/logging"
+	"boro-db/paging"
+	"boro-db/segment"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestTable(t *testing.T, dir string) (filesystem.FileSystem, *Table) {
+	logger := *logging.CreateDebugLogger()
+	heapOptions := heap.HeapFileOptions{
+		PageSizeByte:        4096,
+		FileDirectory:       dir,
+		MaxHeapFileSizeByte: 4096 * 64,
+	}
+	fs, err := filesystem.NewFileSystem(logger, &filesystem.FileSystemOptions{
+		HeapFileOptions: heapOptions,
+		PageSystemOption: paging.PageSystemOption{
+			HeapFileOptions:              heapOptions,
+			PageBufferCacheSize:          256,
+			BufferPoolEvictionIntervalms: 3600 * 1000,
+			BufferPoolFlushIntervalms:    3600 * 1000,
+			EnablePageMeta:               true,
+		},
+		ExtendAddressSpaceByPageCount: 16,
+	})
+	assert.Nil(t, err)
+	segments, err := segment.NewManager(logger, fs)
+	assert.Nil(t, err)
+	seg, err := segments.Get("table/users")
+	if err != nil {
+		seg, err = segments.Create("table/users")
+		assert.Nil(t, err)
+	}
+	table, err := NewTable(logger, fs, seg)
+	assert.Nil(t, err)
+	return fs, table
+}
+
+func scanAll(t *testing.T, table *Table) map[RID][]byte {
+	rows := make(map[RID][]byte)
+	scanner := table.Scan()
+	for scanner.Next() {
+		rows[scanner.RID()] = scanner.Row()
+	}
+	assert.Nil(t, scanner.Err())
+	return rows
+}
+
+func TestTable(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-table")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	fs, table := openTestTable(t, dir)
+
+	// enough rows for several pages
+	rows := make(map[RID][]byte)
+	order := make([]RID, 0)
+	for i := 0; i < 300; i++ {
+		row := []byte(fmt.Sprintf("user-%03d:%s", i, bytes.Repeat([]byte{'x'}, i%50)))
+		rid, err := table.Insert(row)
+		assert.Nil(t, err)
+		rows[rid] = row
+		order = append(order, rid)
+	}
+	assert.Greater(t, len(table.pages), 1)
+	for rid, row := range rows {
+		got, err := table.Get(rid)
+		assert.Nil(t, err)
+		assert.Equal(t, row, got)
+	}
+	assert.Equal(t, rows, scanAll(t, table))
+
+	// rows over a quarter page go to an overflow chain
+	large := bytes.Repeat([]byte("large row "), 1000)
+	largeRID, err := table.Insert(large)
+	assert.Nil(t, err)
+	got, err := table.Get(largeRID)
+	assert.Nil(t, err)
+	assert.Equal(t, large, got)
+	rows[largeRID] = large
+
+	// an update that outgrows the full first page keeps its RID
+	grown := bytes.Repeat([]byte{'g'}, 900)
+	assert.Nil(t, table.Update(order[0], grown))
+	got, err = table.Get(order[0])
+	assert.Nil(t, err)
+	assert.Equal(t, grown, got)
+	rows[order[0]] = grown
+	assert.Nil(t, table.Update(order[0], []byte("small again")))
+	rows[order[0]] = []byte("small again")
+	assert.Nil(t, table.Update(largeRID, []byte("no longer large")))
+	rows[largeRID] = []byte("no longer large")
+
+	// deleted rows are gone and their room is reused by the next insert
+	assert.Nil(t, table.Delete(order[1]))
+	delete(rows, order[1])
+	_, err = table.Get(order[1])
+	assert.ErrorIs(t, err, ErrRowNotFound)
+	assert.ErrorIs(t, table.Delete(order[1]), ErrRowNotFound)
+	_, err = table.Get(RID{Page: 123456, Slot: 0})
+	assert.ErrorIs(t, err, ErrRowNotFound)
+	rid, err := table.Insert([]byte("reused"))
+	assert.Nil(t, err)
+	assert.Equal(t, order[1].Page, rid.Page)
+	rows[rid] = []byte("reused")
+
+	assert.Equal(t, rows, scanAll(t, table))
+	assert.Nil(t, fs.Close(context.Background()))
+
+	fs, table = openTestTable(t, dir)
+	assert.Equal(t, rows, scanAll(t, table))
+	count, err := table.Count()
+	assert.Nil(t, err)
+	assert.Equal(t, len(rows), count)
+
+	// truncating gives back every page , overflow chains included
+	tablePages := uint64(len(table.segment.Pages()))
+	before, err := fs.Stats()
+	assert.Nil(t, err)
+	_, err = table.Insert(large)
+	assert.Nil(t, err)
+	assert.Nil(t, table.Truncate())
+	after, err := fs.Stats()
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, after.AllocatedPages, before.AllocatedPages-tablePages)
+	assert.Empty(t, table.segment.Pages())
+	assert.Empty(t, scanAll(t, table))
+
+	rid, err = table.Insert([]byte("after truncate"))
+	assert.Nil(t, err)
+	got, err = table.Get(rid)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after truncate"), got)
+	assert.Nil(t, fs.Close(context.Background()))
+}
+
+func TestFreeSpaceMap(t *testing.T) {
+
+	free := newFreeSpaceMap(paging.MaxRecordSize(4096))
+	free.set(1, 100)
+	free.set(2, 40)
+	free.set(3, 3000)
+	// too little room for any record , known but never handed out
+	free.set(4, minRecordSize-1)
+
+	page, ok := free.find(30)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), page)
+	page, ok = free.find(41)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), page)
+	page, ok = free.find(101)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), page)
+	_, ok = free.find(3001)
+	assert.False(t, ok)
+	page, ok = free.find(minRecordSize)
+	assert.True(t, ok)
+	assert.NotEqual(t, uint64(4), page)
+	assert.True(t, free.contains(4))
+
+	// a page moves between buckets as its room changes
+	free.set(3, 20)
+	page, ok = free.find(30)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), page)
+	_, ok = free.find(101)
+	assert.False(t, ok)
+	free.remove(2)
+	free.remove(1)
+	assert.False(t, free.contains(2))
+	page, ok = free.find(minRecordSize)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), page)
+	_, ok = free.find(21)
+	assert.False(t, ok)
+}
+
+func TestConcurrentScanAndDelete(t *testing.T) {
+
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-table-scan")
+
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+
+	fs, table := openTestTable(t, dir)
+	defer fs.Close(context.Background())
+
+	// overflow rows , a scan reading a freed chain would see another row's bytes
+	rowOf := func(i int, version byte) []byte {
+		return append([]byte(fmt.Sprintf("row-%03d-%d:", i, version)), bytes.Repeat([]byte{version}, 12000)...)
+	}
+	rids := make([]RID, 0)
+	for i := 0; i < 8; i++ {
+		rid, err := table.Insert(rowOf(i, 0))
+		assert.Nil(t, err)
+		rids = append(rids, rid)
+	}
+
+	// every update frees the chain of the old row , the next one takes its pages
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; round <= 50; round++ {
+			for i, rid := range rids {
+				assert.Nil(t, table.Update(rid, rowOf(i, byte(round))))
+			}
+		}
+		for _, rid := range rids {
+			assert.Nil(t, table.Delete(rid))
+		}
+	}()
+
+	for scanning := true; scanning; {
+		select {
+		case <-done:
+			scanning = false
+		default:
+		}
+		scanner := table.Scan()
+		for scanner.Next() {
+			row := scanner.Row()
+			var i, version int
+			_, err := fmt.Sscanf(string(row), "row-%03d-%d:", &i, &version)
+			assert.Nil(t, err)
+			assert.Equal(t, rowOf(i, byte(version)), row)
+		}
+		assert.Nil(t, scanner.Err())
+	}
+	assert.Empty(t, scanAll(t, table))
+}
@@ -27,7 +27,8 @@ type Node[K comparable, V any] struct {
 }
 
 func (c *LRUCache[K, V]) Size() int {
-
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.length
 }
 
@@ -52,18 +53,19 @@ func (c *LRUCache[K, V]) Range(onEach func(K, V) bool) {
 	}
 }
 
+// Compact holds a global lock and evicts from the head until the cache is back to its size
+// nodes onEvict refuses (dirty pages) are skipped , every node is looked at once at most
 func (c *LRUCache[K, V]) Compact(onEvict func(K, V) bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if c.length <= c.size {
-		return
-	}
 
-	for c.length > c.size {
-		key := c.listHead.key
-		c.Evict(key, func(v V) bool {
-			return onEvict(key, v)
+	node := c.listHead
+	for remaining := c.length; remaining > 0 && c.length > c.size; remaining-- {
+		next := node.next
+		c.evict(node, func(v V) bool {
+			return onEvict(node.key, v)
 		})
+		node = next
 	}
 }
 
@@ -76,26 +78,34 @@ func (c *LRUCache[K, V]) Evict(key K, preEvict func(V) bool) bool {
 	if !ok {
 		return false
 	}
+	return c.evict(node, preEvict)
+}
 
+// caller must hold the lock
+func (c *LRUCache[K, V]) evict(node *Node[K, V], preEvict func(V) bool) bool {
 	if !preEvict(node.value) {
 		return false
 	}
 
-	delete(c.cache, key)
+	delete(c.cache, node.key)
+	c.unlink(node)
+	c.length--
+	return true
+}
 
+// takes node out of the list , caller must hold the lock
+func (c *LRUCache[K, V]) unlink(node *Node[K, V]) {
+	if node.next == node {
+		c.listHead = nil
+		return
+	}
 	node.prev.next = node.next
 	node.next.prev = node.prev
-
 	if c.listHead == node {
 		c.listHead = node.next
 	}
-
-	if c.length == 1 {
-		c.listHead = nil
-	}
-
-	c.length--
-	return true
+	node.prev = node
+	node.next = node
 }
 
 // Put holds a global lock and adds a value to the cache
@@ -110,6 +120,11 @@ func (c *LRUCache[K, V]) Put(key K, value V) {
 	node.prev = node
 	node.next = node
 
+	// a second Put for the key replaces the node , a stale one left in the list breaks Range
+	if old, ok := c.cache[key]; ok {
+		c.unlink(old)
+		c.length--
+	}
 	c.cache[key] = node
 
 	if c.listHead != nil {
@@ -125,9 +140,10 @@ func (c *LRUCache[K, V]) Put(key K, value V) {
 }
 
 // Get holds a global lock and returns a value from the cache
+// it moves the node in the list so it needs the write lock
 func (c *LRUCache[K, V]) Get(key K) (V, bool) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	value, ok := c.cache[key]
 
 	var def V
@@ -135,8 +151,12 @@ func (c *LRUCache[K, V]) Get(key K) (V, bool) {
 		return def, false
 	}
 
-	value.prev.next = value.next
-	value.next.prev = value.prev
+	if value == c.listHead {
+		// moving the head behind the tail is a rotation of the ring
+		c.listHead = value.next
+		return value.value, true
+	}
+	c.unlink(value)
 
 	c.listHead.prev.next = value
 	value.prev = c.listHead.prev
@@ -31,3 +31,52 @@ func TestLRUCache(t *testing.T) {
 	assert.Equal(t, cache.length, 0)
 	assert.Empty(t, cache.listHead)
 }
+
+func TestLRUCacheRing(t *testing.T) {
+	c := NewLRUCache[int, int](10)
+	cache := c.(*LRUCache[int, int])
+	for i := 0; i < 3; i++ {
+		cache.Put(i, i)
+	}
+	// hitting the head and putting a key twice keep a single ring over every key
+	_, ok := cache.Get(2)
+	assert.True(t, ok)
+	cache.Put(1, 10)
+	_, ok = cache.Get(0)
+	assert.True(t, ok)
+
+	seen := make(map[int]int)
+	cache.Range(func(k int, v int) bool {
+		seen[k] = v
+		return len(seen) <= 3
+	})
+	assert.Equal(t, map[int]int{0: 0, 1: 10, 2: 2}, seen)
+	assert.Equal(t, 3, cache.length)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, cache.Evict(i, func(int) bool { return true }))
+	}
+	assert.Nil(t, cache.listHead)
+}
+
+func TestLRUCacheCompact(t *testing.T) {
+	c := NewLRUCache[int, int](2)
+	cache := c.(*LRUCache[int, int])
+	for i := 0; i < 5; i++ {
+		cache.Put(i, i)
+	}
+	// odd values refuse eviction , compaction skips them instead of retrying
+	cache.Compact(func(k int, v int) bool { return v%2 == 0 })
+	assert.Equal(t, 2, cache.length)
+	_, ok := cache.cache[1]
+	assert.True(t, ok)
+	_, ok = cache.cache[3]
+	assert.True(t, ok)
+
+	// nothing can be evicted , it still returns
+	cache.Put(5, 5)
+	cache.Compact(func(int, int) bool { return false })
+	assert.Equal(t, 3, cache.length)
+	cache.Compact(func(int, int) bool { return true })
+	assert.Equal(t, 2, cache.length)
+}
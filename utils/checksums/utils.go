@@ -1,18 +1,150 @@
 package checksums
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
+	"sync"
 )
 
+var ErrUnknownAlgorithm = fmt.Errorf("unknown checksum algorithm")
+
+/*
+Checksum algorithms are identified by a single byte which gets persisted
+(heap manifest , heap file header) so the ids below can never be reused.
+CRC32IEEE is the zero value , everything written before algorithms existed used it.
+*/
+type Algorithm uint8
+
+const (
+	CRC32IEEE Algorithm = iota
+	CRC32C              // Castagnoli , hardware accelerated on amd64 (SSE4.2) and arm64
+	XXHash64
+)
+
+type Checksum interface {
+	// bytes the checksum occupies when stored
+	Size() int
+	Sum(buffer []byte) uint64
+}
+
+type checksumFunc struct {
+	size int
+	sum  func([]byte) uint64
+}
+
+func (c checksumFunc) Size() int                { return c.size }
+func (c checksumFunc) Sum(buffer []byte) uint64 { return c.sum(buffer) }
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var registryLock sync.RWMutex
+var registry = map[Algorithm]Checksum{
+	CRC32IEEE: checksumFunc{size: 4, sum: func(b []byte) uint64 { return uint64(crc32.ChecksumIEEE(b)) }},
+	CRC32C:    checksumFunc{size: 4, sum: func(b []byte) uint64 { return uint64(crc32.Checksum(b, castagnoliTable)) }},
+	XXHash64:  checksumFunc{size: 8, sum: xxHash64},
+}
+
+var names = map[Algorithm]string{
+	CRC32IEEE: "crc32-ieee",
+	CRC32C:    "crc32c",
+	XXHash64:  "xxhash64",
+}
+
+// Register plugs in another algorithm , size has to be 4 or 8 bytes
+func Register(algorithm Algorithm, name string, checksum Checksum) error {
+	if checksum.Size() != 4 && checksum.Size() != 8 {
+		return fmt.Errorf("checksum %s has unsupported size %d", name, checksum.Size())
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[algorithm]; ok {
+		return fmt.Errorf("checksum algorithm %d already registered as %s", algorithm, names[algorithm])
+	}
+	registry[algorithm] = checksum
+	names[algorithm] = name
+	return nil
+}
+
+func Get(algorithm Algorithm) (Checksum, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	checksum, ok := registry[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w : %d", ErrUnknownAlgorithm, algorithm)
+	}
+	return checksum, nil
+}
+
+// Size of the stored checksum , 0 for unknown algorithms
+func (a Algorithm) Size() int {
+	checksum, err := Get(a)
+	if err != nil {
+		return 0
+	}
+	return checksum.Size()
+}
+
+func (a Algorithm) String() string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	if name, ok := names[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(a))
+}
+
+// algorithm registered under name , for command line flags
+func ParseAlgorithm(name string) (Algorithm, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	for algorithm, registered := range names {
+		if registered == name {
+			return algorithm, nil
+		}
+	}
+	return 0, fmt.Errorf("%w : %s", ErrUnknownAlgorithm, name)
+}
+
+/*
+Calculate stores the checksum of buffer big endian in the first Size() bytes of location
+  - algorithms are never unregistered , once Get accepted one Calculate can not fail
+  - everything persisting checksums validates its algorithm with Get when it is opened
+    so an unregistered algorithm here is a bug and panics
+*/
+func Calculate(algorithm Algorithm, location []byte, buffer []byte) {
+	checksum, err := Get(algorithm)
+	if err != nil {
+		panic(err)
+	}
+	put(checksum, location, checksum.Sum(buffer))
+}
+
+// Verify compares the checksum of buffer with the one stored in location
+func Verify(algorithm Algorithm, location []byte, buffer []byte) bool {
+	checksum, err := Get(algorithm)
+	if err != nil || len(location) < checksum.Size() {
+		return false
+	}
+	expected := make([]byte, checksum.Size())
+	put(checksum, expected, checksum.Sum(buffer))
+	return bytes.Equal(expected, location[:checksum.Size()])
+}
+
+func put(checksum Checksum, location []byte, sum uint64) {
+	if checksum.Size() == 8 {
+		binary.BigEndian.PutUint64(location, sum)
+	} else {
+		binary.BigEndian.PutUint32(location, uint32(sum))
+	}
+}
+
 func CalculateCRC(checkSumLocation []byte, buffer []byte) {
 	chksum1 := crc32.ChecksumIEEE(buffer)
 	binary.BigEndian.PutUint32(checkSumLocation, chksum1)
 }
 
 func CompareCRC(buffer1 []byte, buffer2 []byte) bool {
-	if buffer1[0] != buffer2[0] || buffer1[1] != buffer2[1] || buffer1[2] != buffer2[2] || buffer1[3] != buffer2[3] {
-		return false
-	}
-	return true
+	return bytes.Equal(buffer1[:4], buffer2[:4])
 }
@@ -0,0 +1,41 @@
+package checksums
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksums(t *testing.T) {
+
+	check := []byte("123456789")
+
+	crc32ieee, err := Get(CRC32IEEE)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0xCBF43926), crc32ieee.Sum(check))
+
+	crc32c, err := Get(CRC32C)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0xE3069283), crc32c.Sum(check))
+
+	xxhash, err := Get(XXHash64)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, xxhash.Size())
+	assert.Equal(t, uint64(0xEF46DB3751D8E999), xxhash.Sum([]byte("")))
+	assert.Equal(t, uint64(0xD24EC4F1A98C6E5B), xxhash.Sum([]byte("a")))
+	assert.Equal(t, uint64(0x44BC2CF5AD770999), xxhash.Sum([]byte("abc")))
+
+	_, err = Get(Algorithm(200))
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+	// callers validate with Get up front , an unknown algorithm never gets an unset checksum
+	assert.Panics(t, func() { Calculate(Algorithm(200), make([]byte, 8), []byte("abc")) })
+
+	for _, algorithm := range []Algorithm{CRC32IEEE, CRC32C, XXHash64} {
+		buffer := make([]byte, 64)
+		copy(buffer[8:], "some page content that is long enough to hit every xxhash lane")
+		Calculate(algorithm, buffer[0:8], buffer[8:])
+		assert.True(t, Verify(algorithm, buffer[0:8], buffer[8:]), algorithm.String())
+		buffer[20] ^= 1
+		assert.False(t, Verify(algorithm, buffer[0:8], buffer[8:]), algorithm.String())
+	}
+}
@@ -0,0 +1,78 @@
+package checksums
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxHash64 (seed 0) , https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+// vars not consts , the spec relies on wrapping arithmetic
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	return acc*xxPrime1 + xxPrime4
+}
+
+func xxHash64(buffer []byte) uint64 {
+	n := len(buffer)
+	var h uint64
+
+	if n >= 32 {
+		v1 := xxPrime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1
+		for len(buffer) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(buffer[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(buffer[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(buffer[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(buffer[24:32]))
+			buffer = buffer[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(buffer) >= 8; buffer = buffer[8:] {
+		k1 := xxRound(0, binary.LittleEndian.Uint64(buffer[0:8]))
+		h ^= k1
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(buffer) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(buffer[0:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		buffer = buffer[4:]
+	}
+	for _, b := range buffer {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,129 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/xts"
+)
+
+var ErrKeyNotFound = fmt.Errorf("encryption key not found")
+
+/*
+KeyProvider hands out the keys pages are encrypted with
+  - keys are identified by an id which gets persisted in the heap file header , the key itself never is
+  - new heap files are encrypted with CurrentKeyID , older files keep the key they were created with
+    so rotating a key only needs CurrentKeyID to change and the old key to stay available
+  - keys are AES-XTS keys , 32 bytes (AES-128) or 64 bytes (AES-256)
+*/
+type KeyProvider interface {
+	Key(id uint32) ([]byte, error)
+	CurrentKeyID() uint32
+}
+
+// StaticKeyProvider serves keys from memory , meant for tests and local setups
+type StaticKeyProvider struct {
+	lock    sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewStaticKeyProvider(current uint32, keys map[uint32][]byte) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		keys:    keys,
+		current: current,
+	}
+}
+
+func (sp *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	key, ok := sp.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w : %d", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+func (sp *StaticKeyProvider) CurrentKeyID() uint32 {
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	return sp.current
+}
+
+// Rotate adds a key and makes it the one new files are created with
+func (sp *StaticKeyProvider) Rotate(id uint32, key []byte) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.keys[id] = key
+	sp.current = id
+}
+
+/*
+PageCipher encrypts pages with AES-XTS
+  - a page is split into UnitSize data units , each one encrypted with the tweak
+    pageNumber * unitsPerPage + unit index so no two units on disk share a tweak
+  - XTS keeps the size , a page encrypts to exactly PageSize bytes
+  - units that are all zeros on disk were never written (or were punched) and decrypt to zeros
+*/
+const UnitSize = 512
+
+type PageCipher struct {
+	cipher   *xts.Cipher
+	pageSize int
+}
+
+func NewPageCipher(key []byte, pageSize int) (*PageCipher, error) {
+	if pageSize%UnitSize != 0 {
+		return nil, fmt.Errorf("page size %d is not a multiple of the encryption unit %d", pageSize, UnitSize)
+	}
+	cipher, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+	return &PageCipher{
+		cipher:   cipher,
+		pageSize: pageSize,
+	}, nil
+}
+
+func (pc *PageCipher) tweak(pageNumber uint64, unit int) uint64 {
+	return pageNumber*uint64(pc.pageSize/UnitSize) + uint64(unit)
+}
+
+// Encrypt encrypts buffer in place , its length has to be a multiple of UnitSize
+func (pc *PageCipher) Encrypt(buffer []byte, pageNumber uint64) error {
+	if len(buffer)%UnitSize != 0 || len(buffer) > pc.pageSize {
+		return fmt.Errorf("can not encrypt %d bytes , expected a multiple of %d up to %d", len(buffer), UnitSize, pc.pageSize)
+	}
+	for unit := 0; unit*UnitSize < len(buffer); unit++ {
+		region := buffer[unit*UnitSize : (unit+1)*UnitSize]
+		pc.cipher.Encrypt(region, region, pc.tweak(pageNumber, unit))
+	}
+	return nil
+}
+
+// Decrypt decrypts buffer in place , all zero units are left as they are
+func (pc *PageCipher) Decrypt(buffer []byte, pageNumber uint64) error {
+	if len(buffer)%UnitSize != 0 || len(buffer) > pc.pageSize {
+		return fmt.Errorf("can not decrypt %d bytes , expected a multiple of %d up to %d", len(buffer), UnitSize, pc.pageSize)
+	}
+	for unit := 0; unit*UnitSize < len(buffer); unit++ {
+		region := buffer[unit*UnitSize : (unit+1)*UnitSize]
+		if isZero(region) {
+			continue
+		}
+		pc.cipher.Decrypt(region, region, pc.tweak(pageNumber, unit))
+	}
+	return nil
+}
+
+func isZero(buffer []byte) bool {
+	for _, b := range buffer {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
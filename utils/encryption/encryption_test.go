@@ -0,0 +1,54 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageCipher(t *testing.T) {
+
+	key := bytes.Repeat([]byte{7}, 64)
+	cipher, err := NewPageCipher(key, 4096)
+	assert.Nil(t, err)
+
+	page := bytes.Repeat([]byte("boro-db "), 4096/8)
+	encrypted := bytes.Clone(page)
+	assert.Nil(t, cipher.Encrypt(encrypted, 1))
+	assert.NotEqual(t, page, encrypted)
+
+	// the page number is the tweak , same content encrypts differently per page
+	other := bytes.Clone(page)
+	assert.Nil(t, cipher.Encrypt(other, 2))
+	assert.NotEqual(t, encrypted, other)
+
+	assert.Nil(t, cipher.Decrypt(encrypted, 1))
+	assert.Equal(t, page, encrypted)
+
+	// never written units stay zero
+	zero := make([]byte, 4096)
+	assert.Nil(t, cipher.Decrypt(zero, 1))
+	assert.Equal(t, make([]byte, 4096), zero)
+
+	assert.NotNil(t, cipher.Encrypt(make([]byte, 100), 1))
+	_, err = NewPageCipher(key, 1000)
+	assert.NotNil(t, err)
+	_, err = NewPageCipher([]byte("short"), 4096)
+	assert.NotNil(t, err)
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+
+	provider := NewStaticKeyProvider(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 64)})
+	assert.Equal(t, uint32(1), provider.CurrentKeyID())
+
+	_, err := provider.Key(2)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	provider.Rotate(2, bytes.Repeat([]byte{2}, 64))
+	assert.Equal(t, uint32(2), provider.CurrentKeyID())
+	key, err := provider.Key(1)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 64), key)
+}
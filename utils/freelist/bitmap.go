@@ -14,15 +14,32 @@ type FreeList interface {
 	LocsRange() [2]uint64
 	IsLocFree(page uint64) bool
 	CurrentBuffer() []byte
+	// Best fit free run of at least count locations , smallest run wins , lowest start on ties
+	FindRun(count uint64) (start uint64, length uint64, ok bool)
+	// Allocates count locations starting at start , all of them have to be free
+	AllocateRun(start uint64, count uint64) ([]uint64, error)
 }
 
+var ErrRunNotFree = errors.New("run is not free")
+
+/*
+Two level free space map over the persisted bitmap
+  - bitmap : one bit per location , 1 = allocated. this is what gets written to disk
+  - chunkFree : free locations per chunk of chunkLocs locations , lets allocation skip full chunks
+    without touching their bitmap bytes
+  - freePages : total free locations , O(1) accounting
+
+Allocation always hands out the lowest free locations first , freed pages get reused
+in address order which keeps the heap dense at the front.
+*/
+const chunkLocs = 512 // 64 bitmap bytes , one cache line
+
 type BitmapFreeList struct {
 	bitmap    []byte
-	next      []int  // Linked list of free pages
-	head      int    // Head of the free list
-	start     uint64 // Start of the address range
-	end       uint64 // End of the address range
-	freePages uint64 // Counter for free pages available
+	chunkFree []uint32 // free locations per chunk
+	start     uint64   // Start of the address range
+	end       uint64   // End of the address range
+	freePages uint64   // Counter for free pages available
 }
 
 func (fl *BitmapFreeList) CurrentBuffer() []byte {
@@ -40,28 +57,46 @@ func (fl *BitmapFreeList) TotalFreeLocs() uint64 {
 	return fl.freePages
 }
 
+// locations of the chunk with in the address range
+func (fl *BitmapFreeList) chunkRange(chunk int) (uint64, uint64) {
+	return max(uint64(chunk)*chunkLocs, fl.start), min(uint64(chunk+1)*chunkLocs, fl.end)
+}
+
+func (fl *BitmapFreeList) allocate(loc uint64) {
+	fl.bitmap[loc/8] |= 1 << (loc % 8)
+	fl.chunkFree[loc/chunkLocs]--
+	fl.freePages--
+}
+
 func (fl *BitmapFreeList) GetLocs(count uint64) ([]uint64, error) {
 	if count == 0 {
 		return nil, fmt.Errorf("no free pages available")
 	}
 
 	var pages []uint64
-	current := fl.head
 
-	for i := uint64(0); i < count; i++ {
-		if current == -1 {
-			break
+	for chunk := range fl.chunkFree {
+		if fl.chunkFree[chunk] == 0 {
+			continue
+		}
+		lo, hi := fl.chunkRange(chunk)
+		for loc := lo; loc < hi; loc++ {
+			if fl.bitmap[loc/8] == 0xFF {
+				// whole byte allocated
+				loc |= 7
+				continue
+			}
+			if fl.bitmap[loc/8]&(1<<(loc%8)) != 0 {
+				continue
+			}
+			fl.allocate(loc)
+			pages = append(pages, loc)
+			if uint64(len(pages)) == count {
+				return pages, nil
+			}
 		}
-		pages = append(pages, uint64(current))
-		fl.bitmap[current/8] |= 1 << (current % 8) // Mark page as allocated
-		prev := current
-		current = fl.next[current] // Move to the next free page
-		fl.next[prev] = -1         // Remove the allocated page from the free list
-		fl.freePages--             // Decrement the free pages counter
 	}
 
-	fl.head = current // Update the head to the new top of the free list
-
 	return pages, nil
 }
 
@@ -82,63 +117,88 @@ func (fl *BitmapFreeList) ReleaseLoc(pages []uint64) error {
 		}
 
 		fl.bitmap[page/8] &^= 1 << (page % 8) // Mark page as free
-		fl.next[page] = fl.head               // Point the released page to the current head
-		fl.head = int(page)                   // Make the released page the new head
-		fl.freePages++                        // Increment the free pages counter
+		fl.chunkFree[page/chunkLocs]++
+		fl.freePages++ // Increment the free pages counter
 	}
 
 	return nil
 }
 
-func (fl *BitmapFreeList) LocsRange() [2]uint64 {
-	return [2]uint64{fl.start, fl.end}
-}
-
-/*
- Cache friendly free list implementation
- - Bitmap for serialization and markers
- - Linked list for fast allocation and deallocation
-*/
+func (fl *BitmapFreeList) FindRun(count uint64) (uint64, uint64, bool) {
+	if count == 0 {
+		return 0, 0, false
+	}
+	bestStart, bestLength := uint64(0), uint64(0)
+	found := false
 
-func NewBitmapFreeList(bitmap []byte, start, end uint64) FreeList {
-	size := len(bitmap) * 8
-	next := make([]int, size)
-	head := -1             // Start with no free pages
-	prev := -1             // Track the previous free page
-	freePages := uint64(0) // Counter for free pages
-
-	// Initialize the linked list of free pages based on the bitmap
-	for i := 0; i < size; i++ {
-		page := uint64(i)
-		if page < start || page >= end {
-			next[i] = -1 // Mark as out of range
+	runStart, runLength := uint64(0), uint64(0)
+	consider := func() {
+		if runLength >= count && (!found || runLength < bestLength) {
+			bestStart, bestLength, found = runStart, runLength, true
+		}
+	}
+	for loc := fl.start; loc < fl.end && loc < uint64(len(fl.bitmap))*8; loc++ {
+		if fl.chunkFree[loc/chunkLocs] == 0 {
+			// full chunk ends the run , jump to the last location of the chunk
+			consider()
+			runLength = 0
+			loc = loc/chunkLocs*chunkLocs + chunkLocs - 1
 			continue
 		}
-
-		if bitmap[i/8]&(1<<(i%8)) == 0 { // Check if the page is free
-			if head == -1 {
-				head = i // Set the head to the first free page
-			} else {
-				next[prev] = i // Point the previous free page to the current free page
+		if fl.bitmap[loc/8]&(1<<(loc%8)) == 0 {
+			if runLength == 0 {
+				runStart = loc
 			}
-			prev = i    // Update the previous free page
-			freePages++ // Increment the free pages counter
-		} else {
-			next[i] = -1 // Mark as allocated
+			runLength++
+			continue
+		}
+		consider()
+		runLength = 0
+	}
+	consider()
+	return bestStart, bestLength, found
+}
+
+func (fl *BitmapFreeList) AllocateRun(start uint64, count uint64) ([]uint64, error) {
+	if count == 0 || start < fl.start || start+count > fl.end {
+		return nil, fmt.Errorf("%w : run %d-%d outside of %d-%d", ErrRunNotFree, start, start+count, fl.start, fl.end)
+	}
+	for loc := start; loc < start+count; loc++ {
+		if fl.bitmap[loc/8]&(1<<(loc%8)) != 0 {
+			return nil, fmt.Errorf("%w : %d is allocated", ErrRunNotFree, loc)
 		}
 	}
 
-	// Ensure the last free page in the range points to -1
-	if prev != -1 {
-		next[prev] = -1 // Terminate the linked list
+	locs := make([]uint64, 0, count)
+	for loc := start; loc < start+count; loc++ {
+		fl.allocate(loc)
+		locs = append(locs, loc)
+	}
+	return locs, nil
+}
+
+func (fl *BitmapFreeList) LocsRange() [2]uint64 {
+	return [2]uint64{fl.start, fl.end}
+}
+
+func NewBitmapFreeList(bitmap []byte, start, end uint64) FreeList {
+	size := uint64(len(bitmap)) * 8
+	end = min(end, size)
+	chunkFree := make([]uint32, (size+chunkLocs-1)/chunkLocs)
+	freePages := uint64(0)
+
+	for loc := start; loc < end; loc++ {
+		if bitmap[loc/8]&(1<<(loc%8)) == 0 {
+			chunkFree[loc/chunkLocs]++
+			freePages++
+		}
 	}
 
 	return &BitmapFreeList{
 		bitmap:    bitmap,
-		next:      next,
-		head:      head,
+		chunkFree: chunkFree,
 		start:     start,
 		end:       end,
-		freePages: freePages, // Initialize the free pages counter
+		freePages: freePages,
 	}
 }
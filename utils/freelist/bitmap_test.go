@@ -30,7 +30,8 @@ func TestBitMapFreeList(t *testing.T) {
 	pages, err = freelist.GetLocs(1)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(pages))
-	assert.Equal(t, uint64(2), pages[0])
+	// lowest free location first
+	assert.Equal(t, uint64(0), pages[0])
 
 	pages, err = freelist.GetLocs(50)
 
@@ -39,3 +40,42 @@ func TestBitMapFreeList(t *testing.T) {
 	assert.True(t, freelist.TotalFreeLocs() == 0)
 
 }
+
+func TestBitMapFreeListRuns(t *testing.T) {
+	bitmap := make([]byte, 4)
+	freelist := NewBitmapFreeList(bitmap, 0, 32)
+
+	// free runs : 0-3 (4) , 8-9 (2) , 12-31 (20)
+	_, err := freelist.AllocateRun(4, 4)
+	assert.Nil(t, err)
+	_, err = freelist.AllocateRun(10, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(26), freelist.TotalFreeLocs())
+
+	start, length, ok := freelist.FindRun(2)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(8), start)
+	assert.Equal(t, uint64(2), length)
+
+	start, length, ok = freelist.FindRun(3)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), start)
+	assert.Equal(t, uint64(4), length)
+
+	_, _, ok = freelist.FindRun(21)
+	assert.False(t, ok)
+
+	_, err = freelist.AllocateRun(2, 3)
+	assert.ErrorIs(t, err, ErrRunNotFree)
+
+	locs, err := freelist.AllocateRun(12, 20)
+	assert.Nil(t, err)
+	assert.Len(t, locs, 20)
+	assert.Equal(t, uint64(12), locs[0])
+
+	// the per chunk free counts skip what the runs took , only the rest is handed out
+	locs, err = freelist.GetLocs(10)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{0, 1, 2, 3, 8, 9}, locs)
+	assert.Equal(t, uint64(0), freelist.TotalFreeLocs())
+}
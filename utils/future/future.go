@@ -0,0 +1,82 @@
+package future
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+Future is a single assignment result of an async operation
+- Get blocks until the value is available or the context is done
+- cancelling the context only stops the wait , the operation itself keeps running
+*/
+type Future[T any] struct {
+	done  chan struct{}
+	once  sync.Once
+	value T
+	err   error
+}
+
+func newFuture[T any]() *Future[T] {
+	return &Future[T]{
+		done: make(chan struct{}),
+	}
+}
+
+// first completion wins, later ones are ignored
+func (f *Future[T]) complete(value T, err error) {
+	f.once.Do(func() {
+		f.value = value
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Done is closed once the result is available
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *Future[T]) Get(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var def T
+		return def, ctx.Err()
+	}
+}
+
+// Go runs fn on its own goroutine and resolves the future with its result
+func Go[T any](fn func() (T, error)) *Future[T] {
+	f := newFuture[T]()
+	go func() {
+		f.complete(fn())
+	}()
+	return f
+}
+
+// FromCallback adapts callback style apis (onRead func(T, error)) into a future
+// start runs on its own goroutine , the callbacks underneath may be synchronous
+func FromCallback[T any](start func(func(T, error))) *Future[T] {
+	f := newFuture[T]()
+	go start(f.complete)
+	return f
+}
+
+/*
+Await runs start on the calling goroutine and waits for its callback
+  - the context is only checked before starting , ctx.Err() means the operation never ran
+  - once started the result is always waited for , an error is the operation's own
+    so a caller never has to guess whether a write that "failed" still lands later
+*/
+func Await[T any](ctx context.Context, start func(func(T, error))) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var def T
+		return def, err
+	}
+	f := newFuture[T]()
+	start(f.complete)
+	<-f.done
+	return f.value, f.err
+}
@@ -0,0 +1,46 @@
+package future
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuture(t *testing.T) {
+
+	value, err := Await(context.Background(), func(onDone func(int, error)) {
+		onDone(42, nil)
+		onDone(7, errors.New("ignored second completion"))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 42, value)
+
+	f := Go(func() (string, error) {
+		return "", errors.New("failed")
+	})
+	<-f.Done()
+	_, err = f.Get(context.Background())
+	assert.EqualError(t, err, "failed")
+
+	// a started operation is waited for past the deadline , its result is what comes back
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	value, err = Await(ctx, func(onDone func(int, error)) {
+		go func() {
+			<-ctx.Done()
+			onDone(1, nil)
+		}()
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, value)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Await(cancelled, func(onDone func(int, error)) {
+		t.Error("operation should not start with a cancelled context")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
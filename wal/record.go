@@ -0,0 +1,73 @@
+package wal
+
+import (
+	"boro-db/utils/checksums"
+	"encoding/binary"
+	"fmt"
+)
+
+var ErrRecordCorrupted = fmt.Errorf("wal record corrupted")
+
+/*
+WAL record
+┌──────────────────────────────────────────────────────────────┐
+| length (4byte) | checksum (4 or 8 byte)                      |
+| payload (length bytes)                                       |
+└──────────────────────────────────────────────────────────────┘
+- checksum covers the length and the payload , WalOptions.ChecksumAlgorithm decides its size
+- a zero length marks the end of the written records in a segment
+*/
+const recordLengthSize = 4
+
+func recordHeaderSize(algorithm checksums.Algorithm) int {
+	return recordLengthSize + algorithm.Size()
+}
+
+func recordSize(algorithm checksums.Algorithm, payloadSize int) int {
+	return recordHeaderSize(algorithm) + payloadSize
+}
+
+// encodes the record into buffer , returns the bytes used
+func encodeRecord(algorithm checksums.Algorithm, buffer []byte, payload []byte) (int, error) {
+	checksum, err := checksums.Get(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	size := recordSize(algorithm, len(payload))
+	if len(buffer) < size {
+		return 0, fmt.Errorf("record of %d bytes does not fit in %d bytes", size, len(buffer))
+	}
+	binary.BigEndian.PutUint32(buffer[0:recordLengthSize], uint32(len(payload)))
+	copy(buffer[recordHeaderSize(algorithm):size], payload)
+	checksums.Calculate(algorithm, buffer[recordLengthSize:recordLengthSize+checksum.Size()], recordChecksumInput(algorithm, buffer[:size]))
+	return size, nil
+}
+
+/*
+decodes the record at the start of buffer , returns the payload and the bytes used
+a zero length returns (nil , 0 , nil) , the end of the records
+*/
+func decodeRecord(algorithm checksums.Algorithm, buffer []byte) ([]byte, int, error) {
+	if len(buffer) < recordHeaderSize(algorithm) {
+		return nil, 0, nil
+	}
+	length := int(binary.BigEndian.Uint32(buffer[0:recordLengthSize]))
+	if length == 0 {
+		return nil, 0, nil
+	}
+	size := recordSize(algorithm, length)
+	if size > len(buffer) {
+		return nil, 0, fmt.Errorf("%w : length %d past the end of the buffer", ErrRecordCorrupted, length)
+	}
+	if !checksums.Verify(algorithm, buffer[recordLengthSize:recordHeaderSize(algorithm)], recordChecksumInput(algorithm, buffer[:size])) {
+		return nil, 0, fmt.Errorf("%w : checksum mismatch", ErrRecordCorrupted)
+	}
+	return buffer[recordHeaderSize(algorithm):size], size, nil
+}
+
+// length followed by payload , the checksum slot is skipped
+func recordChecksumInput(algorithm checksums.Algorithm, record []byte) []byte {
+	input := make([]byte, 0, len(record)-algorithm.Size())
+	input = append(input, record[0:recordLengthSize]...)
+	return append(input, record[recordHeaderSize(algorithm):]...)
+}
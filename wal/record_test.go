@@ -0,0 +1,38 @@
+package wal
+
+import (
+	"boro-db/utils/checksums"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordEncoding(t *testing.T) {
+
+	for _, algorithm := range []checksums.Algorithm{checksums.CRC32IEEE, checksums.CRC32C, checksums.XXHash64} {
+		buffer := make([]byte, 64)
+		payload := []byte("hello wal")
+
+		size, err := encodeRecord(algorithm, buffer, payload)
+		assert.Nil(t, err)
+		assert.Equal(t, recordSize(algorithm, len(payload)), size)
+
+		decoded, decodedSize, err := decodeRecord(algorithm, buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, size, decodedSize)
+		assert.Equal(t, payload, decoded)
+
+		// the zeroed tail is the end of the records
+		decoded, decodedSize, err = decodeRecord(algorithm, buffer[size:])
+		assert.Nil(t, err)
+		assert.Nil(t, decoded)
+		assert.Equal(t, 0, decodedSize)
+
+		buffer[size-1] ^= 0xFF
+		_, _, err = decodeRecord(algorithm, buffer)
+		assert.ErrorIs(t, err, ErrRecordCorrupted)
+	}
+
+	_, err := encodeRecord(checksums.CRC32C, make([]byte, 8), []byte("too long"))
+	assert.NotNil(t, err)
+}
@@ -2,25 +2,223 @@ package wal
 
 import (
 	"boro-db/heap"
-	"boro-db/paging"
+	"boro-db/utils/checksums"
+	"boro-db/utils/encryption"
+	"boro-db/utils/future"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
 
 	"github.com/phuslu/log"
 )
 
+// shared with heap so callers can check errors.Is(err, ErrClosed) at any layer
+var ErrClosed = heap.ErrClosed
+var ErrEmptyRecord = fmt.Errorf("wal record is empty")
+
 type Wal struct {
-	logger  log.Logger
-	heap    heap.HeapFile
-	page    paging.PageSystem
-	options *WalOptions
+	logger   log.Logger
+	heap     heap.HeapFile
+	options  *WalOptions
+	pageSize int
+
+	// serializes appends , the tail is only moved under it
+	lock sync.Mutex
+	// log offset the next record is written at
+	tail uint64
+	// copy of the page the tail is in , bytes past the tail are zero
+	tailPage []byte
 }
 
 type WalOptions struct {
 	FileDirectory string
 	SegmentSizes  uint32
+	// checksum of every record , pinned by the heap manifest of the wal directory
+	ChecksumAlgorithm checksums.Algorithm
+	// encrypts the wal segments , see heap.HeapFileOptions
+	KeyProvider encryption.KeyProvider
 }
 
+/*
+Log layout
+┌──────────────────────────────────────────────────────────────┐
+| page 0 : record | record | rec-                              |
+| page 1 : -ord | record | 0 0 0 0 0 ......                    |
+└──────────────────────────────────────────────────────────────┘
+  - the segments form one byte stream , records are packed back to back and may span pages
+  - the lsn of a record is the log offset right after it , so lsns grow with every append and 0 is never one
+  - Append writes the pages the record touches and returns once the heap has fsynced them
+    the page holding the tail is rewritten by the next append , records already in it ride along
+  - on open the log is scanned from the start , the first zero length or checksum mismatch is the tail
+    a record torn by a crash was never acknowledged and is overwritten by the next append
+*/
+
+// Appends data as one record , onWrite gets its lsn once it is durable
 func (w *Wal) Append(data []byte, onWrite func(uint64, error)) {
+	if len(data) == 0 {
+		onWrite(0, ErrEmptyRecord)
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	record := make([]byte, recordSize(w.options.ChecksumAlgorithm, len(data)))
+	if _, err := encodeRecord(w.options.ChecksumAlgorithm, record, data); err != nil {
+		onWrite(0, err)
+		return
+	}
+
+	pageSize := uint64(w.pageSize)
+	end := w.tail + uint64(len(record))
+	if err := w.ensurePages((end + pageSize - 1) / pageSize); err != nil {
+		w.logger.Error().Err(err).Msg("error extending wal")
+		onWrite(0, err)
+		return
+	}
+
+	ctx := context.Background()
+	first := w.heap.ValidAddressRange()[0]
+	// the tail page is only replaced once every write went through
+	page := append([]byte(nil), w.tailPage...)
+	offset, written := w.tail, 0
+	for {
+		n := copy(page[offset%pageSize:], record[written:])
+		if err := w.heap.WriteContext(ctx, first+offset/pageSize, page); err != nil {
+			w.logger.Error().Err(err).Msg(fmt.Sprintf("error writing wal page %d", offset/pageSize))
+			onWrite(0, err)
+			return
+		}
+		written += n
+		offset += uint64(n)
+		if written == len(record) {
+			break
+		}
+		page = make([]byte, w.pageSize)
+	}
 
+	w.tail = end
+	w.tailPage = page
+	if end%pageSize == 0 {
+		w.tailPage = make([]byte, w.pageSize)
+	}
+	onWrite(end, nil)
+}
+
+// blocking variant of Append
+func (w *Wal) AppendContext(ctx context.Context, data []byte) (uint64, error) {
+	return future.Await(ctx, func(onWrite func(uint64, error)) {
+		w.Append(data, onWrite)
+	})
+}
+
+// lsn of the last durable record , 0 for an empty log
+func (w *Wal) LastLSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.tail
+}
+
+/*
+Replay calls fn for every record with an lsn past after , oldest first
+an error from fn stops the replay and is returned
+*/
+func (w *Wal) Replay(ctx context.Context, after uint64, fn func(lsn uint64, payload []byte) error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := w.scan(ctx, func(lsn uint64, payload []byte) error {
+		if lsn <= after {
+			return nil
+		}
+		return fn(lsn, payload)
+	})
+	return err
+}
+
+// caller must hold the lock
+func (w *Wal) ensurePages(pageCount uint64) error {
+	addressRange := w.heap.ValidAddressRange()
+	// wraps to 0 for an empty address space
+	available := addressRange[1] + 1 - addressRange[0]
+	if available >= pageCount {
+		return nil
+	}
+	segmentPages := uint64(w.options.SegmentSizes) / uint64(w.pageSize)
+	return w.heap.ExtendBy(int(max(pageCount-available, segmentPages)))
+}
+
+/*
+reads the records from the start of the log , returns the offset past the last good record
+caller must hold the lock
+*/
+func (w *Wal) scan(ctx context.Context, fn func(lsn uint64, payload []byte) error) (uint64, error) {
+	addressRange := w.heap.ValidAddressRange()
+	pageCount := addressRange[1] + 1 - addressRange[0]
+	algorithm := w.options.ChecksumAlgorithm
+
+	// bytes of the log from start on
+	window := make([]byte, 0, w.pageSize)
+	start, next := uint64(0), uint64(0)
+	for {
+		if len(window) >= recordLengthSize {
+			length := int(binary.BigEndian.Uint32(window[0:recordLengthSize]))
+			if length == 0 {
+				return start, nil
+			}
+			if len(window) >= recordSize(algorithm, length) {
+				payload, size, err := decodeRecord(algorithm, window)
+				if err != nil {
+					w.logger.Warn().Err(err).Msg(fmt.Sprintf("wal ends in a torn record at offset %d", start))
+					return start, nil
+				}
+				if err := fn(start+uint64(size), payload); err != nil {
+					return start, err
+				}
+				start += uint64(size)
+				window = window[size:]
+				continue
+			}
+		}
+		if next == pageCount {
+			// the record runs past the end of the log , torn as well
+			return start, nil
+		}
+		buffer := make([]byte, w.pageSize)
+		if err := w.heap.ReadContext(ctx, addressRange[0]+next, buffer); err != nil {
+			w.logger.Error().Err(err).Msg(fmt.Sprintf("error reading wal page %d", next))
+			return start, err
+		}
+		window = append(append(make([]byte, 0, len(window)+w.pageSize), window...), buffer...)
+		next++
+	}
+}
+
+// finds the tail after a restart , caller must hold the lock
+func (w *Wal) recover(ctx context.Context) error {
+	tail, err := w.scan(ctx, func(uint64, []byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	w.tail = tail
+	w.tailPage = make([]byte, w.pageSize)
+	if inPage := tail % uint64(w.pageSize); inPage != 0 {
+		pageNumber := w.heap.ValidAddressRange()[0] + tail/uint64(w.pageSize)
+		if err := w.heap.ReadContext(ctx, pageNumber, w.tailPage); err != nil {
+			return err
+		}
+		// drops what is left of a torn record
+		clear(w.tailPage[inPage:])
+	}
+	return nil
+}
+
+// Close closes the segment files , every appended record is already durable
+func (w *Wal) Close(ctx context.Context) error {
+	if err := w.heap.Close(ctx); err != nil {
+		w.logger.Error().Err(err).Msg("error closing heap")
+		return err
+	}
+	return nil
 }
 
 func NewWal(logger log.Logger, options *WalOptions) (*Wal, error) {
@@ -28,6 +226,8 @@ func NewWal(logger log.Logger, options *WalOptions) (*Wal, error) {
 		PageSizeByte:        4096,
 		FileDirectory:       options.FileDirectory,
 		MaxHeapFileSizeByte: options.SegmentSizes,
+		ChecksumAlgorithm:   options.ChecksumAlgorithm,
+		KeyProvider:         options.KeyProvider,
 	}
 	heapfs, err := heap.NewHeap(logger, heapOptions)
 
@@ -36,22 +236,16 @@ func NewWal(logger log.Logger, options *WalOptions) (*Wal, error) {
 		return nil, err
 	}
 
-	pagesys, err := paging.NewPageSystem(logger, heapfs, paging.PageSystemOption{
-		HeapFileOptions:              *heapOptions,
-		PageBufferCacheSize:          int(options.SegmentSizes) / int(heapOptions.PageSizeByte),
-		BufferPoolEvictionIntervalms: 100,
-		BufferPoolFlushIntervalms:    100,
-	})
-
-	if err != nil {
-		logger.Error().Err(err).Msg("error creating paging")
+	w := &Wal{
+		logger:   logger,
+		heap:     heapfs,
+		options:  options,
+		pageSize: int(heapOptions.PageSizeByte),
+	}
+	if err := w.recover(context.Background()); err != nil {
+		logger.Error().Err(err).Msg("error recovering wal tail")
+		w.Close(context.Background())
 		return nil, err
 	}
-
-	return &Wal{
-		logger:  logger,
-		heap:    heapfs,
-		page:    pagesys,
-		options: options,
-	}, nil
+	return w, nil
 }
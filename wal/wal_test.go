@@ -0,0 +1,116 @@
+package wal
+
+import (
+	"boro-db/logging"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestWal(t *testing.T, dir string) *Wal {
+	w, err := NewWal(*logging.CreateDebugLogger(), &WalOptions{
+		FileDirectory: dir,
+		SegmentSizes:  4096 * 8,
+	})
+	assert.Nil(t, err)
+	return w
+}
+
+func collect(t *testing.T, w *Wal, after uint64) ([]uint64, [][]byte) {
+	lsns := make([]uint64, 0)
+	payloads := make([][]byte, 0)
+	err := w.Replay(context.Background(), after, func(lsn uint64, payload []byte) error {
+		lsns = append(lsns, lsn)
+		payloads = append(payloads, bytes.Clone(payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	return lsns, payloads
+}
+
+func TestWalAppendReplay(t *testing.T) {
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-wal-append")
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	w := openTestWal(t, dir)
+	_, err := w.AppendContext(ctx, nil)
+	assert.ErrorIs(t, err, ErrEmptyRecord)
+
+	// small records share pages , the large ones span several
+	records := [][]byte{
+		[]byte("create table users"),
+		bytes.Repeat([]byte{'a'}, 5000),
+		[]byte("drop table users"),
+		bytes.Repeat([]byte{'b'}, 4096*3),
+	}
+	lsns := make([]uint64, 0)
+	for _, record := range records {
+		lsn, err := w.AppendContext(ctx, record)
+		assert.Nil(t, err)
+		if len(lsns) > 0 {
+			assert.Greater(t, lsn, lsns[len(lsns)-1])
+		}
+		lsns = append(lsns, lsn)
+	}
+	assert.Equal(t, lsns[len(lsns)-1], w.LastLSN())
+	assert.Nil(t, w.Close(ctx))
+
+	w = openTestWal(t, dir)
+	assert.Equal(t, lsns[len(lsns)-1], w.LastLSN())
+	replayedLSNs, payloads := collect(t, w, 0)
+	assert.Equal(t, lsns, replayedLSNs)
+	assert.Equal(t, records, payloads)
+
+	replayedLSNs, payloads = collect(t, w, lsns[1])
+	assert.Equal(t, lsns[2:], replayedLSNs)
+	assert.Equal(t, records[2:], payloads)
+
+	// appends continue after the recovered tail
+	lsn, err := w.AppendContext(ctx, []byte("create index users_id"))
+	assert.Nil(t, err)
+	_, payloads = collect(t, w, lsns[len(lsns)-1])
+	assert.Equal(t, [][]byte{[]byte("create index users_id")}, payloads)
+	assert.Equal(t, lsn, w.LastLSN())
+	assert.Nil(t, w.Close(ctx))
+}
+
+func TestWalTornTail(t *testing.T) {
+	pt, _ := os.Getwd()
+	dir := filepath.Join(pt, "test-wal-torn")
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	w := openTestWal(t, dir)
+	first, err := w.AppendContext(ctx, []byte("first"))
+	assert.Nil(t, err)
+	_, err = w.AppendContext(ctx, []byte("second"))
+	assert.Nil(t, err)
+
+	// tear the last byte of the second record
+	page := make([]byte, w.pageSize)
+	assert.Nil(t, w.heap.ReadContext(ctx, 0, page))
+	page[w.LastLSN()-1] ^= 0xFF
+	assert.Nil(t, w.heap.WriteContext(ctx, 0, page))
+	assert.Nil(t, w.Close(ctx))
+
+	w = openTestWal(t, dir)
+	assert.Equal(t, first, w.LastLSN())
+	_, payloads := collect(t, w, 0)
+	assert.Equal(t, [][]byte{[]byte("first")}, payloads)
+
+	// the torn record is overwritten
+	_, err = w.AppendContext(ctx, []byte("third"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close(ctx))
+
+	w = openTestWal(t, dir)
+	_, payloads = collect(t, w, 0)
+	assert.Equal(t, [][]byte{[]byte("first"), []byte("third")}, payloads)
+	assert.Nil(t, w.Close(ctx))
+}